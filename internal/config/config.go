@@ -1,9 +1,15 @@
 package config
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"nano-backend/internal/crypto"
 )
 
 type Config struct {
@@ -12,11 +18,36 @@ type Config struct {
 	InitAdminUsername      string
 	InitAdminPassword      string
 	SessionTTLHours        int
+	AdminSessionTTLHours   int // 0 = SessionTTLHours
+	UserSessionTTLHours    int // 0 = SessionTTLHours
 	DefaultProviderHost    string
-	DefaultProviderAPIKey  string
+	DefaultProviderAPIKey  crypto.SecretString
 	APIKeyEncryptionSecret string
+	PasswordScryptN        int
+	PasswordScryptR        int
+	PasswordScryptP        int
+	FileTokenSecret        string
+	FileTokenTTLHours      int
 	FileRetentionHours     int
+	CleanupIntervalMinutes int
+	SessionCleanupMinutes  int // 0 = CleanupIntervalMinutes
 	ImageBatchMax          int
+	ImageMaxReferences     int
+	ImageMaxMegapixels     int
+	UploadMaxWidth         int // 0 = unlimited
+	UploadMaxHeight        int // 0 = unlimited
+	UploadDownscale        bool
+	ReferenceMaxEdge       int // 0 = send references as stored
+	GenerationDedupeSecs   int
+	DefaultImageAspect     string
+	DefaultImageSize       string
+	DefaultVideoAspect     string
+	DefaultVideoSize       string
+	TranscodeOutputs       bool
+	DownloadTimeoutSeconds int
+	DownloadAuthProviders  string
+	FractionProgressHosts  string
+	UserStorageQuotaMB     int
 	CorsOrigins            string
 	DataDir                string
 	StorageDir             string
@@ -29,21 +60,135 @@ func Load() *Config {
 		publicBaseURL = "http://" + publicBaseURL
 	}
 
+	apiKeyEncryptionSecret := getEnv("API_KEY_ENCRYPTION_SECRET", "PLEASE_CHANGE_THIS_SECRET_32BYTES")
+
 	return &Config{
 		Port:                   getEnv("PORT", "4000"),
 		PublicBaseURL:          publicBaseURL,
 		InitAdminUsername:      getEnv("INIT_ADMIN_USERNAME", "admin"),
 		InitAdminPassword:      getEnv("INIT_ADMIN_PASSWORD", "admin123456"),
 		SessionTTLHours:        getEnvInt("SESSION_TTL_HOURS", 168),
+		AdminSessionTTLHours:   getEnvInt("SESSION_TTL_HOURS_ADMIN", 0),
+		UserSessionTTLHours:    getEnvInt("SESSION_TTL_HOURS_USER", 0),
 		DefaultProviderHost:    getEnv("DEFAULT_PROVIDER_HOST", "https://grsai.dakka.com.cn"),
-		DefaultProviderAPIKey:  getEnv("DEFAULT_PROVIDER_API_KEY", ""),
-		APIKeyEncryptionSecret: getEnv("API_KEY_ENCRYPTION_SECRET", "PLEASE_CHANGE_THIS_SECRET_32BYTES"),
+		DefaultProviderAPIKey:  crypto.SecretString(getEnv("DEFAULT_PROVIDER_API_KEY", "")),
+		APIKeyEncryptionSecret: apiKeyEncryptionSecret,
+		PasswordScryptN:        getEnvInt("PASSWORD_SCRYPT_N", 32768),
+		PasswordScryptR:        getEnvInt("PASSWORD_SCRYPT_R", 8),
+		PasswordScryptP:        getEnvInt("PASSWORD_SCRYPT_P", 1),
+		FileTokenSecret:        getEnv("FILE_TOKEN_SECRET", crypto.DeriveSecret(apiKeyEncryptionSecret, "nano-backend file tokens")),
+		FileTokenTTLHours:      getEnvInt("FILE_TOKEN_TTL_HOURS", 24),
 		FileRetentionHours:     getEnvInt("FILE_RETENTION_HOURS", 168),
+		CleanupIntervalMinutes: getEnvInt("CLEANUP_INTERVAL_MINUTES", 60),
+		SessionCleanupMinutes:  getEnvInt("SESSION_CLEANUP_INTERVAL_MINUTES", 0),
 		ImageBatchMax:          getEnvInt("IMAGE_BATCH_MAX", 12),
+		ImageMaxReferences:     getEnvInt("IMAGE_MAX_REFERENCES", 0),
+		ImageMaxMegapixels:     getEnvInt("IMAGE_MAX_MEGAPIXELS", 50),
+		UploadMaxWidth:         getEnvInt("UPLOAD_MAX_WIDTH", 0),
+		UploadMaxHeight:        getEnvInt("UPLOAD_MAX_HEIGHT", 0),
+		UploadDownscale:        getEnvBool("UPLOAD_DOWNSCALE", false),
+		ReferenceMaxEdge:       getEnvInt("REFERENCE_MAX_EDGE", 0),
+		GenerationDedupeSecs:   getEnvInt("GENERATION_DEDUPE_SECONDS", 10),
+		DefaultImageAspect:     getEnv("DEFAULT_IMAGE_ASPECT_RATIO", "auto"),
+		DefaultImageSize:       getEnv("DEFAULT_IMAGE_SIZE", ""),
+		DefaultVideoAspect:     getEnv("DEFAULT_VIDEO_ASPECT_RATIO", "9:16"),
+		DefaultVideoSize:       getEnv("DEFAULT_VIDEO_SIZE", "small"),
+		TranscodeOutputs:       getEnvBool("TRANSCODE_OUTPUTS", false),
+		DownloadTimeoutSeconds: getEnvInt("DOWNLOAD_TIMEOUT_SECONDS", 120),
+		DownloadAuthProviders:  getEnv("DOWNLOAD_AUTH_PROVIDERS", ""),
+		FractionProgressHosts:  getEnv("FRACTION_PROGRESS_HOSTS", ""),
+		UserStorageQuotaMB:     getEnvInt("USER_STORAGE_QUOTA_MB", 0),
 		CorsOrigins:            getEnv("CORS_ORIGINS", "*"),
-		DataDir:                "data",
-		StorageDir:             "storage",
+		DataDir:                getEnvPath("DATA_DIR", "data"),
+		StorageDir:             getEnvPath("STORAGE_DIR", "storage"),
+	}
+}
+
+// SessionTTLForRole returns the session lifetime in hours for a role, falling back to SessionTTLHours
+func (c *Config) SessionTTLForRole(role string) int {
+	ttl := 0
+	switch role {
+	case "admin":
+		ttl = c.AdminSessionTTLHours
+	case "user":
+		ttl = c.UserSessionTTLHours
+	}
+	if ttl <= 0 {
+		return c.SessionTTLHours
+	}
+	return ttl
+}
+
+// CleanupInterval is how often expired files are removed; non-positive values fall back to an hour
+func (c *Config) CleanupInterval() time.Duration {
+	if c.CleanupIntervalMinutes <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.CleanupIntervalMinutes) * time.Minute
+}
+
+// SessionCleanupInterval is how often expired sessions are removed, defaulting to CleanupInterval
+func (c *Config) SessionCleanupInterval() time.Duration {
+	if c.SessionCleanupMinutes <= 0 {
+		return c.CleanupInterval()
+	}
+	return time.Duration(c.SessionCleanupMinutes) * time.Minute
+}
+
+// ForwardsDownloadAuth reports whether result downloads for the provider type should carry the
+// provider's API key (DOWNLOAD_AUTH_PROVIDERS, comma-separated, e.g. "openai,grsai")
+func (c *Config) ForwardsDownloadAuth(providerType string) bool {
+	for _, t := range strings.Split(c.DownloadAuthProviders, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), providerType) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportsFractionProgress reports whether the GRS-compatible provider at providerHost sends progress
+// as a 0-1 fraction rather than a percentage (FRACTION_PROGRESS_HOSTS, comma-separated hostnames)
+func (c *Config) ReportsFractionProgress(providerHost string) bool {
+	host := providerHost
+	if u, err := url.Parse(providerHost); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	for _, h := range strings.Split(c.FractionProgressHosts, ",") {
+		if h = strings.TrimSpace(h); h != "" && strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks settings that would otherwise only fail on first use
+func (c *Config) Validate() error {
+	if n := c.PasswordScryptN; n <= 1 || n&(n-1) != 0 {
+		return fmt.Errorf("PASSWORD_SCRYPT_N (%d) must be a power of two greater than 1", n)
+	}
+	if c.PasswordScryptR < 1 || c.PasswordScryptP < 1 {
+		return fmt.Errorf("PASSWORD_SCRYPT_R and PASSWORD_SCRYPT_P must be at least 1")
+	}
+	for name, dir := range map[string]string{"DATA_DIR": c.DataDir, "STORAGE_DIR": c.StorageDir} {
+		if err := ensureWritableDir(dir); err != nil {
+			return fmt.Errorf("%s (%s) is not writable: %w", name, dir, err)
+		}
+	}
+	return nil
+}
+
+// ensureWritableDir creates dir if needed and proves it's writable with a throwaway file
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	return os.Remove(name)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -53,6 +198,25 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvPath reads a directory path and resolves it against the working directory at startup,
+// so later chdir-independent code always sees an absolute path
+func getEnvPath(key, defaultValue string) string {
+	path := getEnv(key, defaultValue)
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if i, err := strconv.Atoi(value); err == nil {
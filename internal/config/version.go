@@ -0,0 +1,12 @@
+package config
+
+// Build information, injected at build time:
+//
+//	go build -ldflags "-X nano-backend/internal/config.Version=1.2.0 \
+//		-X nano-backend/internal/config.GitCommit=$(git rev-parse --short HEAD) \
+//		-X nano-backend/internal/config.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
+)
@@ -3,51 +3,91 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/scrypt"
 )
 
-// HashPassword hashes a password using scrypt
+// ScryptParams are the scrypt cost parameters
+type ScryptParams struct {
+	N, R, P int
+}
+
+// legacyScryptParams were implied by hashes written before the parameters were stored in them
+var legacyScryptParams = ScryptParams{N: 32768, R: 8, P: 1}
+
+// PasswordParams is used for new hashes; main sets it from config. Existing hashes always
+// verify with the parameters encoded in them, so changing this only affects new passwords.
+var PasswordParams = legacyScryptParams
+
+// HashPassword hashes a password using scrypt, as "scrypt:N:r:p:salt:hash"
 func HashPassword(password string) (string, error) {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
 
-	dk, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, 64)
+	params := PasswordParams
+	dk, err := scrypt.Key([]byte(password), salt, params.N, params.R, params.P, 64)
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("scrypt:%s:%s",
+	return fmt.Sprintf("scrypt:%d:%d:%d:%s:%s",
+		params.N, params.R, params.P,
 		base64.StdEncoding.EncodeToString(salt),
 		base64.StdEncoding.EncodeToString(dk)), nil
 }
 
-// VerifyPassword verifies a password against a stored hash
+// VerifyPassword verifies a password against a stored hash, using the parameters recorded in it
+// (or the legacy defaults for "scrypt:salt:hash")
 func VerifyPassword(password, stored string) bool {
 	parts := strings.Split(stored, ":")
-	if len(parts) != 3 || parts[0] != "scrypt" {
+	if len(parts) == 0 || parts[0] != "scrypt" {
+		return false
+	}
+
+	var params ScryptParams
+	switch len(parts) {
+	case 3:
+		params = legacyScryptParams
+		parts = []string{parts[1], parts[2]}
+	case 6:
+		var err error
+		if params.N, err = strconv.Atoi(parts[1]); err != nil {
+			return false
+		}
+		if params.R, err = strconv.Atoi(parts[2]); err != nil {
+			return false
+		}
+		if params.P, err = strconv.Atoi(parts[3]); err != nil {
+			return false
+		}
+		parts = []string{parts[4], parts[5]}
+	default:
 		return false
 	}
 
-	salt, err := base64.StdEncoding.DecodeString(parts[1])
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
 	if err != nil {
 		return false
 	}
 
-	storedHash, err := base64.StdEncoding.DecodeString(parts[2])
+	storedHash, err := base64.StdEncoding.DecodeString(parts[1])
 	if err != nil {
 		return false
 	}
 
-	dk, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, 64)
+	dk, err := scrypt.Key([]byte(password), salt, params.N, params.R, params.P, len(storedHash))
 	if err != nil {
 		return false
 	}
@@ -62,6 +102,49 @@ func RandomToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// SignFileToken creates a file-scoped access token for the given user, valid until expiresAt (ms)
+func SignFileToken(fileID, userID string, expiresAt int64, secret string) string {
+	exp := strconv.FormatInt(expiresAt, 10)
+	return fmt.Sprintf("%s.%s.%s", userID, exp, fileTokenSignature(fileID, userID, exp, secret))
+}
+
+// VerifyFileToken checks a file-scoped access token and returns the user it was issued to
+func VerifyFileToken(token, fileID, secret string, now int64) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", false
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || expiresAt < now {
+		return "", false
+	}
+
+	expected := fileTokenSignature(fileID, parts[0], parts[1], secret)
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// DeriveSecret derives an independent hex-encoded subkey of secret for the given purpose (HKDF-SHA256),
+// so one configured secret can back several uses without a leak in one weakening the others
+func DeriveSecret(secret, purpose string) string {
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, purpose, 32)
+	if err != nil {
+		// Only possible for an invalid length, which is fixed above
+		panic(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+func fileTokenSignature(fileID, userID, expiresAt, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fileID + "|" + userID + "|" + expiresAt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // getAESKey derives a 32-byte key from the secret
 func getAESKey(secret string) []byte {
 	hash := sha256.Sum256([]byte(secret))
@@ -130,3 +213,14 @@ func DecryptText(encrypted, secret string) (string, error) {
 
 	return string(plaintext), nil
 }
+
+// KeyFingerprint returns a keyed digest of a provider key, so two requests can be compared for
+// using the same key without storing the key or a plain hash of it; "" for no key
+func KeyFingerprint(key SecretString, secret string) string {
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(key.Reveal()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
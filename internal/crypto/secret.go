@@ -0,0 +1,32 @@
+package crypto
+
+// redacted is what a SecretString prints as in logs, errors and JSON
+const redacted = "***"
+
+// SecretString holds a sensitive value such as a provider API key.
+// Formatting it with fmt/log or marshalling it to JSON prints "***";
+// call Reveal only where the raw value is actually needed (e.g. an HTTP header).
+type SecretString string
+
+// Reveal returns the underlying secret value
+func (s SecretString) Reveal() string {
+	return string(s)
+}
+
+// String implements fmt.Stringer so %s and %v print a redacted value
+func (s SecretString) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString implements fmt.GoStringer so %#v is redacted as well
+func (s SecretString) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON redacts the value when a struct holding a SecretString is serialized
+func (s SecretString) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"nano-backend/internal/models"
+)
+
+// writerQueue is the single-writer-goroutine alternative to dbMu measured below: every write is
+// sent over a channel and executed in order by one goroutine
+type writerQueue struct {
+	ops chan writerOp
+}
+
+type writerOp struct {
+	fn   func() error
+	done chan error
+}
+
+func newWriterQueue() *writerQueue {
+	q := &writerQueue{ops: make(chan writerOp)}
+	go func() {
+		for op := range q.ops {
+			op.done <- op.fn()
+		}
+	}()
+	return q
+}
+
+func (q *writerQueue) run(fn func() error) error {
+	done := make(chan error, 1)
+	q.ops <- writerOp{fn: fn, done: done}
+	return <-done
+}
+
+func (q *writerQueue) close() { close(q.ops) }
+
+// seedGenerations inserts n generations and returns their IDs
+func seedGenerations(b *testing.B, n int) []string {
+	b.Helper()
+	ids := make([]string, n)
+	now := models.Now()
+	for i := range ids {
+		g := &models.Generation{
+			ID: fmt.Sprintf("gen-%d", i), UserID: "u1", Type: "image", Prompt: "p", Model: "m",
+			Status: "running", ReferenceFileIDs: []string{}, CreatedAt: now, UpdatedAt: now,
+		}
+		if err := CreateGeneration(g); err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = g.ID
+	}
+	return ids
+}
+
+// benchmarkMixed runs a read-heavy workload like the API plus job runner: one in every
+// writeEvery operations is a progress update, the rest are generation reads
+func benchmarkMixed(b *testing.B, writeEvery int, write func(id string, progress float64) error) {
+	ids := seedGenerations(b, 64)
+	var counter atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := counter.Add(1)
+			id := ids[n%int64(len(ids))]
+			if n%int64(writeEvery) == 0 {
+				if err := write(id, float64(n%100)); err != nil {
+					b.Error(err)
+				}
+			} else if _, err := GetGenerationByID(id); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMixedWorkload(b *testing.B) {
+	for _, writeEvery := range []int{2, 5, 20} {
+		b.Run(fmt.Sprintf("mutex/1in%d", writeEvery), func(b *testing.B) {
+			setupTestDB(b)
+			benchmarkMixed(b, writeEvery, func(id string, progress float64) error {
+				return UpdateGeneration(id, map[string]interface{}{"progress": progress})
+			})
+		})
+		b.Run(fmt.Sprintf("writerQueue/1in%d", writeEvery), func(b *testing.B) {
+			setupTestDB(b)
+			q := newWriterQueue()
+			defer q.close()
+			benchmarkMixed(b, writeEvery, func(id string, progress float64) error {
+				return q.run(func() error {
+					_, err := execWithRetry("UPDATE generations SET progress = ?, updatedAt = ? WHERE id = ?", progress, models.Now(), id)
+					return err
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,603 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nano-backend/internal/config"
+	"nano-backend/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// setupTestDB opens a fresh database in a temp dir for the duration of the test
+func setupTestDB(t testing.TB) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		DataDir:                filepath.Join(dir, "data"),
+		StorageDir:             filepath.Join(dir, "storage"),
+		APIKeyEncryptionSecret: "test-secret",
+		FileRetentionHours:     1,
+	}
+	if err := Init(cfg); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(Close)
+	return cfg
+}
+
+// createStoredFile writes a file under the user's storage dir and records it
+func createStoredFile(t testing.TB, cfg *config.Config, userID string, persistent bool) *models.File {
+	t.Helper()
+	dir := filepath.Join(cfg.StorageDir, "u_"+userID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, uuid.New().String()+".png")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := CreateFile(userID, "generation", "image/png", "", path, 4, persistent)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	return f
+}
+
+// createTestGeneration stores a queued image generation for userID, optionally as a node of runID
+func createTestGeneration(t testing.TB, userID string, runID *string) *models.Generation {
+	t.Helper()
+	now := models.Now()
+	g := &models.Generation{
+		ID:               uuid.New().String(),
+		UserID:           userID,
+		Type:             "image",
+		Prompt:           "a cat",
+		Model:            "nano-banana",
+		Status:           "queued",
+		ReferenceFileIDs: []string{},
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		RunID:            runID,
+	}
+	if runID != nil {
+		pos := 0
+		g.NodePosition = &pos
+	}
+	if err := CreateGeneration(g); err != nil {
+		t.Fatalf("CreateGeneration: %v", err)
+	}
+	return g
+}
+
+// ageFile moves a file's createdAt past the retention window
+func ageFile(t testing.TB, id string) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE files SET createdAt = ? WHERE id = ?", models.Now()-30*24*3600*1000, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupExpiredFilesUnlinksWithoutHoldingLock(t *testing.T) {
+	cfg := setupTestDB(t)
+	f := createStoredFile(t, cfg, "u1", false)
+	ageFile(t, f.ID)
+
+	var removed []string
+	heldDuringRemove := false
+	orig := removeStoredFile
+	removeStoredFile = func(path string) {
+		if dbMu.TryLock() {
+			dbMu.Unlock()
+		} else {
+			heldDuringRemove = true
+		}
+		removed = append(removed, path)
+		orig(path)
+	}
+	t.Cleanup(func() { removeStoredFile = orig })
+
+	CleanupExpiredFiles(cfg)
+
+	if heldDuringRemove {
+		t.Error("dbMu was held while unlinking files")
+	}
+	if len(removed) != 1 || removed[0] != f.Path {
+		t.Fatalf("removed = %v, want [%s]", removed, f.Path)
+	}
+	if _, err := os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Errorf("file still on disk: %v", err)
+	}
+	if got, _ := GetFileByID(f.ID); got != nil {
+		t.Error("file row not deleted")
+	}
+}
+
+func TestCleanupExpiredFilesKeepsFilesMadePersistent(t *testing.T) {
+	cfg := setupTestDB(t)
+	f := createStoredFile(t, cfg, "u1", false)
+	ageFile(t, f.ID)
+	if _, err := CreateLibraryItem("u1", "image", "kept", f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFilePersistent(f.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	CleanupExpiredFiles(cfg)
+
+	if _, err := os.Stat(f.Path); err != nil {
+		t.Errorf("persistent file removed from disk: %v", err)
+	}
+	if got, _ := GetFileByID(f.ID); got == nil {
+		t.Error("persistent file row deleted")
+	}
+	if items, _ := ListLibrary("u1", ""); len(items) != 1 {
+		t.Errorf("library items = %d, want 1", len(items))
+	}
+}
+
+func TestUserUsageTracksFileRows(t *testing.T) {
+	cfg := setupTestDB(t)
+	a := createStoredFile(t, cfg, "u1", false)
+	createStoredFile(t, cfg, "u1", false)
+	// A thumbnail on disk has no row and must not count
+	if err := os.WriteFile(a.Path+".thumb-512.jpg", make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage, _ := GetUserUsage("u1"); usage != 8 {
+		t.Fatalf("usage after create = %d, want 8", usage)
+	}
+	if err := DeleteFile(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := GetUserUsage("u1"); usage != 4 {
+		t.Fatalf("usage after delete = %d, want 4", usage)
+	}
+
+	// Drift is corrected from the recorded sizes
+	if _, err := db.Exec("UPDATE user_usage SET bytes = 999 WHERE userId = 'u1'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO user_usage (userId, bytes, updatedAt) VALUES ('gone', 50, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	ReconcileUserUsage()
+	if usage, _ := GetUserUsage("u1"); usage != 4 {
+		t.Errorf("usage after reconcile = %d, want 4", usage)
+	}
+	if usage, _ := GetUserUsage("gone"); usage != 0 {
+		t.Errorf("usage of user without files = %d, want 0", usage)
+	}
+}
+
+func TestDeleteVideoRunDetachesGenerations(t *testing.T) {
+	setupTestDB(t)
+	run, err := CreateVideoRun("user-1", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := CreateVideoRun("user-1", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestGeneration(t, "user-1", &run.ID)
+	createTestGeneration(t, "user-1", &run.ID)
+	// A row owned by someone else must not be left pointing at the deleted run either
+	createTestGeneration(t, "user-2", &run.ID)
+	kept := createTestGeneration(t, "user-1", &other.ID)
+
+	if err := DeleteVideoRun("user-2", run.ID); err != sql.ErrNoRows {
+		t.Fatalf("DeleteVideoRun by another user: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := DeleteVideoRun("user-1", run.ID); err != nil {
+		t.Fatalf("DeleteVideoRun: %v", err)
+	}
+
+	var dangling int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM generations WHERE runId IS NOT NULL AND runId NOT IN (SELECT id FROM video_runs)",
+	).Scan(&dangling); err != nil {
+		t.Fatal(err)
+	}
+	if dangling != 0 {
+		t.Errorf("%d generations still reference a deleted run", dangling)
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM generations").Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 {
+		t.Errorf("generations = %d, want all 4 kept in history", total)
+	}
+
+	g, err := GetGenerationByID(kept.ID)
+	if err != nil || g == nil {
+		t.Fatalf("GetGenerationByID: %v", err)
+	}
+	if g.RunID == nil || *g.RunID != other.ID || g.NodePosition == nil {
+		t.Errorf("generation of another run was detached: runId=%v", g.RunID)
+	}
+}
+
+func TestToggleFavoriteConcurrent(t *testing.T) {
+	setupTestDB(t)
+	g := createTestGeneration(t, "user-1", nil)
+
+	// An even number of concurrent toggles must leave the flag where it started, and every
+	// toggle must observe a distinct transition (half report true, half false)
+	const toggles = 50
+	results := make(chan bool, toggles)
+	var wg sync.WaitGroup
+	for i := 0; i < toggles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fav, err := ToggleFavorite("user-1", g.ID)
+			if err != nil {
+				t.Errorf("ToggleFavorite: %v", err)
+				return
+			}
+			results <- fav
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	on := 0
+	for fav := range results {
+		if fav {
+			on++
+		}
+	}
+	if on != toggles/2 {
+		t.Errorf("%d toggles reported favorite=true, want %d", on, toggles/2)
+	}
+
+	stored, err := GetGenerationByID(g.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("GetGenerationByID: %v", err)
+	}
+	if stored.Favorite {
+		t.Error("favorite = true after an even number of toggles, want false")
+	}
+
+	if _, err := ToggleFavorite("user-2", g.ID); err != sql.ErrNoRows {
+		t.Errorf("toggle by another user: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestProgressRoundTripsFractions(t *testing.T) {
+	setupTestDB(t)
+	g := createTestGeneration(t, "user-1", nil)
+
+	for _, p := range []float64{0, 0.5, 12.25, 33.333, 99.9, 100} {
+		if err := UpdateGeneration(g.ID, map[string]interface{}{"progress": p}); err != nil {
+			t.Fatalf("UpdateGeneration(%v): %v", p, err)
+		}
+		stored, err := GetGenerationByID(g.ID)
+		if err != nil || stored == nil {
+			t.Fatalf("GetGenerationByID: %v", err)
+		}
+		if stored.Progress == nil {
+			t.Fatalf("progress = NULL, want %v", p)
+		}
+		if *stored.Progress != p {
+			t.Errorf("progress = %v, want %v", *stored.Progress, p)
+		}
+	}
+
+	// Rows written as text by older builds still scan as numbers
+	if _, err := db.Exec("UPDATE generations SET progress = '42.5' WHERE id = ?", g.ID); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := GetGenerationByID(g.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("GetGenerationByID: %v", err)
+	}
+	if stored.Progress == nil {
+		t.Fatal("progress from text = NULL, want 42.5")
+	}
+	if *stored.Progress != 42.5 {
+		t.Errorf("progress from text = %v, want 42.5", *stored.Progress)
+	}
+}
+
+func TestBuildGenerationUpdateIsDeterministic(t *testing.T) {
+	updates := map[string]interface{}{
+		"status":         "failed",
+		"error":          "boom",
+		"errorCode":      "unknown",
+		"elapsedSeconds": int64(7),
+		"updatedAt":      int64(1000),
+		"progress":       50.0,
+	}
+	wantQuery := "UPDATE generations SET elapsedSeconds = ?, error = ?, errorCode = ?, progress = ?, status = ?, updatedAt = ? WHERE id = ? AND userId = ?"
+	wantArgs := []interface{}{int64(7), "boom", "unknown", 50.0, "failed", int64(1000), "g1", "u1"}
+
+	// Map iteration order is randomized per range, so repeat to catch any order dependence
+	for i := 0; i < 100; i++ {
+		query, args := buildGenerationUpdate("g1", updates, " AND userId = ?", "u1")
+		if query != wantQuery {
+			t.Fatalf("query = %q, want %q", query, wantQuery)
+		}
+		if !reflect.DeepEqual(args, wantArgs) {
+			t.Fatalf("args = %v, want %v", args, wantArgs)
+		}
+	}
+}
+
+func TestUpdateGenerationRejectsUnknownColumns(t *testing.T) {
+	setupTestDB(t)
+	g := createTestGeneration(t, "user-1", nil)
+
+	for _, key := range []string{
+		"bogus",
+		"userId",
+		"status = 'succeeded', prompt",
+		"prompt = prompt; DROP TABLE generations; --",
+	} {
+		err := UpdateGeneration(g.ID, map[string]interface{}{"prompt": "a dog", key: "x"})
+		if err == nil || !strings.Contains(err.Error(), "unknown generation column") {
+			t.Errorf("key %q: err = %v, want unknown generation column", key, err)
+		}
+	}
+	if err := UpdatePendingGeneration("user-1", g.ID, map[string]interface{}{"bogus": 1}); err == nil {
+		t.Error("UpdatePendingGeneration accepted an unknown column")
+	}
+	if err := ClaimGeneration(g.ID, map[string]interface{}{"bogus": 1}); err == nil {
+		t.Error("ClaimGeneration accepted an unknown column")
+	}
+
+	// Nothing was written, not even the allowed column next to the bad one
+	stored, err := GetGenerationByID(g.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("GetGenerationByID: %v", err)
+	}
+	if stored.Prompt != "a cat" || stored.UserID != "user-1" || stored.Status != "queued" {
+		t.Errorf("generation changed: prompt=%q userId=%q status=%q", stored.Prompt, stored.UserID, stored.Status)
+	}
+}
+
+func TestIsBusyError(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"database is locked (5) (SQLITE_BUSY)":     true,
+		"database table is locked (SQLITE_LOCKED)": true,
+		"database is locked":                       true,
+		"UNIQUE constraint failed: users.username": false,
+		"no such table: bogus":                     false,
+	} {
+		if got := isBusyError(errors.New(msg)); got != want {
+			t.Errorf("isBusyError(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestConcurrentWritersWithExternalLock(t *testing.T) {
+	cfg := setupTestDB(t)
+	const writers, rounds = 8, 25
+
+	gens := make([]*models.Generation, writers)
+	for i := range gens {
+		gens[i] = createTestGeneration(t, "user-1", nil)
+	}
+
+	// A second connection, like a backup tool or sqlite3 shell, repeatedly grabs the write lock
+	other, err := sql.Open("sqlite", filepath.Join(cfg.DataDir, "db.sqlite")+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	stop := make(chan struct{})
+	lockerDone := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				lockerDone <- nil
+				return
+			default:
+			}
+			tx, err := other.Begin()
+			if err != nil {
+				lockerDone <- err
+				return
+			}
+			if _, err := tx.Exec("UPDATE app_meta SET value = value WHERE key = 'none'"); err != nil {
+				tx.Rollback()
+				lockerDone <- err
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			if err := tx.Commit(); err != nil {
+				lockerDone <- err
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*rounds*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(g *models.Generation) {
+			defer wg.Done()
+			for r := 1; r <= rounds; r++ {
+				if err := UpdateGeneration(g.ID, map[string]interface{}{"progress": float64(r)}); err != nil {
+					errs <- err
+				}
+				if _, err := CreateFile("user-1", "generation", "image/png", "", "/nonexistent", 1, false); err != nil {
+					errs <- err
+				}
+			}
+		}(gens[i])
+	}
+	wg.Wait()
+	close(stop)
+	if err := <-lockerDone; err != nil {
+		t.Fatalf("external writer: %v", err)
+	}
+	close(errs)
+	for err := range errs {
+		t.Errorf("write failed under contention: %v", err)
+	}
+
+	for _, g := range gens {
+		stored, err := GetGenerationByID(g.ID)
+		if err != nil || stored == nil || stored.Progress == nil {
+			t.Fatalf("generation %s: %v", g.ID, err)
+		}
+		if *stored.Progress != rounds {
+			t.Errorf("generation %s: progress = %v, want %d", g.ID, *stored.Progress, rounds)
+		}
+	}
+	var files int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE userId = 'user-1'").Scan(&files); err != nil {
+		t.Fatal(err)
+	}
+	if files != writers*rounds {
+		t.Errorf("files = %d, want %d", files, writers*rounds)
+	}
+	if used, _ := GetUserUsage("user-1"); used != writers*rounds {
+		t.Errorf("usage = %d, want %d", used, writers*rounds)
+	}
+}
+
+func TestRequeueFailedGenerationsSkipsNonRetryable(t *testing.T) {
+	setupTestDB(t)
+
+	codes := []string{"", string(models.ErrorCodeNetworkError), string(models.ErrorCodeTimeout),
+		string(models.ErrorCodeInvalidAPIKey), string(models.ErrorCodeInvalidRequest)}
+	ids := make(map[string]string, len(codes))
+	for _, code := range codes {
+		g := createTestGeneration(t, "user-1", nil)
+		updates := map[string]interface{}{"status": "failed", "error": "boom"}
+		if code != "" {
+			updates["errorCode"] = code
+		}
+		if err := UpdateGeneration(g.ID, updates); err != nil {
+			t.Fatal(err)
+		}
+		ids[code] = g.ID
+	}
+	status := func(code string) string {
+		g, err := GetGenerationByID(ids[code])
+		if err != nil || g == nil {
+			t.Fatalf("GetGenerationByID: %v", err)
+		}
+		return g.Status
+	}
+
+	count, err := RequeueFailedGenerations(1, 0, "")
+	if err != nil {
+		t.Fatalf("RequeueFailedGenerations: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("requeued %d generations, want 3", count)
+	}
+	for _, code := range codes {
+		want := "queued"
+		if code == string(models.ErrorCodeInvalidAPIKey) || code == string(models.ErrorCodeInvalidRequest) {
+			want = "failed"
+		}
+		if got := status(code); got != want {
+			t.Errorf("errorCode %q: status = %s, want %s", code, got, want)
+		}
+	}
+
+	// Naming a non-retryable code explicitly still requeues it
+	if count, err := RequeueFailedGenerations(0, 0, string(models.ErrorCodeInvalidAPIKey)); err != nil || count != 1 {
+		t.Errorf("explicit errorCode: count = %d, err = %v, want 1", count, err)
+	}
+	if got := status(string(models.ErrorCodeInvalidAPIKey)); got != "queued" {
+		t.Errorf("explicit errorCode: status = %s, want queued", got)
+	}
+}
+
+func TestProviderKeyScrubbedOnTerminalStatus(t *testing.T) {
+	setupTestDB(t)
+
+	withKey := func() *models.Generation {
+		g := createTestGeneration(t, "user-1", nil)
+		if _, err := db.Exec("UPDATE generations SET providerKeyEnc = 'enc-key' WHERE id = ?", g.ID); err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	keyOf := func(id string) *string {
+		g, err := GetGenerationByID(id)
+		if err != nil || g == nil {
+			t.Fatalf("GetGenerationByID: %v", err)
+		}
+		return g.ProviderKeyEnc
+	}
+
+	running := withKey()
+	if err := UpdateGeneration(running.ID, map[string]interface{}{"status": "running"}); err != nil {
+		t.Fatal(err)
+	}
+	if k := keyOf(running.ID); k == nil || *k != "enc-key" {
+		t.Errorf("running generation lost its key: %v", k)
+	}
+
+	for _, status := range []string{"succeeded", "failed"} {
+		g := withKey()
+		if err := UpdateGeneration(g.ID, map[string]interface{}{"status": status}); err != nil {
+			t.Fatal(err)
+		}
+		if k := keyOf(g.ID); k == nil || *k != "" {
+			t.Errorf("%s generation: providerKeyEnc = %v, want scrubbed", status, k)
+		}
+	}
+
+	canceled := withKey()
+	if _, err := CancelUserGenerations("user-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if k := keyOf(canceled.ID); k == nil || *k != "" {
+		t.Errorf("canceled generation: providerKeyEnc = %v, want scrubbed", k)
+	}
+
+	// Generations that used the saved provider have no key to scrub
+	plain := createTestGeneration(t, "user-1", nil)
+	if err := UpdateGeneration(plain.ID, map[string]interface{}{"status": "failed", "errorCode": "timeout"}); err != nil {
+		t.Fatal(err)
+	}
+	if k := keyOf(plain.ID); k != nil {
+		t.Errorf("generation without override: providerKeyEnc = %q, want NULL", *k)
+	}
+
+	// A bulk requeue must not rerun a scrubbed override with the user's default provider
+	overridden := withKey()
+	if err := UpdateGeneration(overridden.ID, map[string]interface{}{"status": "failed", "errorCode": "timeout"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := RequeueFailedGenerations(0, 0, "timeout"); err != nil || count != 1 {
+		t.Errorf("RequeueFailedGenerations: count = %d, err = %v, want only the generation without override", count, err)
+	}
+	if g, _ := GetGenerationByID(overridden.ID); g == nil || g.Status != "failed" {
+		t.Errorf("scrubbed generation was requeued")
+	}
+}
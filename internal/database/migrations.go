@@ -0,0 +1,262 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+
+	"nano-backend/internal/models"
+)
+
+// migration is one schema change, applied exactly once and recorded in schema_migrations.
+// Versions must be unique and only ever appended; never edit a migration that has shipped.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations is the ordered list of schema changes on top of the base tables in createTables.
+// The early entries replace the old ALTER-on-every-boot statements; addColumn makes them
+// no-ops on databases that already got the column that way.
+var migrations = []migration{
+	{1, "users.disabled", func(tx *sql.Tx) error {
+		return addColumn(tx, "users", "disabled", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{2, "settings.referenceHistoryLimit", func(tx *sql.Tx) error {
+		return addColumn(tx, "settings", "referenceHistoryLimit", "INTEGER NOT NULL DEFAULT 50")
+	}},
+	{3, "settings.imageTimeoutSeconds", func(tx *sql.Tx) error {
+		return addColumn(tx, "settings", "imageTimeoutSeconds", "INTEGER NOT NULL DEFAULT 600")
+	}},
+	{4, "settings.videoTimeoutSeconds", func(tx *sql.Tx) error {
+		return addColumn(tx, "settings", "videoTimeoutSeconds", "INTEGER NOT NULL DEFAULT 600")
+	}},
+	{5, "generations.startedAt+elapsedSeconds", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "generations", "startedAt", "INTEGER"); err != nil {
+			return err
+		}
+		return addColumn(tx, "generations", "elapsedSeconds", "INTEGER")
+	}},
+	{6, "generations.errorCode", func(tx *sql.Tx) error {
+		return addColumn(tx, "generations", "errorCode", "TEXT")
+	}},
+	{7, "review_storyboards.reviewedBy+reviewedAt", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "review_storyboards", "reviewedBy", "TEXT"); err != nil {
+			return err
+		}
+		return addColumn(tx, "review_storyboards", "reviewedAt", "INTEGER")
+	}},
+	{8, "generations.outputFileIds", func(tx *sql.Tx) error {
+		return addColumn(tx, "generations", "outputFileIds", "TEXT")
+	}},
+	{9, "generations.outputFormat", func(tx *sql.Tx) error {
+		return addColumn(tx, "generations", "outputFormat", "TEXT")
+	}},
+	{10, "generations.requestId", func(tx *sql.Tx) error {
+		return addColumn(tx, "generations", "requestId", "TEXT")
+	}},
+	{11, "user_provider.providerType", func(tx *sql.Tx) error {
+		return addColumn(tx, "user_provider", "providerType", "TEXT")
+	}},
+	{12, "files.size", func(tx *sql.Tx) error {
+		return addColumn(tx, "files", "size", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{13, "sessions.impersonatedBy", func(tx *sql.Tx) error {
+		return addColumn(tx, "sessions", "impersonatedBy", "TEXT")
+	}},
+	{14, "users.isLoggedIn+lastHeartbeatAt", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "users", "isLoggedIn", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "users", "lastHeartbeatAt", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	// Replaces the temp_review_episodes rebuild that ran on every boot and reset sortOrder to 0
+	{15, "review_episodes.sortOrder", func(tx *sql.Tx) error {
+		return addColumn(tx, "review_episodes", "sortOrder", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	// UpdateReviewStoryboard already wrote this column but it was never created
+	{16, "review_storyboards.name", func(tx *sql.Tx) error {
+		return addColumn(tx, "review_storyboards", "name", "TEXT NOT NULL DEFAULT ''")
+	}},
+	// Failures recorded before errorCode existed have no code; classify them as unknown
+	{17, "backfill generations.errorCode", func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"UPDATE generations SET errorCode = ? WHERE status = 'failed' AND (errorCode IS NULL OR errorCode = '')",
+			string(models.ErrorCodeUnknown),
+		)
+		return err
+	}},
+	// Files stored before the size column was added count as 0 bytes; take the size from disk
+	{18, "backfill files.size", backfillFileSizes},
+	{19, "user_provider.locked", func(tx *sql.Tx) error {
+		return addColumn(tx, "user_provider", "locked", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	// NULL means never reordered; such presets keep the createdAt order after the sorted ones
+	{20, "presets.sortOrder", func(tx *sql.Tx) error {
+		return addColumn(tx, "presets", "sortOrder", "INTEGER")
+	}},
+	// Per-request provider override; the key is encrypted like user_provider.apiKeyEnc
+	{21, "generations.providerHost+providerType+providerKeyEnc", func(tx *sql.Tx) error {
+		for _, col := range []string{"providerHost", "providerType", "providerKeyEnc"} {
+			if err := addColumn(tx, "generations", col, "TEXT"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{22, "generations.providerProfileId", func(tx *sql.Tx) error {
+		return addColumn(tx, "generations", "providerProfileId", "TEXT")
+	}},
+	{23, "generations.dedupeKey", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "generations", "dedupeKey", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_generations_userId_dedupeKey ON generations(userId, dedupeKey)")
+		return err
+	}},
+	{24, "users.disabledReason", func(tx *sql.Tx) error {
+		return addColumn(tx, "users", "disabledReason", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{25, "settings.disabledModels", func(tx *sql.Tx) error {
+		return addColumn(tx, "settings", "disabledModels", "TEXT NOT NULL DEFAULT '[]'")
+	}},
+	{26, "review_projects.description+review_episodes.description", func(tx *sql.Tx) error {
+		for _, table := range []string{"review_projects", "review_episodes"} {
+			if err := addColumn(tx, table, "description", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// runMigrations applies every migration newer than what schema_migrations records,
+// each in its own transaction together with its bookkeeping row
+func runMigrations() error {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if _, err := execWithRetry(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		appliedAt INTEGER NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	lastVersion := 0
+	for _, m := range migrations {
+		if m.version <= lastVersion {
+			return fmt.Errorf("migration %d (%s) is out of order", m.version, m.name)
+		}
+		lastVersion = m.version
+		if applied[m.version] {
+			continue
+		}
+
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		log.Printf("[database] Applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+func backfillFileSizes(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, path FROM files WHERE size = 0")
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var id, path string
+		if err := rows.Scan(&id, &path); err != nil {
+			rows.Close()
+			return err
+		}
+		if info, err := os.Stat(path); err == nil {
+			sizes[id] = info.Size()
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, size := range sizes {
+		if _, err := tx.Exec("UPDATE files SET size = ? WHERE id = ?", size, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, ?, ?)",
+		m.version, m.name, models.Now(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumn adds a column unless the table already has it
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	exists, err := columnExists(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -2,8 +2,11 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 
 	"nano-backend/internal/models"
+
+	"github.com/google/uuid"
 )
 
 // ========== 影视项目 (Projects) ==========
@@ -13,20 +16,17 @@ func CreateReviewProject(project *models.ReviewProject) error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
-	_, err := db.Exec(
-		"INSERT INTO review_projects (id, userId, name, coverFileId, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?)",
-		project.ID, project.UserID, project.Name, project.CoverFileID, project.CreatedAt, project.UpdatedAt,
+	_, err := execWithRetry(
+		"INSERT INTO review_projects (id, userId, name, description, coverFileId, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		project.ID, project.UserID, project.Name, project.Description, project.CoverFileID, project.CreatedAt, project.UpdatedAt,
 	)
 	return err
 }
 
 // ListReviewProjects 获取所有项目列表 (移除 userID 参数)
 func ListReviewProjects() ([]models.ReviewProject, error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
-
 	rows, err := db.Query(
-		"SELECT id, userId, name, coverFileId, createdAt, updatedAt FROM review_projects ORDER BY createdAt DESC",
+		"SELECT id, userId, name, description, coverFileId, createdAt, updatedAt FROM review_projects ORDER BY createdAt DESC",
 	)
 	if err != nil {
 		return nil, err
@@ -37,39 +37,49 @@ func ListReviewProjects() ([]models.ReviewProject, error) {
 	for rows.Next() {
 		var p models.ReviewProject
 		var coverFileId sql.NullString
-		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &coverFileId, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.Description, &coverFileId, &p.CreatedAt, &p.UpdatedAt); err != nil {
 			return nil, err
 		}
 		if coverFileId.Valid {
 			p.CoverFileID = coverFileId.String
 		}
-		// 计算集数
-		if err := db.QueryRow(
-			"SELECT COUNT(*) FROM review_episodes WHERE projectId = ?",
-			p.ID,
-		).Scan(&p.EpisodeCount); err != nil {
-			p.EpisodeCount = 0
-		}
 		projects = append(projects, p)
 	}
 	// 确保返回空切片而不是nil
 	if projects == nil {
 		return []models.ReviewProject{}, nil
 	}
+
+	// 计算集数与审阅进度 (分组聚合，避免逐行查询)
+	episodeCounts, err := groupedCounts("SELECT projectId, COUNT(*) FROM review_episodes GROUP BY projectId")
+	if err != nil {
+		return nil, err
+	}
+	progress, err := storyboardProgress(
+		`SELECT e.projectId, s.status, COUNT(*) FROM review_storyboards s
+		JOIN review_episodes e ON e.id = s.episodeId
+		GROUP BY e.projectId, s.status`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for i := range projects {
+		projects[i].EpisodeCount = episodeCounts[projects[i].ID]
+		if p, ok := progress[projects[i].ID]; ok {
+			projects[i].Progress = *p
+		}
+	}
 	return projects, nil
 }
 
 // GetReviewProject 获取单个项目详情 (移除 userID 参数)
 func GetReviewProject(id string) (*models.ReviewProject, error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
-
 	var p models.ReviewProject
 	var coverFileId sql.NullString
 	err := db.QueryRow(
-		"SELECT id, userId, name, coverFileId, createdAt, updatedAt FROM review_projects WHERE id = ?",
+		"SELECT id, userId, name, description, coverFileId, createdAt, updatedAt FROM review_projects WHERE id = ?",
 		id,
-	).Scan(&p.ID, &p.UserID, &p.Name, &coverFileId, &p.CreatedAt, &p.UpdatedAt)
+	).Scan(&p.ID, &p.UserID, &p.Name, &p.Description, &coverFileId, &p.CreatedAt, &p.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -86,6 +96,20 @@ func GetReviewProject(id string) (*models.ReviewProject, error) {
 	).Scan(&p.EpisodeCount); err != nil {
 		p.EpisodeCount = 0
 	}
+	// 计算审阅进度
+	progress, err := storyboardProgress(
+		`SELECT e.projectId, s.status, COUNT(*) FROM review_storyboards s
+		JOIN review_episodes e ON e.id = s.episodeId
+		WHERE e.projectId = ?
+		GROUP BY e.projectId, s.status`,
+		p.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if pr, ok := progress[p.ID]; ok {
+		p.Progress = *pr
+	}
 	return &p, nil
 }
 
@@ -96,24 +120,31 @@ func CreateReviewEpisode(episode *models.ReviewEpisode) error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
-	_, err := db.Exec(
-		"INSERT INTO review_episodes (id, projectId, userId, name, coverFileId, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		episode.ID, episode.ProjectID, episode.UserID, episode.Name, episode.CoverFileID, episode.SortOrder, episode.CreatedAt, episode.UpdatedAt,
+	_, err := execWithRetry(
+		"INSERT INTO review_episodes (id, projectId, userId, name, description, coverFileId, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		episode.ID, episode.ProjectID, episode.UserID, episode.Name, episode.Description, episode.CoverFileID, episode.SortOrder, episode.CreatedAt, episode.UpdatedAt,
 	)
 	return err
 }
 
 // ListReviewEpisodes 获取项目的单集列表 (移除 userID 参数)
-func ListReviewEpisodes(projectID string) ([]models.ReviewEpisode, error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
+// limit <= 0 时返回全部；第二个返回值为总数
+func ListReviewEpisodes(projectID string, limit, offset int) ([]models.ReviewEpisode, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM review_episodes WHERE projectId = ?", projectID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
 
-	rows, err := db.Query(
-		"SELECT id, projectId, userId, name, coverFileId, sortOrder, createdAt, updatedAt FROM review_episodes WHERE projectId = ? ORDER BY sortOrder ASC",
-		projectID,
-	)
+	query := "SELECT id, projectId, userId, name, description, coverFileId, sortOrder, createdAt, updatedAt FROM review_episodes WHERE projectId = ? ORDER BY sortOrder ASC"
+	args := []interface{}{projectID}
+	if limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
@@ -121,39 +152,46 @@ func ListReviewEpisodes(projectID string) ([]models.ReviewEpisode, error) {
 	for rows.Next() {
 		var e models.ReviewEpisode
 		var coverFileId sql.NullString
-		if err := rows.Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Name, &coverFileId, &e.SortOrder, &e.CreatedAt, &e.UpdatedAt); err != nil {
-			return nil, err
+		if err := rows.Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Name, &e.Description, &coverFileId, &e.SortOrder, &e.CreatedAt, &e.UpdatedAt); err != nil {
+			return nil, 0, err
 		}
 		if coverFileId.Valid {
 			e.CoverFileID = coverFileId.String
 		}
-		// 计算分镜数
-		if err := db.QueryRow(
-			"SELECT COUNT(*) FROM review_storyboards WHERE episodeId = ?",
-			e.ID,
-		).Scan(&e.StoryboardCount); err != nil {
-			e.StoryboardCount = 0
-		}
 		episodes = append(episodes, e)
 	}
 	// 确保返回空切片而不是nil
 	if episodes == nil {
-		return []models.ReviewEpisode{}, nil
+		return []models.ReviewEpisode{}, total, nil
+	}
+
+	// 计算分镜数与审阅进度 (分组聚合，避免逐行查询)
+	progress, err := storyboardProgress(
+		`SELECT episodeId, status, COUNT(*) FROM review_storyboards
+		WHERE episodeId IN (SELECT id FROM review_episodes WHERE projectId = ?)
+		GROUP BY episodeId, status`,
+		projectID,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range episodes {
+		if p, ok := progress[episodes[i].ID]; ok {
+			episodes[i].Progress = *p
+			episodes[i].StoryboardCount = p.Total()
+		}
 	}
-	return episodes, nil
+	return episodes, total, nil
 }
 
 // GetReviewEpisode 获取单个单集详情 (移除 userID 参数)
 func GetReviewEpisode(id string) (*models.ReviewEpisode, error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
-
 	var e models.ReviewEpisode
 	var coverFileId sql.NullString
 	err := db.QueryRow(
-		"SELECT id, projectId, userId, name, coverFileId, sortOrder, createdAt, updatedAt FROM review_episodes WHERE id = ?",
+		"SELECT id, projectId, userId, name, description, coverFileId, sortOrder, createdAt, updatedAt FROM review_episodes WHERE id = ?",
 		id,
-	).Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Name, &coverFileId, &e.SortOrder, &e.CreatedAt, &e.UpdatedAt)
+	).Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Name, &e.Description, &coverFileId, &e.SortOrder, &e.CreatedAt, &e.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -164,16 +202,66 @@ func GetReviewEpisode(id string) (*models.ReviewEpisode, error) {
 		e.CoverFileID = coverFileId.String
 	}
 
-	// 计算分镜数
-	if err := db.QueryRow(
-		"SELECT COUNT(*) FROM review_storyboards WHERE episodeId = ?",
+	// 计算分镜数与审阅进度
+	progress, err := storyboardProgress(
+		"SELECT episodeId, status, COUNT(*) FROM review_storyboards WHERE episodeId = ? GROUP BY episodeId, status",
 		e.ID,
-	).Scan(&e.StoryboardCount); err != nil {
-		e.StoryboardCount = 0
+	)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := progress[e.ID]; ok {
+		e.Progress = *p
+		e.StoryboardCount = p.Total()
 	}
 	return &e, nil
 }
 
+// groupedCounts 执行返回 (key, count) 两列的分组查询
+func groupedCounts(query string, args ...interface{}) (map[string]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
+// storyboardProgress 执行返回 (key, status, count) 三列的分组查询，按 key 汇总审阅进度
+func storyboardProgress(query string, args ...interface{}) (map[string]*models.ReviewProgress, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	progress := make(map[string]*models.ReviewProgress)
+	for rows.Next() {
+		var key, status string
+		var count int
+		if err := rows.Scan(&key, &status, &count); err != nil {
+			return nil, err
+		}
+		p, ok := progress[key]
+		if !ok {
+			p = &models.ReviewProgress{}
+			progress[key] = p
+		}
+		p.AddStatusCount(status, count)
+	}
+	return progress, rows.Err()
+}
+
 // ========== 分镜 (Storyboards) ==========
 
 // CreateReviewStoryboard 创建分镜
@@ -181,51 +269,117 @@ func CreateReviewStoryboard(storyboard *models.ReviewStoryboard) error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
-	_, err := db.Exec(
-		"INSERT INTO review_storyboards (id, episodeId, userId, imageFileId, status, feedback, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		storyboard.ID, storyboard.EpisodeID, storyboard.UserID, storyboard.ImageFileID, storyboard.Status, storyboard.Feedback, storyboard.SortOrder, storyboard.CreatedAt, storyboard.UpdatedAt,
+	_, err := execWithRetry(
+		"INSERT INTO review_storyboards (id, episodeId, userId, name, imageFileId, status, feedback, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		storyboard.ID, storyboard.EpisodeID, storyboard.UserID, storyboard.Name, storyboard.ImageFileID, storyboard.Status, storyboard.Feedback, storyboard.SortOrder, storyboard.CreatedAt, storyboard.UpdatedAt,
 	)
 	return err
 }
 
+// CreateReviewStoryboards 在同一事务中批量创建分镜，排序值接在单集当前最大排序之后
+func CreateReviewStoryboards(episodeID string, storyboards []*models.ReviewStoryboard) error {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var maxOrder int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(sortOrder), -1) FROM review_storyboards WHERE episodeId = ?", episodeID).Scan(&maxOrder); err != nil {
+		return err
+	}
+
+	for i, sb := range storyboards {
+		sb.EpisodeID = episodeID
+		sb.SortOrder = maxOrder + 1 + i
+		if _, err := tx.Exec(
+			"INSERT INTO review_storyboards (id, episodeId, userId, name, imageFileId, status, feedback, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			sb.ID, sb.EpisodeID, sb.UserID, sb.Name, sb.ImageFileID, sb.Status, sb.Feedback, sb.SortOrder, sb.CreatedAt, sb.UpdatedAt,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // ListReviewStoryboards 获取单集的分镜列表 (移除 userID 参数)
-func ListReviewStoryboards(episodeID string) ([]models.ReviewStoryboard, error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
+// status 为空时不过滤；limit <= 0 时返回全部；第二个返回值为过滤后的总数
+func ListReviewStoryboards(episodeID, status string, limit, offset int) ([]models.ReviewStoryboard, int, error) {
+	where := "episodeId = ?"
+	args := []interface{}{episodeID}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
 
-	rows, err := db.Query(
-		"SELECT id, episodeId, userId, imageFileId, status, feedback, sortOrder, createdAt, updatedAt FROM review_storyboards WHERE episodeId = ? ORDER BY sortOrder ASC",
-		episodeID,
-	)
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM review_storyboards WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT " + reviewStoryboardColumns + " FROM review_storyboards WHERE " + where + " ORDER BY sortOrder ASC"
+	if limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	var storyboards []models.ReviewStoryboard
 	for rows.Next() {
-		var s models.ReviewStoryboard
-		var feedback sql.NullString
-		if err := rows.Scan(&s.ID, &s.EpisodeID, &s.UserID, &s.ImageFileID, &s.Status, &feedback, &s.SortOrder, &s.CreatedAt, &s.UpdatedAt); err != nil {
-			return nil, err
-		}
-		if feedback.Valid {
-			s.Feedback = feedback.String
+		s, err := scanReviewStoryboard(rows)
+		if err != nil {
+			return nil, 0, err
 		}
-		storyboards = append(storyboards, s)
+		storyboards = append(storyboards, *s)
 	}
 	// 确保返回空切片而不是nil
 	if storyboards == nil {
-		return []models.ReviewStoryboard{}, nil
+		return []models.ReviewStoryboard{}, total, nil
+	}
+	return storyboards, total, nil
+}
+
+// ListProjectStoryboards 一次查询返回项目下所有单集的分镜，按 sortOrder 排序；
+// perEpisode > 0 时每集只返回前 perEpisode 条
+func ListProjectStoryboards(projectID string, perEpisode int) ([]models.ReviewStoryboard, error) {
+	inner := "SELECT " + reviewStoryboardColumns + ", ROW_NUMBER() OVER (PARTITION BY episodeId ORDER BY sortOrder ASC) AS rn" +
+		" FROM review_storyboards WHERE episodeId IN (SELECT id FROM review_episodes WHERE projectId = ?)"
+	query := "SELECT " + reviewStoryboardColumns + " FROM (" + inner + ")"
+	args := []interface{}{projectID}
+	if perEpisode > 0 {
+		query += " WHERE rn <= ?"
+		args = append(args, perEpisode)
+	}
+	query += " ORDER BY sortOrder ASC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var storyboards []models.ReviewStoryboard
+	for rows.Next() {
+		s, err := scanReviewStoryboard(rows)
+		if err != nil {
+			return nil, err
+		}
+		storyboards = append(storyboards, *s)
 	}
-	return storyboards, nil
+	return storyboards, rows.Err()
 }
 
 // GetMaxStoryboardOrder 获取当前最大排序值
 func GetMaxStoryboardOrder(episodeID string) int {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
-
 	var maxOrder int
 	err := db.QueryRow("SELECT COALESCE(MAX(sortOrder), -1) FROM review_storyboards WHERE episodeId = ?", episodeID).Scan(&maxOrder)
 	if err != nil {
@@ -234,15 +388,23 @@ func GetMaxStoryboardOrder(episodeID string) int {
 	return maxOrder
 }
 
-// UpdateStoryboardStatus 更新分镜状态和反馈
-func UpdateStoryboardStatus(id, status, feedback string) error {
+// UpdateStoryboardStatus 更新分镜状态和反馈，并记录审阅人与审阅时间
+// 非 rejected 状态不保留修改建议
+func UpdateStoryboardStatus(id, status, feedback, reviewerID string) error {
+	if !models.IsValidStoryboardStatus(status) {
+		return fmt.Errorf("无效的分镜状态: %s", status)
+	}
+	if status != models.StoryboardStatusRejected {
+		feedback = ""
+	}
+
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
 	now := models.Now()
-	_, err := db.Exec(
-		"UPDATE review_storyboards SET status = ?, feedback = ?, updatedAt = ? WHERE id = ?",
-		status, feedback, now, id,
+	_, err := execWithRetry(
+		"UPDATE review_storyboards SET status = ?, feedback = ?, reviewedBy = ?, reviewedAt = ?, updatedAt = ? WHERE id = ?",
+		status, feedback, reviewerID, now, now, id,
 	)
 	return err
 }
@@ -254,7 +416,7 @@ func UpdateStoryboardOrder(storyboardIDs []string) error {
 
 	now := models.Now()
 	for i, id := range storyboardIDs {
-		_, err := db.Exec(
+		_, err := execWithRetry(
 			"UPDATE review_storyboards SET sortOrder = ?, updatedAt = ? WHERE id = ?",
 			i, now, id,
 		)
@@ -267,9 +429,6 @@ func UpdateStoryboardOrder(storyboardIDs []string) error {
 
 // GetMaxEpisodeOrder 获取当前项目下单集的最大排序值
 func GetMaxEpisodeOrder(projectID string) int {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
-
 	var maxOrder int
 	// 使用 COALESCE 处理没有记录的情况，默认返回 -1
 	err := db.QueryRow("SELECT COALESCE(MAX(sortOrder), -1) FROM review_episodes WHERE projectId = ?", projectID).Scan(&maxOrder)
@@ -286,7 +445,7 @@ func UpdateEpisodeOrder(episodeIDs []string) error {
 
 	now := models.Now()
 	for i, id := range episodeIDs {
-		_, err := db.Exec(
+		_, err := execWithRetry(
 			"UPDATE review_episodes SET sortOrder = ?, updatedAt = ? WHERE id = ?",
 			i, now, id,
 		)
@@ -298,41 +457,41 @@ func UpdateEpisodeOrder(episodeIDs []string) error {
 }
 
 // UpdateReviewProject 更新影视项目
-func UpdateReviewProject(projectID, name, coverFileID string) error {
+func UpdateReviewProject(projectID, name, description, coverFileID string) error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
 	now := models.Now()
 	if coverFileID != "" {
-		_, err := db.Exec(
-			"UPDATE review_projects SET name = ?, coverFileId = ?, updatedAt = ? WHERE id = ?",
-			name, coverFileID, now, projectID,
+		_, err := execWithRetry(
+			"UPDATE review_projects SET name = ?, description = ?, coverFileId = ?, updatedAt = ? WHERE id = ?",
+			name, description, coverFileID, now, projectID,
 		)
 		return err
 	}
-	_, err := db.Exec(
-		"UPDATE review_projects SET name = ?, updatedAt = ? WHERE id = ?",
-		name, now, projectID,
+	_, err := execWithRetry(
+		"UPDATE review_projects SET name = ?, description = ?, updatedAt = ? WHERE id = ?",
+		name, description, now, projectID,
 	)
 	return err
 }
 
 // UpdateReviewEpisode 更新影视单集
-func UpdateReviewEpisode(episodeID, name, coverFileID string) error {
+func UpdateReviewEpisode(episodeID, name, description, coverFileID string) error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
 	now := models.Now()
 	if coverFileID != "" {
-		_, err := db.Exec(
-			"UPDATE review_episodes SET name = ?, coverFileId = ?, updatedAt = ? WHERE id = ?",
-			name, coverFileID, now, episodeID,
+		_, err := execWithRetry(
+			"UPDATE review_episodes SET name = ?, description = ?, coverFileId = ?, updatedAt = ? WHERE id = ?",
+			name, description, coverFileID, now, episodeID,
 		)
 		return err
 	}
-	_, err := db.Exec(
-		"UPDATE review_episodes SET name = ?, updatedAt = ? WHERE id = ?",
-		name, now, episodeID,
+	_, err := execWithRetry(
+		"UPDATE review_episodes SET name = ?, description = ?, updatedAt = ? WHERE id = ?",
+		name, description, now, episodeID,
 	)
 	return err
 }
@@ -344,14 +503,14 @@ func UpdateReviewStoryboard(storyboardID, name, imageFileID string) error {
 
 	now := models.Now()
 	if imageFileID != "" {
-		_, err := db.Exec(
-			"UPDATE review_storyboards SET name = ?, imageFileId = ?, status = 'pending', feedback = '', updatedAt = ? WHERE id = ?",
+		_, err := execWithRetry(
+			"UPDATE review_storyboards SET name = ?, imageFileId = ?, status = 'pending', feedback = '', reviewedBy = NULL, reviewedAt = NULL, updatedAt = ? WHERE id = ?",
 			name, imageFileID, now, storyboardID,
 		)
 		return err
 	}
-	_, err := db.Exec(
-		"UPDATE review_storyboards SET name = ?, status = 'pending', feedback = '', updatedAt = ? WHERE id = ?",
+	_, err := execWithRetry(
+		"UPDATE review_storyboards SET name = ?, status = 'pending', feedback = '', reviewedBy = NULL, reviewedAt = NULL, updatedAt = ? WHERE id = ?",
 		name, now, storyboardID,
 	)
 	return err
@@ -359,28 +518,130 @@ func UpdateReviewStoryboard(storyboardID, name, imageFileID string) error {
 
 // GetReviewStoryboard 获取单个分镜详情 (移除 userID 参数)
 func GetReviewStoryboard(id string) (*models.ReviewStoryboard, error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
-
-	var s models.ReviewStoryboard
-	var feedback sql.NullString
-	err := db.QueryRow(
-		"SELECT id, episodeId, userId, imageFileId, status, feedback, sortOrder, createdAt, updatedAt FROM review_storyboards WHERE id = ?",
+	s, err := scanReviewStoryboard(db.QueryRow(
+		"SELECT "+reviewStoryboardColumns+" FROM review_storyboards WHERE id = ?",
 		id,
-	).Scan(&s.ID, &s.EpisodeID, &s.UserID, &s.ImageFileID, &s.Status, &feedback, &s.SortOrder, &s.CreatedAt, &s.UpdatedAt)
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	return s, nil
+}
+
+// reviewStoryboardColumns 与 scanReviewStoryboard 的扫描顺序保持一致
+const reviewStoryboardColumns = "id, episodeId, userId, name, imageFileId, status, feedback, sortOrder, createdAt, updatedAt, reviewedBy, reviewedAt"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanReviewStoryboard 扫描一行分镜记录 (列顺序见 reviewStoryboardColumns)
+func scanReviewStoryboard(row rowScanner) (*models.ReviewStoryboard, error) {
+	var s models.ReviewStoryboard
+	var feedback, reviewedBy sql.NullString
+	var reviewedAt sql.NullInt64
+	if err := row.Scan(&s.ID, &s.EpisodeID, &s.UserID, &s.Name, &s.ImageFileID, &s.Status, &feedback, &s.SortOrder, &s.CreatedAt, &s.UpdatedAt, &reviewedBy, &reviewedAt); err != nil {
+		return nil, err
+	}
 	if feedback.Valid {
 		s.Feedback = feedback.String
 	}
-
+	if reviewedBy.Valid {
+		s.ReviewedBy = reviewedBy.String
+	}
+	if reviewedAt.Valid {
+		ts := reviewedAt.Int64
+		s.ReviewedAt = &ts
+	}
 	return &s, nil
 }
 
+// ========== 复制操作 ==========
+
+// DuplicateReviewProject 在同一事务中深拷贝项目及其单集和分镜 (新ID，状态重置为 pending)
+// 图片文件按引用共享，不复制底层文件；替换封面/图片时 IsFileReferenced 会保护仍被引用的文件
+func DuplicateReviewProject(sourceID string, project *models.ReviewProject) error {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO review_projects (id, userId, name, description, coverFileId, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		project.ID, project.UserID, project.Name, project.Description, project.CoverFileID, project.CreatedAt, project.UpdatedAt,
+	); err != nil {
+		return err
+	}
+
+	// 1. 先读出全部单集，避免在同一事务中边遍历边写入
+	rows, err := tx.Query("SELECT id, name, description, coverFileId, sortOrder FROM review_episodes WHERE projectId = ? ORDER BY sortOrder ASC", sourceID)
+	if err != nil {
+		return err
+	}
+	var episodes []models.ReviewEpisode
+	for rows.Next() {
+		var e models.ReviewEpisode
+		var coverFileId sql.NullString
+		if err := rows.Scan(&e.ID, &e.Name, &e.Description, &coverFileId, &e.SortOrder); err != nil {
+			rows.Close()
+			return err
+		}
+		e.CoverFileID = coverFileId.String
+		episodes = append(episodes, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// 2. 逐集复制单集及其分镜
+	for _, e := range episodes {
+		newEpisodeID := uuid.New().String()
+		if _, err := tx.Exec(
+			"INSERT INTO review_episodes (id, projectId, userId, name, description, coverFileId, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			newEpisodeID, project.ID, project.UserID, e.Name, e.Description, e.CoverFileID, e.SortOrder, project.CreatedAt, project.UpdatedAt,
+		); err != nil {
+			return err
+		}
+
+		sbRows, err := tx.Query("SELECT name, imageFileId, sortOrder FROM review_storyboards WHERE episodeId = ? ORDER BY sortOrder ASC", e.ID)
+		if err != nil {
+			return err
+		}
+		var storyboards []models.ReviewStoryboard
+		for sbRows.Next() {
+			var sb models.ReviewStoryboard
+			if err := sbRows.Scan(&sb.Name, &sb.ImageFileID, &sb.SortOrder); err != nil {
+				sbRows.Close()
+				return err
+			}
+			storyboards = append(storyboards, sb)
+		}
+		sbRows.Close()
+		if err := sbRows.Err(); err != nil {
+			return err
+		}
+
+		for _, sb := range storyboards {
+			if _, err := tx.Exec(
+				"INSERT INTO review_storyboards (id, episodeId, userId, name, imageFileId, status, feedback, sortOrder, createdAt, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				uuid.New().String(), newEpisodeID, project.UserID, sb.Name, sb.ImageFileID, "pending", "", sb.SortOrder, project.CreatedAt, project.UpdatedAt,
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
 // ========== 删除操作 ==========
 
 // DeleteReviewStoryboard 删除分镜
@@ -388,7 +649,7 @@ func DeleteReviewStoryboard(id string) error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
-	_, err := db.Exec("DELETE FROM review_storyboards WHERE id = ?", id)
+	_, err := execWithRetry("DELETE FROM review_storyboards WHERE id = ?", id)
 	return err
 }
 
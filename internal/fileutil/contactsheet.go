@@ -0,0 +1,83 @@
+package fileutil
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	ContactSheetQuality  = 85
+	ContactSheetPadding  = 8
+	ContactSheetMaxPixel = 40_000_000
+)
+
+var contactSheetBackground = color.RGBA{R: 0x1f, G: 0x1f, B: 0x1f, A: 0xff}
+
+// ErrContactSheetTooLarge is returned when the requested grid would exceed ContactSheetMaxPixel.
+var ErrContactSheetTooLarge = errors.New("contact sheet too large")
+
+// ContactSheetSize returns the canvas dimensions for count cells laid out in the given columns.
+func ContactSheetSize(count, columns, cellSize int) (int, int) {
+	if count <= 0 || columns <= 0 {
+		return 0, 0
+	}
+	if columns > count {
+		columns = count
+	}
+	rows := (count + columns - 1) / columns
+	width := columns*cellSize + (columns+1)*ContactSheetPadding
+	height := rows*cellSize + (rows+1)*ContactSheetPadding
+	return width, height
+}
+
+// WriteContactSheet composites the images at paths into a grid and encodes it as JPEG to w.
+// Each image is scaled to fit its square cell and centered; images that can't be decoded
+// leave their cell blank so one bad file doesn't break the whole sheet.
+func WriteContactSheet(w io.Writer, paths []string, columns, cellSize int) error {
+	width, height := ContactSheetSize(len(paths), columns, cellSize)
+	if width == 0 || height == 0 {
+		width, height = cellSize+2*ContactSheetPadding, cellSize+2*ContactSheetPadding
+	}
+	if width*height > ContactSheetMaxPixel {
+		return ErrContactSheetTooLarge
+	}
+	if columns > len(paths) && len(paths) > 0 {
+		columns = len(paths)
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{C: contactSheetBackground}, image.Point{}, draw.Src)
+
+	for i, path := range paths {
+		img, err := decodeImageFile(path)
+		if err != nil {
+			log.Printf("[contact-sheet] Skipping %s: %v", path, err)
+			continue
+		}
+
+		cell := resizeToMaxEdge(img, cellSize)
+		b := cell.Bounds()
+		col, row := i%columns, i/columns
+		x := ContactSheetPadding + col*(cellSize+ContactSheetPadding) + (cellSize-b.Dx())/2
+		y := ContactSheetPadding + row*(cellSize+ContactSheetPadding) + (cellSize-b.Dy())/2
+		draw.Draw(canvas, image.Rect(x, y, x+b.Dx(), y+b.Dy()), cell, b.Min, draw.Over)
+	}
+
+	return jpeg.Encode(w, canvas, &jpeg.Options{Quality: ContactSheetQuality})
+}
+
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeImage(f)
+}
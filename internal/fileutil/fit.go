@@ -0,0 +1,80 @@
+package fileutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// ImageDimensionsError is returned when an image exceeds the allowed width or height.
+type ImageDimensionsError struct {
+	Width, Height       int
+	MaxWidth, MaxHeight int
+}
+
+func (e *ImageDimensionsError) Error() string {
+	return fmt.Sprintf("image is %dx%d, larger than the allowed %s", e.Width, e.Height, e.Limit())
+}
+
+// Limit renders the allowed bounds with unlimited axes as "∞", e.g. "4096x∞"
+func (e *ImageDimensionsError) Limit() string {
+	bound := func(v int) string {
+		if v <= 0 {
+			return "∞"
+		}
+		return fmt.Sprint(v)
+	}
+	return bound(e.MaxWidth) + "x" + bound(e.MaxHeight)
+}
+
+// FitImage checks an image against maxWidth/maxHeight (0 = unlimited on that axis).
+// Images within bounds, and data that isn't a decodable image, are returned unchanged.
+// Oversized images are shrunk to fit (keeping the aspect ratio) when downscale is set and
+// re-encoded as JPEG or PNG; otherwise an *ImageDimensionsError is returned.
+func FitImage(buf []byte, mimeType string, maxWidth, maxHeight int, downscale bool) ([]byte, string, error) {
+	if maxWidth <= 0 && maxHeight <= 0 {
+		return buf, mimeType, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return buf, mimeType, nil
+	}
+
+	scale := 1.0
+	if maxWidth > 0 && cfg.Width > maxWidth {
+		scale = math.Min(scale, float64(maxWidth)/float64(cfg.Width))
+	}
+	if maxHeight > 0 && cfg.Height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(cfg.Height))
+	}
+	if scale >= 1.0 {
+		return buf, mimeType, nil
+	}
+	if !downscale {
+		return nil, "", &ImageDimensionsError{Width: cfg.Width, Height: cfg.Height, MaxWidth: maxWidth, MaxHeight: maxHeight}
+	}
+
+	img, err := decodeImage(bytes.NewReader(buf))
+	if err != nil {
+		return nil, "", err
+	}
+	// Floor so rounding never lands one pixel over the limit
+	maxEdge := int(math.Floor(float64(max(cfg.Width, cfg.Height)) * scale))
+	resized := resizeToMaxEdge(img, max(maxEdge, 1))
+
+	var out bytes.Buffer
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&out, resized, &jpeg.Options{Quality: 90})
+	} else {
+		mimeType = "image/png"
+		err = png.Encode(&out, resized)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), mimeType, nil
+}
@@ -0,0 +1,50 @@
+package fileutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// ErrFrameExtractionUnavailable means ffmpeg is not installed, so frames can't be taken from videos
+var ErrFrameExtractionUnavailable = errors.New("ffmpeg not found")
+
+// frameExtractTimeout bounds a single ffmpeg run
+const frameExtractTimeout = 30 * time.Second
+
+// ExtractLastFrame returns the last frame of a video as PNG bytes.
+// It shells out to ffmpeg, which is an optional dependency of the server.
+func ExtractLastFrame(videoPath string) ([]byte, error) {
+	bin, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, ErrFrameExtractionUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), frameExtractTimeout)
+	defer cancel()
+
+	// -sseof seeks relative to the end (accurately, decoding from the previous keyframe),
+	// so this is the frame shown 0.1s before the video ends
+	cmd := exec.CommandContext(ctx, bin,
+		"-v", "error",
+		"-sseof", "-0.1",
+		"-i", videoPath,
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "png",
+		"pipe:1",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("ffmpeg produced no frame")
+	}
+	return stdout.Bytes(), nil
+}
@@ -1,14 +1,22 @@
 package fileutil
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
-	_ "image/gif"
 	_ "image/png"
+	"io"
 	"math"
 	"os"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -18,6 +26,19 @@ const (
 	thumbFileSuffix = ".thumb"
 )
 
+// MaxDecodePixels caps width*height of untrusted images before they are fully decoded,
+// so a tiny file declaring huge dimensions can't exhaust memory. 0 disables the check.
+var MaxDecodePixels int64 = 50_000_000
+
+// thumbGroup deduplicates in-flight thumbnail generation per thumbnail path
+var thumbGroup singleflight.Group
+
+// thumbGenerator renders a thumbnail; tests replace it to observe deduplication
+var thumbGenerator = generateThumbnail
+
+// ErrImageTooLarge is returned when an image's declared dimensions exceed MaxDecodePixels.
+var ErrImageTooLarge = errors.New("image dimensions exceed decode limit")
+
 // ThumbPath returns the cached thumbnail path for the given original file path.
 func ThumbPath(originalPath string) string {
 	return fmt.Sprintf("%s%s-%d.jpg", originalPath, thumbFileSuffix, ThumbMaxEdge)
@@ -41,21 +62,39 @@ func EnsureThumbnail(originalPath string) (string, error) {
 		return "", err
 	}
 
-	if thumbInfo, err := os.Stat(thumbPath); err == nil {
-		if thumbInfo.Size() > 0 && thumbInfo.ModTime().After(origInfo.ModTime().Add(-1*time.Second)) {
-			return thumbPath, nil
+	if thumbIsFresh(thumbPath, origInfo) {
+		return thumbPath, nil
+	}
+
+	// Concurrent requests for the same thumbnail share one decode/encode instead of racing on the .tmp file
+	_, err, _ = thumbGroup.Do(thumbPath, func() (interface{}, error) {
+		if thumbIsFresh(thumbPath, origInfo) {
+			return nil, nil
 		}
+		return nil, thumbGenerator(originalPath, thumbPath)
+	})
+	if err != nil {
+		return "", err
 	}
+	return thumbPath, nil
+}
 
+func thumbIsFresh(thumbPath string, origInfo os.FileInfo) bool {
+	thumbInfo, err := os.Stat(thumbPath)
+	return err == nil && thumbInfo.Size() > 0 && thumbInfo.ModTime().After(origInfo.ModTime().Add(-1*time.Second))
+}
+
+// generateThumbnail decodes the original and writes the thumbnail via a .tmp file and atomic rename
+func generateThumbnail(originalPath, thumbPath string) error {
 	srcFile, err := os.Open(originalPath)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer srcFile.Close()
 
-	srcImg, _, err := image.Decode(srcFile)
+	srcImg, err := decodeImage(srcFile)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	dstImg := resizeToMaxEdge(srcImg, ThumbMaxEdge)
@@ -63,27 +102,71 @@ func EnsureThumbnail(originalPath string) (string, error) {
 	tmpPath := thumbPath + ".tmp"
 	out, err := os.Create(tmpPath)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	encodeErr := jpeg.Encode(out, dstImg, &jpeg.Options{Quality: ThumbQuality})
 	closeErr := out.Close()
 	if encodeErr != nil {
 		_ = os.Remove(tmpPath)
-		return "", encodeErr
+		return encodeErr
 	}
 	if closeErr != nil {
 		_ = os.Remove(tmpPath)
-		return "", closeErr
+		return closeErr
 	}
 
 	_ = os.Remove(thumbPath)
 	if err := os.Rename(tmpPath, thumbPath); err != nil {
 		_ = os.Remove(tmpPath)
-		return "", err
+		return err
 	}
 
-	return thumbPath, nil
+	return nil
+}
+
+// decodeImage decodes an image for thumbnailing. GIFs take an explicit path: gif.Decode stops
+// after the first frame (unlike gif.DecodeAll, which walks every frame of a large animation),
+// and the frame is flattened onto white so transparent pixels don't turn black in the JPEG.
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	if err := checkDecodeSize(r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(6); err == nil && (bytes.Equal(magic, []byte("GIF87a")) || bytes.Equal(magic, []byte("GIF89a"))) {
+		frame, err := gif.Decode(br)
+		if err != nil {
+			return nil, err
+		}
+		return flattenOnWhite(frame), nil
+	}
+
+	img, _, err := image.Decode(br)
+	return img, err
+}
+
+// checkDecodeSize reads only the image header and rejects dimensions above MaxDecodePixels
+func checkDecodeSize(r io.Reader) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if MaxDecodePixels > 0 && int64(cfg.Width)*int64(cfg.Height) > MaxDecodePixels {
+		return fmt.Errorf("%w: %dx%d", ErrImageTooLarge, cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+func flattenOnWhite(src image.Image) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Over)
+	return dst
 }
 
 func resizeToMaxEdge(src image.Image, maxEdge int) image.Image {
@@ -0,0 +1,147 @@
+package fileutil
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeTestPNG writes a w x h PNG filled with c and returns its path
+func writeTestPNG(t *testing.T, w, h int, c color.Color) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "original.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// decodeThumb decodes a generated thumbnail
+func decodeThumb(t *testing.T, path string) image.Image {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatalf("thumbnail is not a valid JPEG: %v", err)
+	}
+	return img
+}
+
+func TestEnsureThumbnailConcurrent(t *testing.T) {
+	original := writeTestPNG(t, 2048, 1024, color.RGBA{R: 200, A: 255})
+
+	// Slow generation down so every worker arrives while the first one is still running
+	var calls atomic.Int32
+	thumbGenerator = func(originalPath, thumbPath string) error {
+		calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return generateThumbnail(originalPath, thumbPath)
+	}
+	t.Cleanup(func() { thumbGenerator = generateThumbnail })
+
+	const workers = 16
+	var wg sync.WaitGroup
+	paths := make([]string, workers)
+	errs := make([]error, workers)
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			paths[i], errs[i] = EnsureThumbnail(original)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i := 0; i < workers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("worker %d: %v", i, errs[i])
+		}
+		if paths[i] != ThumbPath(original) {
+			t.Errorf("worker %d: path = %q, want %q", i, paths[i], ThumbPath(original))
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("thumbnail generated %d times, want 1", n)
+	}
+	if b := decodeThumb(t, ThumbPath(original)).Bounds(); b.Dx() != ThumbMaxEdge || b.Dy() != ThumbMaxEdge/2 {
+		t.Errorf("thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), ThumbMaxEdge, ThumbMaxEdge/2)
+	}
+	if _, err := os.Stat(ThumbPath(original) + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestEnsureThumbnailMultiFrameGIF(t *testing.T) {
+	// Frame 0: left half red, right half transparent. Frame 1: solid blue.
+	palette := color.Palette{color.Transparent, color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+	const w, h = 64, 32
+	first := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	second := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				first.SetColorIndex(x, y, 1)
+			}
+			second.SetColorIndex(x, y, 2)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "anim.gif")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.EncodeAll(f, &gif.GIF{Image: []*image.Paletted{first, second}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	thumbPath, err := EnsureThumbnail(path)
+	if err != nil {
+		t.Fatalf("EnsureThumbnail: %v", err)
+	}
+	thumb := decodeThumb(t, thumbPath)
+	if b := thumb.Bounds(); b.Dx() != w || b.Dy() != h {
+		t.Fatalf("thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), w, h)
+	}
+
+	// JPEG is lossy, so compare loosely: the first frame's red on the left, white (not black) on the right
+	near := func(got color.Color, r, g, b uint32) bool {
+		gr, gg, gb, _ := got.RGBA()
+		diff := func(a, b uint32) bool { return a>>8 > b+40 || a>>8+40 < b }
+		return !diff(gr, r) && !diff(gg, g) && !diff(gb, b)
+	}
+	if c := thumb.At(w/4, h/2); !near(c, 255, 0, 0) {
+		t.Errorf("left pixel = %v, want the first frame's red", c)
+	}
+	if c := thumb.At(3*w/4, h/2); !near(c, 255, 255, 255) {
+		t.Errorf("transparent pixel = %v, want white", c)
+	}
+}
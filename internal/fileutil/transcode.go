@@ -0,0 +1,59 @@
+package fileutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+)
+
+// FormatMimeTypes maps output format hints to their MIME types.
+var FormatMimeTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// CanTranscode reports whether TranscodeImage has an encoder for format. webp and avif are
+// still valid hints for providers that honour them, they just can't be produced locally.
+func CanTranscode(format string) bool {
+	return format == "png" || format == "jpeg"
+}
+
+// TranscodeImage re-encodes an image into the requested format.
+// Only formats with a standard library encoder (png, jpeg) are supported;
+// callers should keep the original bytes when an error is returned.
+func TranscodeImage(buf []byte, mimeType, format string) ([]byte, string, error) {
+	targetMime, ok := FormatMimeTypes[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown output format: %s", format)
+	}
+	if targetMime == mimeType {
+		return buf, mimeType, nil
+	}
+
+	if err := checkDecodeSize(bytes.NewReader(buf)); err != nil {
+		return nil, "", err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&out, img)
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+	default:
+		return nil, "", fmt.Errorf("no encoder available for %s", format)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), targetMime, nil
+}
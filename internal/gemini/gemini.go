@@ -2,6 +2,7 @@ package gemini
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,17 +11,19 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"nano-backend/internal/crypto"
 )
 
 // Client is the Gemini 3 Pro API client
 type Client struct {
 	Host    string
-	APIKey  string
+	APIKey  crypto.SecretString
 	Timeout time.Duration
 }
 
 // NewClient creates a new Gemini 3 Pro client
-func NewClient(host, apiKey string, timeout time.Duration) *Client {
+func NewClient(host string, apiKey crypto.SecretString, timeout time.Duration) *Client {
 	return &Client{
 		Host:    strings.TrimRight(host, "/"),
 		APIKey:  apiKey,
@@ -83,7 +86,7 @@ type ResponseContent struct {
 }
 
 // CreateImageTask creates a Gemini 3 Pro image generation task
-func (c *Client) CreateImageTask(prompt, aspectRatio, imageSize string, referenceImages []ReferenceImage) (*ImageGenerationResponse, error) {
+func (c *Client) CreateImageTask(ctx context.Context, prompt, aspectRatio, imageSize string, referenceImages []ReferenceImage) (*ImageGenerationResponse, error) {
 	// Build parts array
 	parts := []Part{
 		{Text: prompt},
@@ -131,13 +134,13 @@ func (c *Client) CreateImageTask(prompt, aspectRatio, imageSize string, referenc
 
 	startTime := time.Now()
 
-	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(jsonBody))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-goog-api-key", c.APIKey)
+	httpReq.Header.Set("x-goog-api-key", c.APIKey.Reveal())
 
 	timeout := c.Timeout
 	if timeout <= 0 {
@@ -2,28 +2,41 @@ package grsai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"nano-backend/internal/crypto"
 )
 
 // Client is the GRS AI API client
 type Client struct {
-	Host   string
-	APIKey string
+	Host    string
+	APIKey  crypto.SecretString
 	Timeout time.Duration
+	// ProgressScale is the value the provider reports for a finished task: 100 for GRS itself,
+	// 1 for gateways that report progress as a fraction
+	ProgressScale float64
 }
 
+// DefaultProgressScale is GRS's own convention: progress is a 0-100 percentage
+const DefaultProgressScale = 100
+
 // NewClient creates a new GRS AI client
-func NewClient(host, apiKey string, timeout time.Duration) *Client {
+func NewClient(host string, apiKey crypto.SecretString, timeout time.Duration) *Client {
 	return &Client{
-		Host:   strings.TrimRight(host, "/"),
-		APIKey: apiKey,
-		Timeout: timeout,
+		Host:          strings.TrimRight(host, "/"),
+		APIKey:        apiKey,
+		Timeout:       timeout,
+		ProgressScale: DefaultProgressScale,
 	}
 }
 
@@ -33,6 +46,7 @@ type NanoBananaRequest struct {
 	Prompt       string   `json:"prompt"`
 	AspectRatio  string   `json:"aspectRatio,omitempty"`
 	ImageSize    string   `json:"imageSize,omitempty"`
+	OutputFormat string   `json:"outputFormat,omitempty"`
 	URLs         []string `json:"urls,omitempty"`
 	WebHook      string   `json:"webHook,omitempty"`
 	ShutProgress bool     `json:"shutProgress"`
@@ -69,8 +83,116 @@ type CreateTaskResponse struct {
 	Result   *TaskResult
 }
 
+// APIError is returned when the provider answers with a non-2xx HTTP status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// Retryable reports whether the failure is likely transient (rate limiting or a server error)
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ResponseError is returned when the provider answers 2xx but the body reports a failure,
+// either via a non-zero "code" or an "error" string/object
+type ResponseError struct {
+	Code    string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+	}
+	return e.Message
+}
+
+// ErrMalformedResponse is returned when a 2xx body carries neither an error nor a task ID
+var ErrMalformedResponse = errors.New("服务返回数据格式异常")
+
+// maxLoggedBodyLen caps how much of an unexpected response body is written to the log
+const maxLoggedBodyLen = 1000
+
+// responseError extracts a failure reported inside a 2xx response body, or returns nil
+func responseError(result map[string]interface{}) error {
+	if code, ok := result["code"].(float64); ok && code != 0 {
+		msg := firstString(result, "msg", "message")
+		if msg == "" {
+			msg = "API调用失败"
+		}
+		return &ResponseError{Code: strconv.FormatFloat(code, 'f', -1, 64), Message: msg}
+	}
+
+	switch e := result["error"].(type) {
+	case string:
+		if e != "" {
+			return &ResponseError{Message: e}
+		}
+	case map[string]interface{}:
+		msg := firstString(e, "message", "msg")
+		if msg == "" {
+			msg = "API调用失败"
+		}
+		code := firstString(e, "code", "type")
+		if n, ok := e["code"].(float64); ok && code == "" {
+			code = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		return &ResponseError{Code: code, Message: msg}
+	}
+	return nil
+}
+
+// extractTaskID looks for the task ID under data.id, a bare string data, or a top-level id
+func extractTaskID(result map[string]interface{}) string {
+	switch data := result["data"].(type) {
+	case map[string]interface{}:
+		if id, ok := data["id"].(string); ok && id != "" {
+			return id
+		}
+	case string:
+		if data != "" {
+			return data
+		}
+	}
+	if id, ok := result["id"].(string); ok {
+		return id
+	}
+	return ""
+}
+
+func firstString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := m[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// bodyForLog renders a parsed response for the log, truncated so huge payloads don't flood it
+func bodyForLog(result map[string]interface{}) string {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Sprintf("%v", result)
+	}
+	return rawForLog(raw)
+}
+
+// rawForLog is bodyForLog for bytes that haven't been (or can't be) parsed
+func rawForLog(raw []byte) string {
+	if len(raw) > maxLoggedBodyLen {
+		return string(raw[:maxLoggedBodyLen]) + "...(truncated)"
+	}
+	return string(raw)
+}
+
 // postJSON makes a POST request with JSON body
-func (c *Client) postJSON(endpoint string, body interface{}) (map[string]interface{}, error) {
+func (c *Client) postJSON(ctx context.Context, endpoint string, body interface{}) (map[string]interface{}, error) {
 	url := c.Host + endpoint
 
 	jsonBody, err := json.Marshal(body)
@@ -79,17 +201,17 @@ func (c *Client) postJSON(endpoint string, body interface{}) (map[string]interfa
 	}
 
 	log.Printf("[grsai] POST %s", url)
-	log.Printf("[grsai] Request Body: %s", string(jsonBody))
+	log.Printf("[grsai] Request Body: %s", rawForLog(jsonBody))
 
 	startTime := time.Now()
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	req.Header.Set("Authorization", "Bearer "+c.APIKey.Reveal())
 
 	// 增加超时时间以支持多个并发任务，特别是视频生成任务可能需要更长时间
 	timeout := c.Timeout
@@ -111,13 +233,13 @@ func (c *Client) postJSON(endpoint string, body interface{}) (map[string]interfa
 	}
 
 	log.Printf("[grsai] Response Status: %d (took %v)", resp.StatusCode, time.Since(startTime))
-	log.Printf("[grsai] Response Body: %s", string(respBody))
+	log.Printf("[grsai] Response Body: %s", rawForLog(respBody))
 
 	var result map[string]interface{}
 	if len(respBody) > 0 {
 		// Check if response is SSE format (starts with "data:")
 		respStr := strings.TrimSpace(string(respBody))
-		if strings.HasPrefix(respStr, "data:") {
+		if strings.HasPrefix(respStr, "data:") || strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
 			// Parse SSE stream - find the last valid JSON message
 			result = parseSSEResponse(respStr)
 			if result != nil {
@@ -141,14 +263,14 @@ func (c *Client) postJSON(endpoint string, body interface{}) (map[string]interfa
 				msg = m
 			}
 		}
-		return nil, fmt.Errorf("%s (HTTP %d)", msg, resp.StatusCode)
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: msg}
 	}
 
 	return result, nil
 }
 
 // CreateNanoBananaTask creates a Nano Banana image generation task
-func (c *Client) CreateNanoBananaTask(model, prompt, aspectRatio, imageSize string, urls []string) (*CreateTaskResponse, error) {
+func (c *Client) CreateNanoBananaTask(ctx context.Context, model, prompt, aspectRatio, imageSize, outputFormat string, urls []string) (*CreateTaskResponse, error) {
 	req := NanoBananaRequest{
 		Model:        model,
 		Prompt:       prompt,
@@ -162,44 +284,31 @@ func (c *Client) CreateNanoBananaTask(model, prompt, aspectRatio, imageSize stri
 	if imageSize != "" {
 		req.ImageSize = imageSize
 	}
+	// 输出格式提示（如 webp），服务端不支持时会忽略
+	req.OutputFormat = outputFormat
 
 	log.Printf("[grsai] Creating Nano Banana task: model=%s, aspectRatio=%s, imageSize=%s, urls=%d items",
 		model, aspectRatio, imageSize, len(urls))
 
-	result, err := c.postJSON("/v1/draw/nano-banana", req)
+	result, err := c.postJSON(ctx, "/v1/draw/nano-banana", req)
 	if err != nil {
 		return nil, err
 	}
 
 	// Check for error in response
-	if code, ok := result["code"].(float64); ok && code != 0 {
-		msg := "API调用失败"
-		if m, ok := result["msg"].(string); ok && m != "" {
-			msg = m
-		} else if m, ok := result["message"].(string); ok && m != "" {
-			msg = m
-		}
-		return nil, fmt.Errorf("%s", msg)
+	if err := responseError(result); err != nil {
+		log.Printf("[grsai] Error in 2xx response: %s", bodyForLog(result))
+		return nil, err
 	}
 
 	// Try to get task ID
-	var taskID string
-	if data, ok := result["data"].(map[string]interface{}); ok {
-		if id, ok := data["id"].(string); ok {
-			taskID = id
-		}
-	}
-	if taskID == "" {
-		if id, ok := result["id"].(string); ok {
-			taskID = id
-		}
-	}
+	taskID := extractTaskID(result)
 
 	// Check if result is immediately available
 	if status, ok := result["status"].(string); ok && status != "" {
 		if results, ok := result["results"].([]interface{}); ok && len(results) > 0 {
 			log.Printf("[grsai] Task completed immediately with status: %s", status)
-			taskResult := parseTaskResult(result)
+			taskResult := c.parseTaskResult(result)
 			return &CreateTaskResponse{
 				ID:       taskID,
 				Finished: true,
@@ -209,8 +318,8 @@ func (c *Client) CreateNanoBananaTask(model, prompt, aspectRatio, imageSize stri
 	}
 
 	if taskID == "" {
-		log.Printf("[grsai] Unexpected response format: %v", result)
-		return nil, fmt.Errorf("服务返回数据格式异常")
+		log.Printf("[grsai] Unexpected response format: %s", bodyForLog(result))
+		return nil, fmt.Errorf("%w: 缺少任务 ID", ErrMalformedResponse)
 	}
 
 	log.Printf("[grsai] Created Nano Banana task: %s", taskID)
@@ -218,7 +327,7 @@ func (c *Client) CreateNanoBananaTask(model, prompt, aspectRatio, imageSize stri
 }
 
 // CreateSoraVideoTask creates a Sora video generation task
-func (c *Client) CreateSoraVideoTask(model, prompt, refURL, aspectRatio string, duration int, size string) (*CreateTaskResponse, error) {
+func (c *Client) CreateSoraVideoTask(ctx context.Context, model, prompt, refURL, aspectRatio string, duration int, size string) (*CreateTaskResponse, error) {
 	req := SoraVideoRequest{
 		Model:        model,
 		Prompt:       prompt,
@@ -235,40 +344,25 @@ func (c *Client) CreateSoraVideoTask(model, prompt, refURL, aspectRatio string,
 	log.Printf("[grsai] Creating Sora video task: model=%s, aspectRatio=%s, duration=%d, size=%s, refURL=%s",
 		model, aspectRatio, duration, size, refURL)
 
-	result, err := c.postJSON("/v1/video/sora-video", req)
+	result, err := c.postJSON(ctx, "/v1/video/sora-video", req)
 	if err != nil {
 		return nil, err
 	}
 
 	// Check for error in response
-	if code, ok := result["code"].(float64); ok && code != 0 {
-		msg := "API调用失败"
-		if m, ok := result["msg"].(string); ok && m != "" {
-			msg = m
-		} else if m, ok := result["message"].(string); ok && m != "" {
-			msg = m
-		}
-		return nil, fmt.Errorf("%s", msg)
+	if err := responseError(result); err != nil {
+		log.Printf("[grsai] Error in 2xx response: %s", bodyForLog(result))
+		return nil, err
 	}
 
 	// Try to get task ID
-	var taskID string
-	if data, ok := result["data"].(map[string]interface{}); ok {
-		if id, ok := data["id"].(string); ok {
-			taskID = id
-		}
-	}
-	if taskID == "" {
-		if id, ok := result["id"].(string); ok {
-			taskID = id
-		}
-	}
+	taskID := extractTaskID(result)
 
 	// Check if result is immediately available
 	if status, ok := result["status"].(string); ok && status != "" {
 		if results, ok := result["results"].([]interface{}); ok && len(results) > 0 {
 			log.Printf("[grsai] Task completed immediately with status: %s", status)
-			taskResult := parseTaskResult(result)
+			taskResult := c.parseTaskResult(result)
 			return &CreateTaskResponse{
 				ID:       taskID,
 				Finished: true,
@@ -278,8 +372,8 @@ func (c *Client) CreateSoraVideoTask(model, prompt, refURL, aspectRatio string,
 	}
 
 	if taskID == "" {
-		log.Printf("[grsai] Unexpected response format: %v", result)
-		return nil, fmt.Errorf("服务返回数据格式异常")
+		log.Printf("[grsai] Unexpected response format: %s", bodyForLog(result))
+		return nil, fmt.Errorf("%w: 缺少任务 ID", ErrMalformedResponse)
 	}
 
 	log.Printf("[grsai] Created Sora video task: %s", taskID)
@@ -287,10 +381,10 @@ func (c *Client) CreateSoraVideoTask(model, prompt, refURL, aspectRatio string,
 }
 
 // GetTaskResult queries the result of a task
-func (c *Client) GetTaskResult(taskID string) (*TaskResult, error) {
+func (c *Client) GetTaskResult(ctx context.Context, taskID string) (*TaskResult, error) {
 	log.Printf("[grsai] Querying task result: %s", taskID)
 
-	result, err := c.postJSON("/v1/draw/result", map[string]string{"id": taskID})
+	result, err := c.postJSON(ctx, "/v1/draw/result", map[string]string{"id": taskID})
 	if err != nil {
 		return nil, err
 	}
@@ -301,11 +395,28 @@ func (c *Client) GetTaskResult(taskID string) (*TaskResult, error) {
 		data = d
 	}
 
-	return parseTaskResult(data), nil
+	return c.parseTaskResult(data), nil
+}
+
+// normalizeProgress maps provider progress reported against scale (the value for "done") onto
+// 0-100 and clamps it. The scale is fixed per provider; guessing it from the value itself would
+// misread a fraction provider's 1.0 as 1% or a percentage provider's 0.5 as 50%.
+func normalizeProgress(p, scale float64) float64 {
+	if scale <= 0 {
+		scale = DefaultProgressScale
+	}
+	p = p * 100 / scale
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
 }
 
 // parseTaskResult parses a map into a TaskResult
-func parseTaskResult(data map[string]interface{}) *TaskResult {
+func (c *Client) parseTaskResult(data map[string]interface{}) *TaskResult {
 	result := &TaskResult{}
 
 	if id, ok := data["id"].(string); ok {
@@ -315,7 +426,7 @@ func parseTaskResult(data map[string]interface{}) *TaskResult {
 		result.Status = status
 	}
 	if progress, ok := data["progress"].(float64); ok {
-		result.Progress = progress
+		result.Progress = normalizeProgress(progress, c.ProgressScale)
 	}
 	if errStr, ok := data["error"].(string); ok {
 		result.Error = errStr
@@ -357,32 +468,42 @@ func ExtractFirstResultURL(result *TaskResult) string {
 }
 
 // parseSSEResponse parses SSE (Server-Sent Events) format response
-// It looks for lines starting with "data:" and returns the last valid JSON message
-// with status "succeeded" or "failed", or the last valid JSON if no completed status found
+// Events are separated by blank lines and may carry several "data:" lines. It returns the
+// last event with status "succeeded" or "failed", or the last valid JSON if no completed
+// status was seen. A truncated trailing event is ignored, and a stream that ends without
+// a terminal status is reported as still running so the caller keeps polling.
 func parseSSEResponse(respStr string) map[string]interface{} {
-	lines := strings.Split(respStr, "\n")
+	respStr = strings.ReplaceAll(respStr, "\r\n", "\n")
+
 	var lastResult map[string]interface{}
 	var completedResult map[string]interface{}
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "data:") {
-			continue
+	var lastRaw string
+
+	for _, event := range strings.Split(respStr, "\n\n") {
+		var dataLines []string
+		for _, line := range strings.Split(event, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			dataLines = append(dataLines, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
 		}
 
 		// Extract JSON part after "data:"
-		jsonStr := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-		if jsonStr == "" {
+		jsonStr := strings.TrimSpace(strings.Join(dataLines, "\n"))
+		if jsonStr == "" || jsonStr == "[DONE]" {
 			continue
 		}
+		lastRaw = jsonStr
 
-		var data map[string]interface{}
-		if err := json.Unmarshal([]byte(jsonStr), &data); err != nil {
-			log.Printf("[grsai] Failed to parse SSE data line: %v", err)
+		data, ok := parseSSEData(jsonStr, dataLines)
+		if !ok {
+			log.Printf("[grsai] Failed to parse SSE event (possibly truncated), %d bytes", len(jsonStr))
 			continue
 		}
 
 		lastResult = data
+		lastRaw = ""
 
 		// Check if this is a completed message (succeeded or failed)
 		if status, ok := data["status"].(string); ok {
@@ -396,5 +517,39 @@ func parseSSEResponse(respStr string) map[string]interface{} {
 	if completedResult != nil {
 		return completedResult
 	}
+
+	if lastResult == nil && lastRaw != "" {
+		// Nothing parsed completely; salvage the task id from the truncated payload
+		if m := sseTaskIDPattern.FindStringSubmatch(lastRaw); m != nil {
+			log.Printf("[grsai] Recovered task id %s from truncated SSE stream", m[1])
+			lastResult = map[string]interface{}{"id": m[1]}
+		}
+	}
+
+	if lastResult != nil {
+		if _, ok := lastResult["status"]; ok || lastResult["id"] != nil {
+			log.Printf("[grsai] SSE stream ended without terminal status, treating as running")
+			lastResult["status"] = "running"
+		}
+	}
 	return lastResult
 }
+
+var sseTaskIDPattern = regexp.MustCompile(`"id"\s*:\s*"([^"]+)"`)
+
+// parseSSEData decodes one event's payload. Some servers send one JSON document per
+// "data:" line instead of joining them, so fall back to the last line that parses.
+func parseSSEData(jsonStr string, dataLines []string) (map[string]interface{}, bool) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonStr), &data); err == nil {
+		return data, true
+	}
+
+	for i := len(dataLines) - 1; i >= 0; i-- {
+		data = nil
+		if err := json.Unmarshal([]byte(dataLines[i]), &data); err == nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,238 @@
+package grsai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer answers every request with the given status and body
+func newTestServer(t *testing.T, status int, body string) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL, "test-key", 5*time.Second)
+}
+
+func TestGetTaskResultProgressScale(t *testing.T) {
+	tests := []struct {
+		name     string
+		scale    float64
+		progress string
+		want     float64
+	}{
+		{"percent midway", DefaultProgressScale, "50", 50},
+		{"percent done", DefaultProgressScale, "100", 100},
+		{"percent below one", DefaultProgressScale, "0.5", 0.5},
+		{"percent over range", DefaultProgressScale, "130", 100},
+		{"fraction midway", 1, "0.5", 50},
+		{"fraction done", 1, "1.0", 100},
+		{"fraction negative", 1, "-0.2", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestServer(t, http.StatusOK, `{"code":0,"data":{"id":"t1","status":"running","progress":`+tt.progress+`}}`)
+			client.ProgressScale = tt.scale
+
+			result, err := client.GetTaskResult(context.Background(), "t1")
+			if err != nil {
+				t.Fatalf("GetTaskResult: %v", err)
+			}
+			if result.Progress != tt.want {
+				t.Errorf("progress = %v, want %v", result.Progress, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateNanoBananaTaskMalformedResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode string
+		wantMsg  string
+	}{
+		{"error object", `{"error":{"message":"quota exhausted","code":"insufficient_quota"}}`, "insufficient_quota", "quota exhausted"},
+		{"error string", `{"error":"bad prompt"}`, "", "bad prompt"},
+		{"non-zero code", `{"code":-1,"msg":"invalid model"}`, "-1", "invalid model"},
+		{"non-zero code without message", `{"code":500}`, "500", "API调用失败"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestServer(t, http.StatusOK, tt.body)
+
+			_, err := client.CreateNanoBananaTask(context.Background(), "nano-banana", "cat", "1:1", "", "", nil)
+			var respErr *ResponseError
+			if !errors.As(err, &respErr) {
+				t.Fatalf("err = %v, want *ResponseError", err)
+			}
+			if respErr.Code != tt.wantCode || respErr.Message != tt.wantMsg {
+				t.Errorf("got code=%q msg=%q, want code=%q msg=%q", respErr.Code, respErr.Message, tt.wantCode, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestCreateNanoBananaTaskMissingID(t *testing.T) {
+	for name, body := range map[string]string{
+		"empty object":    `{}`,
+		"data without id": `{"code":0,"data":{"status":"running"}}`,
+		"null data":       `{"code":0,"data":null}`,
+		"not json":        `<html>gateway</html>`,
+		"empty body":      ``,
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := newTestServer(t, http.StatusOK, body)
+
+			_, err := client.CreateNanoBananaTask(context.Background(), "nano-banana", "cat", "1:1", "", "", nil)
+			if !errors.Is(err, ErrMalformedResponse) {
+				t.Fatalf("err = %v, want ErrMalformedResponse", err)
+			}
+		})
+	}
+}
+
+func TestCreateNanoBananaTaskForwardsOutputFormat(t *testing.T) {
+	var got NanoBananaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"code":0,"data":{"id":"task-1"}}`))
+	}))
+	t.Cleanup(srv.Close)
+	client := NewClient(srv.URL, "test-key", 5*time.Second)
+
+	if _, err := client.CreateNanoBananaTask(context.Background(), "nano-banana", "cat", "1:1", "", "webp", nil); err != nil {
+		t.Fatalf("CreateNanoBananaTask: %v", err)
+	}
+	if got.OutputFormat != "webp" {
+		t.Errorf("outputFormat = %q, want webp", got.OutputFormat)
+	}
+}
+
+func TestCreateSoraVideoTaskMissingID(t *testing.T) {
+	client := newTestServer(t, http.StatusOK, `{"code":0,"data":{}}`)
+
+	_, err := client.CreateSoraVideoTask(context.Background(), "sora-2", "cat", "", "16:9", 10, "")
+	if !errors.Is(err, ErrMalformedResponse) {
+		t.Fatalf("err = %v, want ErrMalformedResponse", err)
+	}
+}
+
+func TestPostJSONTruncatesLoggedBodies(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	huge := strings.Repeat("x", 10*maxLoggedBodyLen)
+	client := newTestServer(t, http.StatusOK, `{"code":0,"data":{"id":"t1"},"blob":"`+huge+`"}`)
+
+	if _, err := client.CreateNanoBananaTask(context.Background(), "nano-banana", huge, "1:1", "", "", nil); err != nil {
+		t.Fatalf("CreateNanoBananaTask: %v", err)
+	}
+	if strings.Contains(buf.String(), huge) {
+		t.Error("log contains the full request or response body")
+	}
+	if !strings.Contains(buf.String(), "...(truncated)") {
+		t.Error("log is missing the truncation marker")
+	}
+}
+
+func TestParseSSEResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     string
+		wantID     string
+		wantStatus string
+	}{
+		{
+			"terminal event wins over later noise",
+			"data: {\"id\":\"t1\",\"status\":\"running\",\"progress\":10}\n\n" +
+				"data: {\"id\":\"t1\",\"status\":\"succeeded\",\"results\":[{\"url\":\"https://cdn/a.png\"}]}\n\n" +
+				"data: [DONE]\n\n",
+			"t1", "succeeded",
+		},
+		{
+			"one document split across data lines",
+			"data: {\"id\":\"t2\",\n" +
+				"data: \"status\":\"failed\",\"error\":\"nsfw\"}\n\n",
+			"t2", "failed",
+		},
+		{
+			"one document per data line in a single event",
+			"data: {\"id\":\"t3\",\"status\":\"running\"}\n" +
+				"data: {\"id\":\"t3\",\"status\":\"succeeded\"}\n\n",
+			"t3", "succeeded",
+		},
+		{
+			"CRLF line endings",
+			"data: {\"id\":\"t4\",\"status\":\"succeeded\"}\r\n\r\n",
+			"t4", "succeeded",
+		},
+		{
+			"truncated trailing event is ignored",
+			"data: {\"id\":\"t5\",\"status\":\"running\",\"progress\":40}\n\n" +
+				"data: {\"id\":\"t5\",\"status\":\"succ",
+			"t5", "running",
+		},
+		{
+			"stream ends without terminal status",
+			"data: {\"id\":\"t6\",\"status\":\"running\",\"progress\":90}\n\n",
+			"t6", "running",
+		},
+		{
+			"only a truncated event; id salvaged",
+			"data: {\"id\":\"t7\",\"status\":\"running\",\"progr",
+			"t7", "running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSSEResponse(tt.stream)
+			if got == nil {
+				t.Fatal("parseSSEResponse returned nil")
+			}
+			if id, _ := got["id"].(string); id != tt.wantID {
+				t.Errorf("id = %q, want %q", id, tt.wantID)
+			}
+			if status, _ := got["status"].(string); status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+
+	if got := parseSSEResponse("data: {\"stat"); got != nil {
+		t.Errorf("garbage without an id = %v, want nil", got)
+	}
+}
+
+func TestGetTaskResultSSEOverHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"id\":\"t1\",\"status\":\"running\",\"progress\":50}\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: {\"id\":\"t1\",\"status\":\"succeeded\",\"progress\":100,\"results\":[{\"url\":\"https://cdn/a.png\"}]}\n\n"))
+	}))
+	t.Cleanup(srv.Close)
+	client := NewClient(srv.URL, "test-key", 5*time.Second)
+
+	result, err := client.GetTaskResult(context.Background(), "t1")
+	if err != nil {
+		t.Fatalf("GetTaskResult: %v", err)
+	}
+	if result.Status != "succeeded" || ExtractFirstResultURL(result) != "https://cdn/a.png" {
+		t.Errorf("result = %+v, want succeeded with the result URL", result)
+	}
+}
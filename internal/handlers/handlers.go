@@ -1,15 +1,27 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"nano-backend/internal/config"
 	"nano-backend/internal/crypto"
@@ -24,18 +36,100 @@ import (
 
 var cfg *config.Config
 
+// ActiveJobs reports the generation IDs the job runner is processing, and CancelJob interrupts one;
+// both are set by main to avoid an import cycle
+var (
+	ActiveJobs func() []string
+	CancelJob  func(generationID string) bool
+)
+
 func init() {
 	cfg = config.Load()
 }
 
 // ========== Health Check ==========
 
+// HealthCheck 同时返回服务器时间 (毫秒) 与时区，客户端可据此计算时钟偏差
 func HealthCheck(c *fiber.Ctx) error {
-	return c.JSON(fiber.Map{"ok": true})
+	now := time.Now()
+	zone, offset := now.Zone()
+	return c.JSON(fiber.Map{
+		"ok":               true,
+		"serverTime":       now.UnixMilli(),
+		"timezone":         zone,
+		"utcOffsetMinutes": offset / 60,
+	})
+}
+
+func GetVersion(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"version":   config.Version,
+		"commit":    config.GitCommit,
+		"buildTime": config.BuildTime,
+		"goVersion": runtime.Version(),
+	})
+}
+
+// Limits shared by request validation and GET /api/config
+const (
+	MaxUploadBytes   = 25 * 1024 * 1024 // 25MB, also the Fiber body limit
+	minVideoDuration = 2
+	maxVideoDuration = 30
+)
+
+// GetPublicConfig 返回前端需要的非敏感运行时配置 (不含任何密钥与服务商信息)
+func GetPublicConfig(c *fiber.Ctx) error {
+	videoEnabled := false
+	maxReferences := 0
+	for _, m := range supportedModels {
+		m = withRuntimeLimits(m)
+		if m.Type == "video" {
+			videoEnabled = true
+		}
+		if m.Type == "image" && m.MaxReferences > maxReferences {
+			maxReferences = m.MaxReferences
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"imageBatchMax":     withRuntimeLimits(models.ModelInfo{Type: "image"}).MaxBatch,
+		"maxReferences":     maxReferences,
+		"imageSizes":        imageSizes,
+		"imageAspectRatios": imageAspectRatios,
+		"videoDuration": fiber.Map{
+			"min": minVideoDuration,
+			"max": maxVideoDuration,
+		},
+		"maxUploadBytes":    MaxUploadBytes,
+		"storageQuotaBytes": storageQuotaBytes(),
+		"features": fiber.Map{
+			"video":            videoEnabled,
+			"transcodeOutputs": cfg.TranscodeOutputs,
+		},
+	})
 }
 
 // ========== Auth Handlers ==========
 
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is a hash of a random password with the current cost parameters,
+// verified against when the username doesn't exist
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		hash, err := crypto.HashPassword(crypto.RandomToken())
+		if err != nil {
+			log.Printf("[auth] Error creating dummy password hash: %v", err)
+			return
+		}
+		dummyHash = hash
+	})
+	return dummyHash
+}
+
 func Login(c *fiber.Ctx) error {
 	var body struct {
 		Username string `json:"username"`
@@ -54,6 +148,8 @@ func Login(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 	if user == nil {
+		// 用户不存在时同样执行一次密码校验，使响应耗时与密码错误一致，避免按耗时枚举用户名
+		crypto.VerifyPassword(body.Password, dummyPasswordHash())
 		log.Printf("[auth] User not found: %s", body.Username)
 		return c.Status(401).JSON(fiber.Map{"error": "用户名或密码错误"})
 	}
@@ -66,6 +162,12 @@ func Login(c *fiber.Ctx) error {
 	// Check if user is disabled
 	if user.Disabled {
 		log.Printf("[auth] User is disabled: %s", body.Username)
+		if user.DisabledReason != "" {
+			return c.Status(403).JSON(fiber.Map{
+				"error":          "账号已被禁用：" + user.DisabledReason,
+				"disabledReason": user.DisabledReason,
+			})
+		}
 		return c.Status(403).JSON(fiber.Map{"error": "账号已被禁用，请联系管理员"})
 	}
 
@@ -81,7 +183,7 @@ func Login(c *fiber.Ctx) error {
 	}
 	// =====================
 
-	session, err := database.CreateSession(user.ID, cfg.SessionTTLHours)
+	session, err := database.CreateSession(user.ID, cfg.SessionTTLForRole(user.Role))
 	if err != nil {
 		log.Printf("[auth] Failed to create session: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
@@ -114,7 +216,8 @@ func Logout(c *fiber.Ctx) error {
 	}
 
 	// === 方案第3点：将状态置为未登录 ===
-	if user != nil {
+	// 模拟登录的会话不影响被模拟用户自己的登录状态
+	if user != nil && user.ImpersonatedBy == "" {
 		if err := database.UpdateLoginStatus(user.ID, false); err != nil {
 			log.Printf("[auth] Update status error: %v", err)
 		}
@@ -126,12 +229,105 @@ func Logout(c *fiber.Ctx) error {
 
 func GetCurrentUser(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	return c.JSON(user)
+	if user == nil {
+		return c.Status(401).JSON(fiber.Map{"error": "未登录或登录已过期"})
+	}
+
+	prefs, err := database.GetUserPrefs(user.ID)
+	if err != nil {
+		log.Printf("[auth] Error getting prefs: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	resp := *user
+	resp.Prefs = prefs
+	return c.JSON(resp)
+}
+
+// GetUserPrefs 返回当前用户的个人偏好
+func GetUserPrefs(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	prefs, err := database.GetUserPrefs(user.ID)
+	if err != nil {
+		log.Printf("[prefs] Error getting prefs: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	return c.JSON(prefs)
+}
+
+// UpdateUserPrefs 保存个人偏好；defaultModel 为空表示清除默认模型
+func UpdateUserPrefs(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	var body struct {
+		DefaultModel *string `json:"defaultModel"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+	}
+
+	prefs, err := database.GetUserPrefs(user.ID)
+	if err != nil {
+		log.Printf("[prefs] Error getting prefs: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	if body.DefaultModel != nil {
+		modelID := strings.TrimSpace(*body.DefaultModel)
+		if modelID != "" && GetModelByID(modelID) == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "不支持的模型"})
+		}
+		prefs.DefaultModel = modelID
+	}
+
+	if err := database.SetUserPrefs(user.ID, prefs); err != nil {
+		log.Printf("[prefs] Error saving prefs: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	return c.JSON(prefs)
+}
+
+// resolveModelID 请求未指定模型时使用用户保存的默认模型 (仅当类型匹配)
+func resolveModelID(userID, requested, modelType string) string {
+	if requested != "" {
+		return requested
+	}
+	prefs, err := database.GetUserPrefs(userID)
+	if err != nil {
+		log.Printf("[prefs] Error getting prefs: %v", err)
+		return ""
+	}
+	if m := GetModelByID(prefs.DefaultModel); m != nil && m.Type == modelType {
+		return m.ID
+	}
+	return ""
+}
+
+// GetStorageUsage 返回当前用户的存储占用与配额 (quotaBytes 为 0 表示不限)
+func GetStorageUsage(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	used, err := database.GetUserUsage(user.ID)
+	if err != nil {
+		log.Printf("[usage] Error getting usage: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	return c.JSON(fiber.Map{
+		"usedBytes":  used,
+		"quotaBytes": storageQuotaBytes(),
+	})
 }
 
 // Heartbeat 接收前端的保活请求
 func Heartbeat(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
+	if user == nil {
+		return c.Status(401).JSON(fiber.Map{"error": "未登录或登录已过期"})
+	}
+	if user.ImpersonatedBy != "" {
+		return c.JSON(fiber.Map{"ok": true})
+	}
 
 	if err := database.UpdateHeartbeat(user.ID); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
@@ -142,6 +338,11 @@ func Heartbeat(c *fiber.Ctx) error {
 
 // ========== Models Handler ==========
 
+var (
+	imageAspectRatios = []string{"auto", "1:1", "16:9", "9:16", "4:3", "3:4", "3:2", "2:3", "5:4", "4:5", "21:9"}
+	imageSizes        = []string{"1K", "2K", "4K"}
+)
+
 var supportedModels = []models.ModelInfo{
 	{
 		ID:                  "nano-banana-fast",
@@ -149,6 +350,9 @@ var supportedModels = []models.ModelInfo{
 		Type:                "image",
 		SupportsImageSize:   true,
 		SupportsAspectRatio: true,
+		AspectRatios:        imageAspectRatios,
+		Sizes:               imageSizes,
+		MaxReferences:       14,
 		Tags:                []string{"fast", "1K"},
 	},
 	{
@@ -157,6 +361,9 @@ var supportedModels = []models.ModelInfo{
 		Type:                "image",
 		SupportsImageSize:   true,
 		SupportsAspectRatio: true,
+		AspectRatios:        imageAspectRatios,
+		Sizes:               imageSizes,
+		MaxReferences:       14,
 		Tags:                []string{"1K"},
 	},
 	{
@@ -165,6 +372,9 @@ var supportedModels = []models.ModelInfo{
 		Type:                "image",
 		SupportsImageSize:   true,
 		SupportsAspectRatio: true,
+		AspectRatios:        imageAspectRatios,
+		Sizes:               imageSizes,
+		MaxReferences:       14,
 		Tags:                []string{"pro", "1K/2K/4K"},
 	},
 	{
@@ -173,6 +383,9 @@ var supportedModels = []models.ModelInfo{
 		Type:                "image",
 		SupportsImageSize:   true,
 		SupportsAspectRatio: true,
+		AspectRatios:        imageAspectRatios,
+		Sizes:               imageSizes,
+		MaxReferences:       14,
 		Tags:                []string{"pro", "vt", "1K/2K/4K"},
 	},
 	{
@@ -181,6 +394,9 @@ var supportedModels = []models.ModelInfo{
 		Type:                "image",
 		SupportsImageSize:   true,
 		SupportsAspectRatio: true,
+		AspectRatios:        imageAspectRatios,
+		Sizes:               imageSizes,
+		MaxReferences:       14,
 		Tags:                []string{"gemini", "1K/2K/4K"},
 	},
 	{
@@ -188,82 +404,319 @@ var supportedModels = []models.ModelInfo{
 		Name:                "Sora 2",
 		Type:                "video",
 		SupportsAspectRatio: true,
+		AspectRatios:        []string{"9:16", "16:9"},
+		Sizes:               []string{"small", "large"},
+		MaxReferences:       1,
 		Tags:                []string{"video"},
 	},
 }
 
 func GetModels(c *fiber.Ctx) error {
-	return c.JSON(supportedModels)
+	disabled := disabledModelSet()
+	list := make([]models.ModelInfo, len(supportedModels))
+	for i, m := range supportedModels {
+		list[i] = withRuntimeLimits(m)
+		list[i].Disabled = disabled[m.ID]
+	}
+	return c.JSON(list)
 }
 
 func GetModelByID(modelID string) *models.ModelInfo {
 	for _, m := range supportedModels {
 		if m.ID == modelID {
+			m = withRuntimeLimits(m)
+			m.Disabled = disabledModelSet()[m.ID]
 			return &m
 		}
 	}
 	return nil
 }
 
+// disabledModelSet returns the model IDs an admin has switched off in settings
+func disabledModelSet() map[string]bool {
+	settings, _, err := database.GetSettings()
+	if err != nil {
+		log.Printf("[models] Error getting settings: %v", err)
+		return nil
+	}
+	set := make(map[string]bool, len(settings.DisabledModels))
+	for _, id := range settings.DisabledModels {
+		set[id] = true
+	}
+	return set
+}
+
+// withRuntimeLimits fills in limits that come from config rather than the static registry,
+// so /api/models and request validation always agree
+func withRuntimeLimits(m models.ModelInfo) models.ModelInfo {
+	m.MaxBatch = 1
+	if m.Type == "image" && cfg.ImageBatchMax > 1 {
+		m.MaxBatch = cfg.ImageBatchMax
+	}
+	if m.Type == "image" && cfg.ImageMaxReferences > 0 {
+		m.MaxReferences = cfg.ImageMaxReferences
+	}
+	return m
+}
+
 // ========== Provider Settings Handlers ==========
 
 func GetProviderSettings(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	provider, err := database.GetUserProvider(user.ID)
+	settings, err := providerSettingsResponse(user.ID)
 	if err != nil {
 		log.Printf("[provider] Error getting provider: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
+	return c.JSON(settings)
+}
 
-	providerHost := cfg.DefaultProviderHost
-	hasAPIKey := cfg.DefaultProviderAPIKey != ""
+func UpdateProviderSettings(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
 
-	if provider != nil {
-		providerHost = provider.ProviderHost
-		hasAPIKey = provider.APIKeyEnc != "" || cfg.DefaultProviderAPIKey != ""
+	if locked, err := isProviderLocked(user); err != nil {
+		log.Printf("[provider] Error getting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	} else if locked {
+		return c.Status(403).JSON(fiber.Map{"error": "服务商设置已被管理员锁定"})
 	}
 
-	return c.JSON(fiber.Map{
+	body, msg := parseProviderSettings(c)
+	if msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	if err := database.SetUserProvider(user.ID, body.ProviderHost, body.ProviderType, body.APIKey, cfg); err != nil {
+		log.Printf("[provider] Error setting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[provider] Updated provider settings for user %s", user.Username)
+
+	settings, err := providerSettingsResponse(user.ID)
+	if err != nil {
+		log.Printf("[provider] Error getting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	return c.JSON(settings)
+}
+
+type providerSettingsBody struct {
+	ProviderHost string              `json:"providerHost"`
+	ProviderType string              `json:"providerType"`
+	APIKey       crypto.SecretString `json:"apiKey"`
+	Locked       *bool               `json:"locked"` // 仅管理员接口使用，nil 表示不修改
+}
+
+// parseProviderSettings parses and normalizes a provider settings body, returning a user-facing message when invalid
+func parseProviderSettings(c *fiber.Ctx) (providerSettingsBody, string) {
+	var body providerSettingsBody
+	if err := c.BodyParser(&body); err != nil {
+		return body, "请求格式错误"
+	}
+	return body, body.normalize()
+}
+
+func (b *providerSettingsBody) normalize() string {
+	b.ProviderHost = strings.TrimSpace(b.ProviderHost)
+	if b.ProviderHost == "" {
+		return "服务地址不能为空"
+	}
+
+	b.ProviderType = strings.ToLower(strings.TrimSpace(b.ProviderType))
+	if !models.IsValidProviderType(b.ProviderType) {
+		return "不支持的服务类型"
+	}
+	return ""
+}
+
+// isProviderLocked reports whether an admin locked the user's provider; admins are never locked out
+func isProviderLocked(user *models.SanitizedUser) (bool, error) {
+	if user.Role == "admin" {
+		return false, nil
+	}
+	provider, err := database.GetUserProvider(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return provider != nil && provider.Locked, nil
+}
+
+// providerSettingsResponse describes a user's effective provider without ever exposing the key.
+// It resolves the provider the same way the job runner does, so a default profile is reflected here.
+func providerSettingsResponse(userID string) (fiber.Map, error) {
+	provider, err := database.GetUserProvider(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	providerHost, providerType, apiKey, err := database.GetEffectiveProvider(userID, cfg)
+	if err != nil {
+		if !errors.Is(err, database.ErrNoProviderKey) {
+			// 如默认配置的密钥无法解密；生成时会报告同样的错误
+			log.Printf("[provider] Error resolving provider for user %s: %v", userID, err)
+		}
+		providerHost, providerType, apiKey = cfg.DefaultProviderHost, "", ""
+		if provider != nil {
+			providerHost, providerType = provider.ProviderHost, provider.ProviderType
+		}
+	}
+
+	return fiber.Map{
 		"providerHost": providerHost,
-		"hasApiKey":    hasAPIKey,
-	})
+		"providerType": providerType,
+		"hasApiKey":    apiKey != "",
+		"locked":       provider != nil && provider.Locked,
+	}, nil
 }
 
-func UpdateProviderSettings(c *fiber.Ctx) error {
+// ========== Provider Profile Handlers ==========
+
+type providerProfileBody struct {
+	providerSettingsBody
+	Name      string `json:"name"`
+	IsDefault bool   `json:"isDefault"`
+}
+
+// parseProviderProfile parses a profile body; the key is required when creating and optional when updating
+func parseProviderProfile(c *fiber.Ctx, requireKey bool) (providerProfileBody, string) {
+	var body providerProfileBody
+	if err := c.BodyParser(&body); err != nil {
+		return body, "请求格式错误"
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		return body, "名称不能为空"
+	}
+	if msg := body.normalize(); msg != "" {
+		return body, msg
+	}
+	if requireKey && body.APIKey == "" {
+		return body, "接口密钥不能为空"
+	}
+	return body, ""
+}
+
+func toProviderProfileResponse(p *models.ProviderProfile) fiber.Map {
+	return fiber.Map{
+		"id":           p.ID,
+		"name":         p.Name,
+		"providerHost": p.ProviderHost,
+		"providerType": p.ProviderType,
+		"hasApiKey":    p.APIKeyEnc != "",
+		"isDefault":    p.IsDefault,
+		"createdAt":    p.CreatedAt,
+		"updatedAt":    p.UpdatedAt,
+	}
+}
+
+func ListProviderProfiles(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 
-	var body struct {
-		ProviderHost string `json:"providerHost"`
-		APIKey       string `json:"apiKey"`
+	profiles, err := database.ListProviderProfiles(user.ID)
+	if err != nil {
+		log.Printf("[provider] Error listing provider profiles: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
-	if err := c.BodyParser(&body); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+
+	result := make([]fiber.Map, len(profiles))
+	for i := range profiles {
+		result[i] = toProviderProfileResponse(&profiles[i])
+	}
+	return c.JSON(result)
+}
+
+func CreateProviderProfile(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	if locked, err := isProviderLocked(user); err != nil {
+		log.Printf("[provider] Error getting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	} else if locked {
+		return c.Status(403).JSON(fiber.Map{"error": "服务商设置已被管理员锁定"})
 	}
 
-	providerHost := strings.TrimSpace(body.ProviderHost)
-	if providerHost == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "服务地址不能为空"})
+	body, msg := parseProviderProfile(c, true)
+	if msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
 	}
 
-	if err := database.SetUserProvider(user.ID, providerHost, body.APIKey, cfg); err != nil {
-		log.Printf("[provider] Error setting provider: %v", err)
+	profile, err := database.CreateProviderProfile(user.ID, body.Name, body.ProviderHost, body.ProviderType, body.APIKey, body.IsDefault, cfg)
+	if err != nil {
+		log.Printf("[provider] Error creating provider profile: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
-	log.Printf("[provider] Updated provider settings for user %s", user.Username)
+	log.Printf("[provider] Created provider profile %s for user %s", profile.Name, user.Username)
+	return c.JSON(toProviderProfileResponse(profile))
+}
+
+func UpdateProviderProfile(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	id := c.Params("id")
+
+	if locked, err := isProviderLocked(user); err != nil {
+		log.Printf("[provider] Error getting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	} else if locked {
+		return c.Status(403).JSON(fiber.Map{"error": "服务商设置已被管理员锁定"})
+	}
 
-	provider, _ := database.GetUserProvider(user.ID)
-	hasAPIKey := false
-	if provider != nil && provider.APIKeyEnc != "" {
-		hasAPIKey = true
-	} else if cfg.DefaultProviderAPIKey != "" {
-		hasAPIKey = true
+	body, msg := parseProviderProfile(c, false)
+	if msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
 	}
 
-	return c.JSON(fiber.Map{
-		"providerHost": providerHost,
-		"hasApiKey":    hasAPIKey,
-	})
+	err := database.UpdateProviderProfile(user.ID, id, body.Name, body.ProviderHost, body.ProviderType, body.APIKey, body.IsDefault, cfg)
+	if err == sql.ErrNoRows {
+		return respondNotFound(c)
+	}
+	if err != nil {
+		log.Printf("[provider] Error updating provider profile: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	profile, err := database.GetProviderProfile(user.ID, id)
+	if err != nil || profile == nil {
+		log.Printf("[provider] Error getting provider profile: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	return c.JSON(toProviderProfileResponse(profile))
+}
+
+func DeleteProviderProfile(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	id := c.Params("id")
+
+	if locked, err := isProviderLocked(user); err != nil {
+		log.Printf("[provider] Error getting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	} else if locked {
+		return c.Status(403).JSON(fiber.Map{"error": "服务商设置已被管理员锁定"})
+	}
+
+	profile, err := database.GetProviderProfile(user.ID, id)
+	if err != nil {
+		log.Printf("[provider] Error getting provider profile: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if profile == nil {
+		return respondNotFound(c)
+	}
+
+	if err := database.DeleteProviderProfile(user.ID, id); err != nil {
+		log.Printf("[provider] Error deleting provider profile: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+func lockedLabel(locked *bool) string {
+	if locked == nil {
+		return "unchanged"
+	}
+	return strconv.FormatBool(*locked)
 }
 
 // ========== Admin Handlers ==========
@@ -278,11 +731,12 @@ func AdminListUsers(c *fiber.Ctx) error {
 	result := make([]fiber.Map, len(users))
 	for i, u := range users {
 		result[i] = fiber.Map{
-			"id":        u.ID,
-			"username":  u.Username,
-			"role":      u.Role,
-			"disabled":  u.Disabled,
-			"createdAt": u.CreatedAt,
+			"id":             u.ID,
+			"username":       u.Username,
+			"role":           u.Role,
+			"disabled":       u.Disabled,
+			"disabledReason": u.DisabledReason,
+			"createdAt":      u.CreatedAt,
 		}
 	}
 
@@ -299,20 +753,9 @@ func AdminCreateUser(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
 	}
 
-	username := strings.TrimSpace(body.Username)
-	if username == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "用户名不能为空"})
-	}
-	if len(body.Password) < 6 {
-		return c.Status(400).JSON(fiber.Map{"error": "密码长度不能少于 6 个字符"})
-	}
-
-	role := body.Role
-	if role == "" {
-		role = "user"
-	}
-	if role != "admin" && role != "user" {
-		return c.Status(400).JSON(fiber.Map{"error": "角色不正确"})
+	username, role, msg := validateNewUser(body.Username, body.Password, body.Role)
+	if msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
 	}
 
 	user, err := database.CreateUser(username, body.Password, role)
@@ -332,45 +775,170 @@ func AdminCreateUser(c *fiber.Ctx) error {
 	})
 }
 
-func AdminDeleteUser(c *fiber.Ctx) error {
-	currentUser := middleware.GetCurrentUser(c)
-	userID := c.Params("id")
-
-	// Prevent self-deletion
-	if userID == currentUser.ID {
-		return c.Status(400).JSON(fiber.Map{"error": "不能删除自己的账号"})
-	}
-
-	// Get user to check if exists and not the last admin
-	user, err := database.GetUserByID(userID)
-	if err != nil {
-		log.Printf("[admin] Error getting user: %v", err)
-		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+// validateNewUser normalizes the username and role and returns a user-facing message when invalid
+func validateNewUser(username, password, role string) (string, string, string) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return "", "", "用户名不能为空"
 	}
-	if user == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "用户不存在"})
+	if len(password) < 6 {
+		return "", "", "密码长度不能少于 6 个字符"
 	}
 
-	if err := database.DeleteUser(userID); err != nil {
-		log.Printf("[admin] Error deleting user: %v", err)
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	role = strings.TrimSpace(role)
+	if role == "" {
+		role = "user"
+	}
+	if role != "admin" && role != "user" {
+		return "", "", "角色不正确"
 	}
+	return username, role, ""
+}
 
-	log.Printf("[admin] Deleted user: %s", user.Username)
+// maxImportUsers 单次批量导入的最大行数
+const maxImportUsers = 500
 
-	return c.JSON(fiber.Map{"ok": true})
+type importUserRow struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
 }
 
-func AdminUpdateUserStatus(c *fiber.Ctx) error {
-	currentUser := middleware.GetCurrentUser(c)
-	userID := c.Params("id")
+type importUserResult struct {
+	Row      int    `json:"row"`
+	Username string `json:"username"`
+	OK       bool   `json:"ok"`
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
 
-	var body struct {
-		Disabled bool `json:"disabled"`
+// AdminImportUsers 批量创建用户，支持 JSON 数组或 CSV (username,password,role)。
+// 逐行创建，单行失败不影响其他行，返回每行的结果。
+func AdminImportUsers(c *fiber.Ctx) error {
+	var rows []importUserRow
+	if strings.HasPrefix(c.Get("Content-Type"), "text/csv") {
+		parsed, err := parseImportCSV(c.Body())
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "CSV 格式错误"})
+		}
+		rows = parsed
+	} else if err := c.BodyParser(&rows); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+	}
+
+	if len(rows) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "没有要导入的用户"})
+	}
+	if len(rows) > maxImportUsers {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("单次最多导入 %d 个用户", maxImportUsers)})
+	}
+
+	results := make([]importUserResult, 0, len(rows))
+	created := 0
+	for i, row := range rows {
+		result := importUserResult{Row: i + 1, Username: strings.TrimSpace(row.Username)}
+
+		username, role, msg := validateNewUser(row.Username, row.Password, row.Role)
+		if msg != "" {
+			result.Error = msg
+			results = append(results, result)
+			continue
+		}
+
+		user, err := database.CreateUser(username, row.Password, role)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		result.OK = true
+		result.ID = user.ID
+		results = append(results, result)
+		created++
+	}
+
+	log.Printf("[admin] Imported users: %d created, %d failed", created, len(rows)-created)
+
+	return c.JSON(fiber.Map{
+		"created": created,
+		"failed":  len(rows) - created,
+		"results": results,
+	})
+}
+
+// parseImportCSV reads username,password[,role] records; a leading header row is skipped
+func parseImportCSV(data []byte) ([]importUserRow, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) > 0 && len(records[0]) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "username") {
+		records = records[1:]
+	}
+
+	rows := make([]importUserRow, 0, len(records))
+	for _, rec := range records {
+		var row importUserRow
+		if len(rec) > 0 {
+			row.Username = rec[0]
+		}
+		if len(rec) > 1 {
+			row.Password = rec[1]
+		}
+		if len(rec) > 2 {
+			row.Role = rec[2]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func AdminDeleteUser(c *fiber.Ctx) error {
+	currentUser := middleware.GetCurrentUser(c)
+	userID := c.Params("id")
+
+	// Prevent self-deletion
+	if userID == currentUser.ID {
+		return c.Status(400).JSON(fiber.Map{"error": "不能删除自己的账号"})
+	}
+
+	// Get user to check if exists and not the last admin
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("[admin] Error getting user: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if user == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "用户不存在"})
+	}
+
+	if err := database.DeleteUser(userID); err != nil {
+		log.Printf("[admin] Error deleting user: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[admin] Deleted user: %s", user.Username)
+
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+func AdminUpdateUserStatus(c *fiber.Ctx) error {
+	currentUser := middleware.GetCurrentUser(c)
+	userID := c.Params("id")
+
+	var body struct {
+		Disabled bool   `json:"disabled"`
+		Reason   string `json:"reason"` // 可选，仅禁用时保存
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
 	}
+	reason := sanitizeDisabledReason(body.Reason)
 
 	// Prevent self-disabling
 	if userID == currentUser.ID && body.Disabled {
@@ -387,7 +955,7 @@ func AdminUpdateUserStatus(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "用户不存在"})
 	}
 
-	if err := database.UpdateUserDisabled(userID, body.Disabled); err != nil {
+	if err := database.UpdateUserDisabled(userID, body.Disabled, reason); err != nil {
 		log.Printf("[admin] Error updating user status: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -398,12 +966,286 @@ func AdminUpdateUserStatus(c *fiber.Ctx) error {
 	}
 	log.Printf("[admin] Updated user %s status to %s", user.Username, statusText)
 
+	if !body.Disabled {
+		reason = ""
+	}
 	return c.JSON(fiber.Map{
-		"id":        user.ID,
-		"username":  user.Username,
-		"role":      user.Role,
-		"disabled":  body.Disabled,
-		"createdAt": user.CreatedAt,
+		"id":             user.ID,
+		"username":       user.Username,
+		"role":           user.Role,
+		"disabled":       body.Disabled,
+		"disabledReason": reason,
+		"createdAt":      user.CreatedAt,
+	})
+}
+
+// maxDisabledReasonLen caps the disable reason shown to users at login
+const maxDisabledReasonLen = 200
+
+// sanitizeDisabledReason trims the admin's note, drops control characters and caps its length
+func sanitizeDisabledReason(reason string) string {
+	reason = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, reason)
+	reason = strings.TrimSpace(reason)
+	if runes := []rune(reason); len(runes) > maxDisabledReasonLen {
+		reason = string(runes[:maxDisabledReasonLen])
+	}
+	return reason
+}
+
+// impersonationTTL 模拟登录会话的有效期，刻意短于普通会话
+const impersonationTTL = 30 * time.Minute
+
+// AdminImpersonateUser 为目标用户签发一个短期会话，用于管理员排查问题。
+// 目标为管理员时需在请求体中传 {"confirm": true}。
+func AdminImpersonateUser(c *fiber.Ctx) error {
+	currentUser := middleware.GetCurrentUser(c)
+	userID := c.Params("id")
+
+	// Impersonation sessions must not be able to start another impersonation
+	if currentUser.ImpersonatedBy != "" {
+		return c.Status(403).JSON(fiber.Map{"error": "模拟登录状态下不能再次模拟其他用户"})
+	}
+	if userID == currentUser.ID {
+		return c.Status(400).JSON(fiber.Map{"error": "不能模拟自己的账号"})
+	}
+
+	var body struct {
+		Confirm bool `json:"confirm"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+		}
+	}
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("[admin] Error getting user: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if user == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "用户不存在"})
+	}
+	if user.Disabled {
+		return c.Status(400).JSON(fiber.Map{"error": "该用户已被禁用"})
+	}
+	if user.Role == "admin" && !body.Confirm {
+		return c.Status(409).JSON(fiber.Map{"error": "目标用户为管理员，请确认后再模拟登录"})
+	}
+
+	session, err := database.CreateImpersonationSession(user.ID, currentUser.ID, impersonationTTL)
+	if err != nil {
+		log.Printf("[admin] Failed to create impersonation session: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[audit] Admin %s (%s) started impersonating user %s (%s), expires at %d (req=%s)",
+		currentUser.Username, currentUser.ID, user.Username, user.ID, session.ExpiresAt, middleware.GetRequestID(c))
+
+	return c.JSON(fiber.Map{
+		"token":     session.Token,
+		"expiresAt": session.ExpiresAt,
+		"user": models.SanitizedUser{
+			ID:             user.ID,
+			Username:       user.Username,
+			Role:           user.Role,
+			Disabled:       user.Disabled,
+			ImpersonatedBy: currentUser.ID,
+		},
+	})
+}
+
+// AdminSetUserProvider 管理员为指定用户配置服务商 (密钥照常加密存储)，
+// 可选 locked 字段用于锁定设置，锁定后该用户不能自行修改
+func AdminSetUserProvider(c *fiber.Ctx) error {
+	currentUser := middleware.GetCurrentUser(c)
+	userID := c.Params("id")
+
+	user, err := database.GetUserByID(userID)
+	if err != nil {
+		log.Printf("[admin] Error getting user: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if user == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "用户不存在"})
+	}
+
+	body, msg := parseProviderSettings(c)
+	if msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	if err := database.SetUserProvider(user.ID, body.ProviderHost, body.ProviderType, body.APIKey, cfg); err != nil {
+		log.Printf("[admin] Error setting provider for user %s: %v", user.Username, err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if body.Locked != nil {
+		if err := database.SetUserProviderLocked(user.ID, *body.Locked); err != nil {
+			log.Printf("[admin] Error locking provider for user %s: %v", user.Username, err)
+			return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+		}
+	}
+
+	log.Printf("[audit] Admin %s set provider for user %s (host=%s, type=%s, keyChanged=%t, locked=%s, req=%s)",
+		currentUser.Username, user.Username, body.ProviderHost, body.ProviderType, body.APIKey != "", lockedLabel(body.Locked), middleware.GetRequestID(c))
+
+	settings, err := providerSettingsResponse(user.ID)
+	if err != nil {
+		log.Printf("[admin] Error getting provider: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	return c.JSON(settings)
+}
+
+// AdminGetGenerationErrors 统计最近 hours 小时内 (默认 24，最多 720) 失败任务的错误码分布，
+// 便于发现服务商额度耗尽或密钥失效等全局问题
+func AdminGetGenerationErrors(c *fiber.Ctx) error {
+	hours := c.QueryInt("hours", 24)
+	if hours < 1 || hours > 720 {
+		return c.Status(400).JSON(fiber.Map{"error": "hours 参数需在 1-720 之间"})
+	}
+
+	since := models.Now() - int64(hours)*3600*1000
+	counts, err := database.CountFailedGenerationsByErrorCode(since)
+	if err != nil {
+		log.Printf("[admin] Error counting generation errors: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+
+	return c.JSON(fiber.Map{
+		"hours":  hours,
+		"since":  since,
+		"total":  total,
+		"counts": counts,
+	})
+}
+
+// AdminGetGeneration 管理员查看任意生成的详情，额外包含服务商任务 ID 等排障信息 (不含密钥)，
+// 便于与服务商后台对照；普通用户接口不返回这些字段
+func AdminGetGeneration(c *fiber.Ctx) error {
+	currentUser := middleware.GetCurrentUser(c)
+
+	gen, err := database.GetGenerationByID(c.Params("id"))
+	if err != nil {
+		log.Printf("[admin] Error getting generation: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if gen == nil {
+		return respondNotFound(c)
+	}
+
+	// 文件只对所有者开放，因此以所有者身份签发地址，管理员才能打开结果与参考图
+	log.Printf("[audit] Admin %s viewed generation %s of user %s (req=%s)",
+		currentUser.Username, gen.ID, gen.UserID, middleware.GetRequestID(c))
+
+	return c.JSON(fiber.Map{
+		"generation":        toGenerationResponse(gen, gen.UserID),
+		"userId":            gen.UserID,
+		"providerTaskId":    gen.ProviderTaskID,
+		"providerResultUrl": gen.ProviderResultURL,
+		"providerHost":      gen.ProviderHost,
+		"providerType":      gen.ProviderType,
+		"providerProfileId": gen.ProviderProfileID,
+		"requestId":         gen.RequestID,
+	})
+}
+
+// AdminRequeueFailedGenerations 将失败的生成批量重新排队（如服务商故障恢复后），
+// 按失败时间 (since/until，毫秒) 与错误码筛选，二者至少指定其一；
+// 未指定错误码时跳过密钥无效、额度不足等重试也无法成功的失败，返回重新排队的数量
+func AdminRequeueFailedGenerations(c *fiber.Ctx) error {
+	currentUser := middleware.GetCurrentUser(c)
+
+	var body struct {
+		Since     int64  `json:"since"`
+		Until     int64  `json:"until"`
+		ErrorCode string `json:"errorCode"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+		}
+	}
+	body.ErrorCode = strings.TrimSpace(body.ErrorCode)
+	if body.Since < 0 || body.Until < 0 || (body.Since > 0 && body.Until > 0 && body.Since > body.Until) {
+		return c.Status(400).JSON(fiber.Map{"error": "时间范围无效"})
+	}
+	// 不允许无条件地把所有用户的历史失败一次性重跑
+	if body.Since == 0 && body.ErrorCode == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "请指定起始时间或错误码"})
+	}
+
+	count, err := database.RequeueFailedGenerations(body.Since, body.Until, body.ErrorCode)
+	if err != nil {
+		log.Printf("[admin] Error requeueing failed generations: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[audit] Admin %s requeued %d failed generations (since=%d, until=%d, errorCode=%q, req=%s)",
+		currentUser.Username, count, body.Since, body.Until, body.ErrorCode, middleware.GetRequestID(c))
+
+	return c.JSON(fiber.Map{"requeued": count})
+}
+
+// AdminGetJobs 返回任务执行器的实时状态：进行中的生成、排队数量及最早排队任务的等待时长
+func AdminGetJobs(c *fiber.Ctx) error {
+	var ids []string
+	if ActiveJobs != nil {
+		ids = ActiveJobs()
+	}
+
+	now := models.Now()
+	active := make([]fiber.Map, 0, len(ids))
+	for _, id := range ids {
+		g, err := database.GetGenerationByID(id)
+		if err != nil || g == nil {
+			continue
+		}
+		item := fiber.Map{
+			"id":        g.ID,
+			"userId":    g.UserID,
+			"type":      g.Type,
+			"model":     g.Model,
+			"status":    g.Status,
+			"progress":  g.Progress,
+			"startedAt": g.StartedAt,
+			"createdAt": g.CreatedAt,
+		}
+		if g.StartedAt != nil && *g.StartedAt > 0 {
+			item["elapsedSeconds"] = (now - *g.StartedAt) / 1000
+		}
+		active = append(active, item)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i]["createdAt"].(int64) < active[j]["createdAt"].(int64)
+	})
+
+	queued, oldest, err := database.QueuedGenerationStats()
+	if err != nil {
+		log.Printf("[admin] Error getting queue stats: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	var oldestAgeSeconds int64
+	if oldest > 0 {
+		oldestAgeSeconds = (now - oldest) / 1000
+	}
+
+	return c.JSON(fiber.Map{
+		"active":                 active,
+		"activeCount":            len(active),
+		"queued":                 queued,
+		"oldestQueuedAt":         oldest,
+		"oldestQueuedAgeSeconds": oldestAgeSeconds,
 	})
 }
 
@@ -418,10 +1260,11 @@ func AdminGetSettings(c *fiber.Ctx) error {
 
 func AdminUpdateSettings(c *fiber.Ctx) error {
 	var body struct {
-		FileRetentionHours    *int `json:"fileRetentionHours"`
-		ReferenceHistoryLimit *int `json:"referenceHistoryLimit"`
-		ImageTimeoutSeconds   *int `json:"imageTimeoutSeconds"`
-		VideoTimeoutSeconds   *int `json:"videoTimeoutSeconds"`
+		FileRetentionHours    *int      `json:"fileRetentionHours"`
+		ReferenceHistoryLimit *int      `json:"referenceHistoryLimit"`
+		ImageTimeoutSeconds   *int      `json:"imageTimeoutSeconds"`
+		VideoTimeoutSeconds   *int      `json:"videoTimeoutSeconds"`
+		DisabledModels        *[]string `json:"disabledModels"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
@@ -467,18 +1310,35 @@ func AdminUpdateSettings(c *fiber.Ctx) error {
 		videoTimeoutSeconds = *body.VideoTimeoutSeconds
 	}
 
+	disabledModels := currentSettings.DisabledModels
+	if body.DisabledModels != nil {
+		disabledModels = make([]string, 0, len(*body.DisabledModels))
+		seen := make(map[string]bool)
+		for _, id := range *body.DisabledModels {
+			id = strings.TrimSpace(id)
+			if GetModelByID(id) == nil {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("不支持的模型: %s", id)})
+			}
+			if !seen[id] {
+				seen[id] = true
+				disabledModels = append(disabledModels, id)
+			}
+		}
+	}
+
 	// 更新设置
-	if err := database.UpdateSettings(fileRetentionHours, referenceHistoryLimit, imageTimeoutSeconds, videoTimeoutSeconds); err != nil {
+	if err := database.UpdateSettings(fileRetentionHours, referenceHistoryLimit, imageTimeoutSeconds, videoTimeoutSeconds, disabledModels); err != nil {
 		log.Printf("[admin] Error updating settings: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
 	log.Printf(
-		"[admin] Updated settings: fileRetentionHours=%d, referenceHistoryLimit=%d, imageTimeoutSeconds=%d, videoTimeoutSeconds=%d",
+		"[admin] Updated settings: fileRetentionHours=%d, referenceHistoryLimit=%d, imageTimeoutSeconds=%d, videoTimeoutSeconds=%d, disabledModels=%v",
 		fileRetentionHours,
 		referenceHistoryLimit,
 		imageTimeoutSeconds,
 		videoTimeoutSeconds,
+		disabledModels,
 	)
 
 	return c.JSON(fiber.Map{
@@ -486,6 +1346,7 @@ func AdminUpdateSettings(c *fiber.Ctx) error {
 		"referenceHistoryLimit": referenceHistoryLimit,
 		"imageTimeoutSeconds":   imageTimeoutSeconds,
 		"videoTimeoutSeconds":   videoTimeoutSeconds,
+		"disabledModels":        disabledModels,
 	})
 }
 
@@ -493,7 +1354,7 @@ func AdminUpdateSettings(c *fiber.Ctx) error {
 
 func ListGenerations(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 
 	genType := c.Query("type")
 	limit := c.QueryInt("limit", 50)
@@ -510,7 +1371,20 @@ func ListGenerations(c *fiber.Ctx) error {
 		offset = 0
 	}
 
-	generations, total, err := database.ListGenerations(user.ID, genType, favoritesOnly, limit, offset)
+	// createdAfter/createdBefore 为毫秒时间戳 (含边界)，用于按时间段审计或预览清理
+	createdAfter, err := strconv.ParseInt(c.Query("createdAfter", "0"), 10, 64)
+	if err != nil || createdAfter < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "createdAfter 参数无效"})
+	}
+	createdBefore, err := strconv.ParseInt(c.Query("createdBefore", "0"), 10, 64)
+	if err != nil || createdBefore < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "createdBefore 参数无效"})
+	}
+	if createdAfter > 0 && createdBefore > 0 && createdAfter > createdBefore {
+		return c.Status(400).JSON(fiber.Map{"error": "createdAfter 不能晚于 createdBefore"})
+	}
+
+	generations, total, err := database.ListGenerations(user.ID, genType, favoritesOnly, createdAfter, createdBefore, limit, offset)
 	if err != nil {
 		log.Printf("[generation] Error listing generations: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
@@ -518,7 +1392,7 @@ func ListGenerations(c *fiber.Ctx) error {
 
 	items := make([]models.GenerationResponse, len(generations))
 	for i, g := range generations {
-		items[i] = toGenerationResponse(&g, token)
+		items[i] = toGenerationResponse(&g, viewerID)
 	}
 
 	return c.JSON(fiber.Map{
@@ -530,85 +1404,158 @@ func ListGenerations(c *fiber.Ctx) error {
 func GetGeneration(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	id := c.Params("id")
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 
-	gen, err := database.GetGenerationByID(id)
+	gen, err := database.GetUserGenerationByID(user.ID, id)
 	if err != nil {
 		log.Printf("[generation] Error getting generation: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
-	if gen == nil || gen.UserID != user.ID {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+	if gen == nil {
+		return respondNotFound(c)
 	}
 
-	return c.JSON(toGenerationResponse(gen, token))
+	return c.JSON(toGenerationResponse(gen, viewerID))
 }
 
-func ToggleFavorite(c *fiber.Ctx) error {
+const (
+	waitGenerationDefaultSeconds = 30
+	waitGenerationMaxSeconds     = 60
+	waitGenerationPollInterval   = time.Second
+)
+
+// WaitGeneration 长轮询：阻塞直到生成进入终态 (或不会再自行变化的草稿) 或超时，然后返回当前状态。
+// timeout 单位为秒，默认 30，上限 60
+func WaitGeneration(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	id := c.Params("id")
-	token := middleware.GetToken(c)
+	viewerID := user.ID
+
+	timeout := c.QueryInt("timeout", waitGenerationDefaultSeconds)
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > waitGenerationMaxSeconds {
+		timeout = waitGenerationMaxSeconds
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	for {
+		gen, err := database.GetUserGenerationByID(user.ID, id)
+		if err != nil {
+			log.Printf("[generation] Error getting generation: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+		}
+		if gen == nil {
+			return respondNotFound(c)
+		}
+
+		if (gen.Status != "queued" && gen.Status != "running") || !time.Now().Before(deadline) {
+			return c.JSON(toGenerationResponse(gen, viewerID))
+		}
+
+		wait := min(waitGenerationPollInterval, time.Until(deadline))
+		select {
+		case <-time.After(wait):
+		case <-c.Context().Done():
+			// 服务器关闭
+			return c.JSON(toGenerationResponse(gen, viewerID))
+		}
+	}
+}
+
+// ListGenerationReferences 批量返回生成所用参考图（带访问地址），按 referenceFileIds 顺序；已清理或不属于当前用户的文件跳过
+func ListGenerationReferences(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	viewerID := user.ID
 
-	gen, err := database.GetGenerationByID(id)
+	gen, err := database.GetUserGenerationByID(user.ID, c.Params("id"))
 	if err != nil {
 		log.Printf("[generation] Error getting generation: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
-	if gen == nil || gen.UserID != user.ID {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+	if gen == nil {
+		return respondNotFound(c)
+	}
+
+	files, err := database.GetFilesByIDs(gen.ReferenceFileIDs)
+	if err != nil {
+		log.Printf("[generation] Error getting reference files: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
-	newFavorite := !gen.Favorite
-	if err := database.UpdateGeneration(id, map[string]interface{}{
-		"favorite": boolToInt(newFavorite),
-	}); err != nil {
+	result := make([]*models.StoredFile, 0, len(gen.ReferenceFileIDs))
+	for _, fid := range gen.ReferenceFileIDs {
+		file := files[fid]
+		if file == nil || file.UserID != user.ID {
+			continue
+		}
+		result = append(result, toStoredFile(file, viewerID))
+	}
+
+	return c.JSON(result)
+}
+
+func ToggleFavorite(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	id := c.Params("id")
+	viewerID := user.ID
+
+	newFavorite, err := database.ToggleFavorite(user.ID, id)
+	if err == sql.ErrNoRows {
+		return respondNotFound(c)
+	}
+	if err != nil {
 		log.Printf("[generation] Error updating favorite: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
 	// 重新获取更新后的完整 Generation 对象
-	updatedGen, err := database.GetGenerationByID(id)
+	updatedGen, err := database.GetUserGenerationByID(user.ID, id)
 	if err != nil {
 		log.Printf("[generation] Error getting updated generation: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 	if updatedGen == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+		return respondNotFound(c)
 	}
 
 	log.Printf("[generation] Toggled favorite for generation %s to %v", id, newFavorite)
 
 	// 返回完整的 Generation 响应对象
-	return c.JSON(toGenerationResponse(updatedGen, token))
+	return c.JSON(toGenerationResponse(updatedGen, viewerID))
 }
 
 func DeleteGeneration(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	id := c.Params("id")
 
-	gen, err := database.GetGenerationByID(id)
+	gen, err := database.GetUserGenerationByID(user.ID, id)
 	if err != nil {
 		log.Printf("[generation] Error getting generation: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
-	if gen == nil || gen.UserID != user.ID {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+	if gen == nil {
+		return respondNotFound(c)
 	}
 
-	outputFileID := gen.OutputFileID
+	outputFileIDs := gen.OutputFileIDs
+	if gen.OutputFileID != nil && len(outputFileIDs) == 0 {
+		outputFileIDs = []string{*gen.OutputFileID}
+	}
 
 	if err := database.DeleteGeneration(id); err != nil {
 		log.Printf("[generation] Error deleting generation: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
-	// Delete output file if not used elsewhere
-	if outputFileID != nil {
+	// Delete output files if not used elsewhere
+	for _, outputFileID := range outputFileIDs {
 		// For simplicity, we just delete the file
-		file, _ := database.GetFileByID(*outputFileID)
+		file, _ := database.GetFileByID(outputFileID)
 		if file != nil {
 			fileutil.RemoveWithThumb(file.Path)
-			database.DeleteFile(*outputFileID)
+			database.DeleteFile(outputFileID)
 		}
 	}
 
@@ -617,9 +1564,16 @@ func DeleteGeneration(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"ok": true})
 }
 
+// referenceListItem is one entry of the ordered referenceList in a generate request
+type referenceListItem struct {
+	Type  string `json:"type"`  // "fileId"、"base64" 或 "libraryItem"
+	Value string `json:"value"` // fileId、base64 数据或素材库条目 ID
+}
+
 func GenerateImage(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
+	requestID := middleware.GetRequestID(c)
 
 	// 解析JSON请求体
 	var body struct {
@@ -628,14 +1582,20 @@ func GenerateImage(c *fiber.Ctx) error {
 		ImageSize   string `json:"imageSize"`
 		AspectRatio string `json:"aspectRatio"`
 		Batch       int    `json:"batch"`
+		// 可选输出格式提示：png / jpeg / webp / avif
+		OutputFormat string `json:"outputFormat"`
 		// 新的有序参考图列表格式
-		ReferenceList []struct {
-			Type  string `json:"type"`  // "fileId" 或 "base64"
-			Value string `json:"value"` // fileId 或 base64 数据
-		} `json:"referenceList"`
+		ReferenceList []referenceListItem `json:"referenceList"`
 		// 兼容旧格式
 		ReferenceFileIDs    []string `json:"referenceFileIds"`
 		ReferenceBase64List []string `json:"referenceBase64List"`
+		// 素材库条目作为参考图，按顺序追加在其他参考图之后
+		LibraryItemIDs []string `json:"libraryItemIds"`
+		// 为 true 时，若短时间内已有相同参数的排队任务则直接返回它们，防止重复提交
+		Dedupe bool `json:"dedupe"`
+		// 为 true 时只保存为草稿，不进入任务队列，之后通过 /submit 提交
+		Draft bool `json:"draft"`
+		providerOverride
 	}
 
 	if err := c.BodyParser(&body); err != nil {
@@ -648,80 +1608,190 @@ func GenerateImage(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "提示词不能为空"})
 	}
 
-	model := GetModelByID(body.Model)
+	model := GetModelByID(resolveModelID(user.ID, body.Model, "image"))
 	if model == nil || model.Type != "image" {
 		return c.Status(400).JSON(fiber.Map{"error": "不支持的模型"})
 	}
+	if model.Disabled {
+		return c.Status(503).JSON(fiber.Map{"error": "该模型暂时不可用，请稍后再试或更换模型"})
+	}
+
+	if _, err := checkStorageQuota(user.ID); errors.Is(err, ErrStorageQuotaExceeded) {
+		return c.Status(429).JSON(fiber.Map{"error": "存储空间已用完，请清理后再试"})
+	} else if err != nil {
+		log.Printf("[generation] Error checking storage quota: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
 
 	batchN := body.Batch
 	if batchN < 1 {
 		batchN = 1
 	}
-	if batchN > cfg.ImageBatchMax {
-		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("生成数量必须在 1 到 %d 之间", cfg.ImageBatchMax)})
+	if batchN > model.MaxBatch {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("生成数量必须在 1 到 %d 之间", model.MaxBatch)})
 	}
 
 	imageSize := body.ImageSize
+	if imageSize == "" && model.SupportsSize(cfg.DefaultImageSize) {
+		imageSize = cfg.DefaultImageSize
+	}
+	if imageSize != "" && !model.SupportsSize(imageSize) {
+		return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选分辨率"})
+	}
+
 	aspectRatio := body.AspectRatio
 	if aspectRatio == "" {
 		aspectRatio = "auto"
+		if model.SupportsAspect(cfg.DefaultImageAspect) {
+			aspectRatio = cfg.DefaultImageAspect
+		}
+	}
+	if !model.SupportsAspect(aspectRatio) {
+		return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选画面比例"})
 	}
 
-	var refFileIDs []string
+	outputFormat := strings.ToLower(strings.TrimSpace(body.OutputFormat))
+	if outputFormat == "jpg" {
+		outputFormat = "jpeg"
+	}
+	if _, ok := fileutil.FormatMimeTypes[outputFormat]; outputFormat != "" && !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "不支持的输出格式"})
+	}
+
+	providerKeyEnc, status, msg := prepareProviderOverride(user, &body.providerOverride)
+	if status != 0 {
+		return c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+	// 草稿不会立即执行，提交时再检查
+	if !body.Draft {
+		if msg := checkProviderConfigured(user.ID, body.ProviderProfileID != "" || body.APIKey != ""); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+	}
+
+	dedupeKey := generationDedupeKey(user.ID, prompt, model.ID, imageSize, aspectRatio, outputFormat, batchN,
+		dedupeReferenceList(body.ReferenceList), body.ReferenceFileIDs, dedupeBase64Digests(body.ReferenceBase64List), body.LibraryItemIDs,
+		body.ProviderHost, body.ProviderType, crypto.KeyFingerprint(body.APIKey, cfg.APIKeyEncryptionSecret), body.ProviderProfileID)
+
+	// 先按请求中的数量校验，避免超限时已把 base64 参考图落盘
+	refCount := len(body.LibraryItemIDs)
+	if len(body.ReferenceList) > 0 {
+		refCount += len(body.ReferenceList)
+	} else {
+		refCount += len(body.ReferenceFileIDs) + len(body.ReferenceBase64List)
+	}
+	if refCount > model.MaxReferences {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("该模型最多支持 %d 张参考图", model.MaxReferences)})
+	}
+
+	// 先校验全部参考图 (权限、类型、素材库)，通过后再把 base64 落盘，避免校验失败时留下孤立文件；
+	// base64 参考图先占位，保存后填入 fileId
+	refFileIDs := make([]string, 0, refCount)
+	type pendingBase64 struct {
+		slot  int // refFileIDs 中的位置
+		index int // 请求中的参考图序号，用于错误提示
+		data  string
+	}
+	var pending []pendingBase64
 
 	// 优先使用新的有序参考图列表格式
 	if len(body.ReferenceList) > 0 {
-		for _, ref := range body.ReferenceList {
-			if ref.Type == "fileId" && ref.Value != "" {
-				// 验证文件权限
-				file, err := database.GetFileByID(ref.Value)
-				if err != nil || file == nil || file.UserID != user.ID {
-					return c.Status(400).JSON(fiber.Map{"error": "无权限访问参考文件"})
+		for i, ref := range body.ReferenceList {
+			if ref.Value == "" {
+				continue
+			}
+			if ref.Type == "fileId" {
+				// 验证文件权限与类型
+				if msg := checkReferenceFile(user.ID, ref.Value); msg != "" {
+					return c.Status(400).JSON(fiber.Map{"error": msg})
 				}
 				refFileIDs = append(refFileIDs, ref.Value)
-			} else if ref.Type == "base64" && ref.Value != "" {
-				// 保存 base64 图片并获取 fileId
-				savedFile, err := saveBase64ToFile(user.ID, "reference-upload", ref.Value, false)
-				if err != nil {
-					log.Printf("[generation] Error saving base64 reference: %v", err)
-					continue
+			} else if ref.Type == "base64" {
+				pending = append(pending, pendingBase64{slot: len(refFileIDs), index: i, data: ref.Value})
+				refFileIDs = append(refFileIDs, "")
+			} else if ref.Type == "libraryItem" {
+				fileIDs, ok := resolveLibraryReferences(user.ID, []string{ref.Value})
+				if !ok {
+					return c.Status(400).JSON(fiber.Map{"error": "无权限访问素材库条目"})
 				}
-				refFileIDs = append(refFileIDs, savedFile.ID)
+				refFileIDs = append(refFileIDs, fileIDs...)
+			} else {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("不支持的参考图类型: %s", ref.Type)})
 			}
 		}
 	} else {
 		// 兼容旧格式：先添加 fileIds，再添加 base64（顺序不保证）
-		refFileIDs = body.ReferenceFileIDs
-		if refFileIDs == nil {
-			refFileIDs = []string{}
-		}
-
 		// Validate existing refs belong to user
-		for _, fid := range refFileIDs {
-			file, err := database.GetFileByID(fid)
-			if err != nil || file == nil || file.UserID != user.ID {
-				return c.Status(400).JSON(fiber.Map{"error": "无权限访问参考文件"})
+		for _, fid := range body.ReferenceFileIDs {
+			if msg := checkReferenceFile(user.ID, fid); msg != "" {
+				return c.Status(400).JSON(fiber.Map{"error": msg})
 			}
+			refFileIDs = append(refFileIDs, fid)
 		}
 
-		// 处理base64上传的参考图
-		for _, base64Data := range body.ReferenceBase64List {
+		for i, base64Data := range body.ReferenceBase64List {
 			if base64Data == "" {
 				continue
 			}
+			pending = append(pending, pendingBase64{slot: len(refFileIDs), index: len(body.ReferenceFileIDs) + i, data: base64Data})
+			refFileIDs = append(refFileIDs, "")
+		}
+	}
 
-			savedFile, err := saveBase64ToFile(user.ID, "reference-upload", base64Data, false)
-			if err != nil {
-				log.Printf("[generation] Error saving base64 reference: %v", err)
-				continue
-			}
-			refFileIDs = append(refFileIDs, savedFile.ID)
+	libraryFileIDs, ok := resolveLibraryReferences(user.ID, body.LibraryItemIDs)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "无权限访问素材库条目"})
+	}
+	refFileIDs = append(refFileIDs, libraryFileIDs...)
+
+	// 本次请求由 base64 落盘的参考图；没有创建任何任务 (出错或合并到已有任务) 时统一删除
+	var savedRefIDs []string
+	keepSavedRefs := false
+	defer func() {
+		if keepSavedRefs {
+			return
+		}
+		for _, fid := range savedRefIDs {
+			removeReferenceFile(fid)
+		}
+	}()
+
+	for _, p := range pending {
+		savedFile, err := saveBase64ToFile(user.ID, "reference-upload", p.data, false)
+		if err != nil {
+			return respondReferenceSaveError(c, p.index, err)
 		}
+		refFileIDs[p.slot] = savedFile.ID
+		savedRefIDs = append(savedRefIDs, savedFile.ID)
 	}
 
-	// Cap to 14 references
-	if len(refFileIDs) > 14 {
-		refFileIDs = refFileIDs[:14]
+	genStatus := "queued"
+	if body.Draft {
+		genStatus = "draft"
+	}
+
+	unlockDedupe := func() {}
+	if body.Dedupe && !body.Draft {
+		// 检查与创建需串行，否则并发的重复提交都会看不到对方；只有相同请求之间互相等待
+		unlockDedupe = lockDedupeKey(dedupeKey)
+
+		since := models.Now() - int64(cfg.GenerationDedupeSecs)*1000
+		existing, err := database.ListQueuedDuplicates(user.ID, dedupeKey, since)
+		if err != nil || len(existing) > 0 {
+			unlockDedupe()
+		}
+		if err != nil {
+			log.Printf("[generation] Error checking duplicates (req %s): %v", requestID, err)
+			return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+		}
+		if len(existing) > 0 {
+			created := make([]models.GenerationResponse, len(existing))
+			for i := range existing {
+				created[i] = toGenerationResponse(&existing[i], viewerID)
+			}
+			log.Printf("[generation] Collapsed duplicate image request into %d queued tasks for user %s (req %s)", len(existing), user.Username, requestID)
+			return c.JSON(fiber.Map{"created": created, "deduplicated": true})
+		}
 	}
 
 	createdAt := models.Now()
@@ -734,7 +1804,7 @@ func GenerateImage(c *fiber.Ctx) error {
 			Type:             "image",
 			Prompt:           prompt,
 			Model:            model.ID,
-			Status:           "queued",
+			Status:           genStatus,
 			ReferenceFileIDs: refFileIDs,
 			CreatedAt:        createdAt,
 			UpdatedAt:        createdAt,
@@ -743,27 +1813,423 @@ func GenerateImage(c *fiber.Ctx) error {
 		if imageSize != "" {
 			gen.ImageSize = &imageSize
 		}
+		if outputFormat != "" {
+			gen.OutputFormat = &outputFormat
+		}
+		if requestID != "" {
+			gen.RequestID = &requestID
+		}
+		body.providerOverride.applyTo(gen, providerKeyEnc)
+		gen.DedupeKey = &dedupeKey
 		gen.AspectRatio = &aspectRatio
 
 		progress := float64(0)
 		gen.Progress = &progress
 
 		if err := database.CreateGeneration(gen); err != nil {
-			log.Printf("[generation] Error creating generation: %v", err)
+			log.Printf("[generation] Error creating generation (req %s): %v", requestID, err)
 			continue
 		}
 
-		created = append(created, toGenerationResponse(gen, token))
+		created = append(created, toGenerationResponse(gen, viewerID))
 	}
+	unlockDedupe()
+	keepSavedRefs = len(created) > 0
 
-	log.Printf("[generation] Created %d image generation tasks for user %s", len(created), user.Username)
+	log.Printf("[generation] Created %d image generation %s for user %s (req %s)", len(created), taskLabel(body.Draft, len(created)), user.Username, requestID)
 
 	return c.JSON(fiber.Map{"created": created})
 }
 
+// taskLabel names created generations in logs: "task(s)" or "draft(s)"
+func taskLabel(draft bool, n int) string {
+	label := "task"
+	if draft {
+		label = "draft"
+	}
+	if n != 1 {
+		label += "s"
+	}
+	return label
+}
+
+// CancelAllGenerations 取消当前用户所有排队中的生成；includeRunning 为 true 时同时中断执行中的任务
+func CancelAllGenerations(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	var body struct {
+		IncludeRunning bool `json:"includeRunning"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+		}
+	}
+
+	ids, err := database.CancelUserGenerations(user.ID, body.IncludeRunning)
+	if err != nil {
+		log.Printf("[generation] Error canceling generations for user %s: %v", user.Username, err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	interrupted := 0
+	if CancelJob != nil {
+		for _, id := range ids {
+			if CancelJob(id) {
+				interrupted++
+			}
+		}
+	}
+
+	log.Printf("[generation] Canceled %d generations for user %s (%d interrupted)", len(ids), user.Username, interrupted)
+
+	return c.JSON(fiber.Map{"canceled": len(ids), "ids": ids})
+}
+
+// SubmitGeneration 将草稿提交到任务队列
+func SubmitGeneration(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	viewerID := user.ID
+	id := c.Params("id")
+
+	gen, err := database.GetUserGenerationByID(user.ID, id)
+	if err != nil {
+		log.Printf("[generation] Error getting generation: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if gen == nil {
+		return respondNotFound(c)
+	}
+	if gen.Status != "draft" {
+		return c.Status(409).JSON(fiber.Map{"error": "只有草稿可以提交"})
+	}
+	if model := GetModelByID(gen.Model); model != nil && model.Disabled {
+		return c.Status(503).JSON(fiber.Map{"error": "该模型暂时不可用，请稍后再试或更换模型"})
+	}
+	hasOverride := (gen.ProviderProfileID != nil && *gen.ProviderProfileID != "") || (gen.ProviderKeyEnc != nil && *gen.ProviderKeyEnc != "")
+	if msg := checkProviderConfigured(user.ID, hasOverride); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	// 条件更新：并发提交时只有一次生效
+	err = database.SubmitDraftGeneration(user.ID, id)
+	if err == sql.ErrNoRows {
+		return c.Status(409).JSON(fiber.Map{"error": "只有草稿可以提交"})
+	}
+	if err != nil {
+		log.Printf("[generation] Error submitting draft %s: %v", id, err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	gen.Status = "queued"
+	gen.UpdatedAt = models.Now()
+
+	log.Printf("[generation] Submitted draft %s for user %s", id, user.Username)
+
+	return c.JSON(toGenerationResponse(gen, viewerID))
+}
+
+// EditGeneration 修改尚未开始执行（草稿或排队中）的生成参数，未提供的字段保持不变，
+// 合并后按创建时的规则重新校验
+func EditGeneration(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	viewerID := user.ID
+	id := c.Params("id")
+
+	var body struct {
+		Prompt           *string   `json:"prompt"`
+		Model            *string   `json:"model"`
+		ImageSize        *string   `json:"imageSize"`
+		AspectRatio      *string   `json:"aspectRatio"`
+		Duration         *int      `json:"duration"`
+		VideoSize        *string   `json:"videoSize"`
+		ReferenceFileIDs *[]string `json:"referenceFileIds"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+	}
+
+	gen, err := database.GetUserGenerationByID(user.ID, id)
+	if err != nil {
+		log.Printf("[generation] Error getting generation: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if gen == nil {
+		return respondNotFound(c)
+	}
+	if gen.Status != "draft" && gen.Status != "queued" {
+		return c.Status(409).JSON(fiber.Map{"error": "任务已开始执行，无法修改"})
+	}
+
+	if body.Prompt != nil {
+		gen.Prompt = strings.TrimSpace(*body.Prompt)
+	}
+	if gen.Prompt == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "提示词不能为空"})
+	}
+
+	if body.Model != nil {
+		gen.Model = *body.Model
+	}
+	model := GetModelByID(gen.Model)
+	if model == nil || model.Type != gen.Type {
+		return c.Status(400).JSON(fiber.Map{"error": "不支持的模型"})
+	}
+	if model.Disabled {
+		return c.Status(503).JSON(fiber.Map{"error": "该模型暂时不可用，请稍后再试或更换模型"})
+	}
+
+	if body.AspectRatio != nil {
+		gen.AspectRatio = body.AspectRatio
+	}
+	if gen.AspectRatio != nil && !model.SupportsAspect(*gen.AspectRatio) {
+		return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选画面比例"})
+	}
+
+	if body.ReferenceFileIDs != nil {
+		gen.ReferenceFileIDs = *body.ReferenceFileIDs
+		if gen.ReferenceFileIDs == nil {
+			gen.ReferenceFileIDs = []string{}
+		}
+		for _, fid := range gen.ReferenceFileIDs {
+			if msg := checkReferenceFile(user.ID, fid); msg != "" {
+				return c.Status(400).JSON(fiber.Map{"error": msg})
+			}
+		}
+	}
+	if len(gen.ReferenceFileIDs) > model.MaxReferences {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("该模型最多支持 %d 张参考图", model.MaxReferences)})
+	}
+
+	updates := map[string]interface{}{
+		"prompt":      gen.Prompt,
+		"model":       gen.Model,
+		"aspectRatio": gen.AspectRatio,
+	}
+
+	if gen.Type == "image" {
+		if body.ImageSize != nil {
+			gen.ImageSize = nil
+			if *body.ImageSize != "" {
+				gen.ImageSize = body.ImageSize
+			}
+		}
+		if gen.ImageSize != nil && !model.SupportsSize(*gen.ImageSize) {
+			return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选分辨率"})
+		}
+		updates["imageSize"] = gen.ImageSize
+	} else {
+		if body.Duration != nil {
+			duration := *body.Duration
+			if duration < minVideoDuration {
+				duration = minVideoDuration
+			}
+			if duration > maxVideoDuration {
+				duration = maxVideoDuration
+			}
+			gen.Duration = &duration
+		}
+		if body.VideoSize != nil {
+			gen.VideoSize = body.VideoSize
+		}
+		if gen.VideoSize != nil && !model.SupportsSize(*gen.VideoSize) {
+			return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选尺寸"})
+		}
+		updates["duration"] = gen.Duration
+		updates["videoSize"] = gen.VideoSize
+	}
+
+	refFileIDs, _ := json.Marshal(gen.ReferenceFileIDs)
+	updates["referenceFileIds"] = string(refFileIDs)
+	// 参数已变，不再与原请求视为重复
+	updates["dedupeKey"] = nil
+
+	// 条件更新：任务已被执行器取走时不再修改
+	err = database.UpdatePendingGeneration(user.ID, id, updates)
+	if err == sql.ErrNoRows {
+		return c.Status(409).JSON(fiber.Map{"error": "任务已开始执行，无法修改"})
+	}
+	if err != nil {
+		log.Printf("[generation] Error editing generation %s: %v", id, err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	updated, err := database.GetUserGenerationByID(user.ID, id)
+	if err != nil || updated == nil {
+		log.Printf("[generation] Error reloading generation %s: %v", id, err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[generation] Edited %s generation %s for user %s", updated.Status, id, user.Username)
+
+	return c.JSON(toGenerationResponse(updated, viewerID))
+}
+
+// dedupeLocks serializes opt-in duplicate checks with the inserts that follow them, per dedupe key,
+// so only identical requests wait on each other
+var (
+	dedupeLocksMu sync.Mutex
+	dedupeLocks   = make(map[string]*dedupeLock)
+)
+
+type dedupeLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockDedupeKey blocks until no other request holds key and returns the matching unlock
+func lockDedupeKey(key string) func() {
+	dedupeLocksMu.Lock()
+	l := dedupeLocks[key]
+	if l == nil {
+		l = &dedupeLock{}
+		dedupeLocks[key] = l
+	}
+	l.refs++
+	dedupeLocksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		dedupeLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(dedupeLocks, key)
+		}
+		dedupeLocksMu.Unlock()
+	}
+}
+
+// generationDedupeKey fingerprints everything that determines a request's output, so two
+// submissions with the same key are the same request sent twice
+func generationDedupeKey(userID string, params ...interface{}) string {
+	hasher := sha256.New()
+	_ = json.NewEncoder(hasher).Encode(append([]interface{}{userID}, params...))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// dedupeBase64Digests stands in for inline reference payloads in the dedupe key with their digests
+func dedupeBase64Digests(payloads []string) []string {
+	digests := make([]string, len(payloads))
+	for i, p := range payloads {
+		sum := sha256.Sum256([]byte(p))
+		digests[i] = hex.EncodeToString(sum[:])
+	}
+	return digests
+}
+
+// dedupeReferenceList is the ordered reference list as "type:value", with base64 values digested
+func dedupeReferenceList(refs []referenceListItem) []string {
+	entries := make([]string, len(refs))
+	for i, ref := range refs {
+		value := ref.Value
+		if ref.Type == "base64" {
+			value = dedupeBase64Digests([]string{value})[0]
+		}
+		entries[i] = ref.Type + ":" + value
+	}
+	return entries
+}
+
+// providerOverride 单次生成使用的服务商，不修改用户保存的设置：
+// 可直接给出服务地址与密钥，也可选择一个已保存的服务商配置
+type providerOverride struct {
+	ProviderHost      string              `json:"providerHost"`
+	ProviderType      string              `json:"providerType"`
+	APIKey            crypto.SecretString `json:"apiKey"`
+	ProviderProfileID string              `json:"providerProfileId"`
+}
+
+// prepareProviderOverride validates the override and returns its encrypted key ("" for none or a profile).
+// A key is required whenever a host or type is given so the server's default key is never sent to a
+// user-supplied host. A non-zero status means the request must be rejected with msg.
+func prepareProviderOverride(user *models.SanitizedUser, o *providerOverride) (keyEnc string, status int, msg string) {
+	o.ProviderHost = strings.TrimSpace(o.ProviderHost)
+	o.ProviderType = strings.ToLower(strings.TrimSpace(o.ProviderType))
+	o.ProviderProfileID = strings.TrimSpace(o.ProviderProfileID)
+	if o.APIKey == "" && o.ProviderHost == "" && o.ProviderType == "" && o.ProviderProfileID == "" {
+		return "", 0, ""
+	}
+
+	locked, err := isProviderLocked(user)
+	if err != nil {
+		log.Printf("[provider] Error getting provider: %v", err)
+		return "", 500, "服务器错误"
+	}
+	if locked {
+		return "", 403, "服务商设置已被管理员锁定"
+	}
+
+	if o.ProviderProfileID != "" {
+		if o.APIKey != "" || o.ProviderHost != "" || o.ProviderType != "" {
+			return "", 400, "不能同时指定服务商配置和接口密钥"
+		}
+		profile, err := database.GetProviderProfile(user.ID, o.ProviderProfileID)
+		if err != nil {
+			log.Printf("[provider] Error getting provider profile: %v", err)
+			return "", 500, "服务器错误"
+		}
+		if profile == nil {
+			return "", 400, "服务商配置不存在"
+		}
+		return "", 0, ""
+	}
+
+	if o.APIKey == "" {
+		return "", 400, "指定服务商时必须同时提供接口密钥"
+	}
+	if !models.IsValidProviderType(o.ProviderType) {
+		return "", 400, "不支持的服务类型"
+	}
+
+	keyEnc, err = crypto.EncryptText(o.APIKey.Reveal(), cfg.APIKeyEncryptionSecret)
+	if err != nil {
+		log.Printf("[generation] Error encrypting provider key: %v", err)
+		return "", 500, "服务器错误"
+	}
+	return keyEnc, 0, ""
+}
+
+// checkProviderConfigured rejects a request up front when no API key would be available at job time,
+// rather than queuing a generation that is bound to fail. Overrides carry their own key or profile.
+func checkProviderConfigured(userID string, hasOverride bool) string {
+	if hasOverride {
+		return ""
+	}
+	_, _, _, err := database.GetEffectiveProvider(userID, cfg)
+	if errors.Is(err, database.ErrNoProviderKey) {
+		return err.Error()
+	}
+	if err != nil {
+		// 其他错误 (如默认配置的密钥无法解密) 留给任务执行时报告
+		log.Printf("[generation] Error resolving provider for user %s: %v", userID, err)
+	}
+	return ""
+}
+
+// applyTo stores the override on the generation; the job uses it instead of the saved provider
+func (o *providerOverride) applyTo(g *models.Generation, keyEnc string) {
+	if o.ProviderProfileID != "" {
+		profileID := o.ProviderProfileID
+		g.ProviderProfileID = &profileID
+		return
+	}
+	if keyEnc == "" {
+		return
+	}
+	g.ProviderKeyEnc = &keyEnc
+	if o.ProviderHost != "" {
+		host := o.ProviderHost
+		g.ProviderHost = &host
+	}
+	if o.ProviderType != "" {
+		providerType := o.ProviderType
+		g.ProviderType = &providerType
+	}
+}
+
 func GenerateVideo(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
+	requestID := middleware.GetRequestID(c)
 
 	// 解析JSON请求体
 	var body struct {
@@ -775,6 +2241,12 @@ func GenerateVideo(c *fiber.Ctx) error {
 		RunID            string   `json:"runId"`
 		ReferenceFileIDs []string `json:"referenceFileIds"`
 		ReferenceBase64  string   `json:"referenceBase64"`
+		LibraryItemIDs   []string `json:"libraryItemIds"`
+		// 续接同一流程中已成功的节点：以其结果 (视频取最后一帧) 作为首张参考图
+		ContinueFromGenerationID string `json:"continueFromGenerationId"`
+		// 为 true 时只保存为草稿，不进入任务队列
+		Draft bool `json:"draft"`
+		providerOverride
 	}
 
 	if err := c.BodyParser(&body); err != nil {
@@ -787,27 +2259,85 @@ func GenerateVideo(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "提示词不能为空"})
 	}
 
-	model := GetModelByID(body.Model)
+	model := GetModelByID(resolveModelID(user.ID, body.Model, "video"))
 	if model == nil || model.Type != "video" {
 		return c.Status(400).JSON(fiber.Map{"error": "不支持的模型"})
 	}
+	if model.Disabled {
+		return c.Status(503).JSON(fiber.Map{"error": "该模型暂时不可用，请稍后再试或更换模型"})
+	}
+
+	if _, err := checkStorageQuota(user.ID); errors.Is(err, ErrStorageQuotaExceeded) {
+		return c.Status(429).JSON(fiber.Map{"error": "存储空间已用完，请清理后再试"})
+	} else if err != nil {
+		log.Printf("[generation] Error checking storage quota: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
 
 	aspectRatio := body.AspectRatio
 	if aspectRatio == "" {
 		aspectRatio = "9:16"
+		if model.SupportsAspect(cfg.DefaultVideoAspect) {
+			aspectRatio = cfg.DefaultVideoAspect
+		}
+	}
+	if !model.SupportsAspect(aspectRatio) {
+		return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选画面比例"})
 	}
 
 	duration := body.Duration
-	if duration < 2 {
-		duration = 2
+	if duration < minVideoDuration {
+		duration = minVideoDuration
 	}
-	if duration > 30 {
-		duration = 30
+	if duration > maxVideoDuration {
+		duration = maxVideoDuration
 	}
 
 	videoSize := body.VideoSize
 	if videoSize == "" {
 		videoSize = "small"
+		if model.SupportsSize(cfg.DefaultVideoSize) {
+			videoSize = cfg.DefaultVideoSize
+		}
+	}
+	if !model.SupportsSize(videoSize) {
+		return c.Status(400).JSON(fiber.Map{"error": "该模型不支持所选尺寸"})
+	}
+
+	providerKeyEnc, status, msg := prepareProviderOverride(user, &body.providerOverride)
+	if status != 0 {
+		return c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+	// 草稿不会立即执行，提交时再检查
+	if !body.Draft {
+		if msg := checkProviderConfigured(user.ID, body.ProviderProfileID != "" || body.APIKey != ""); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+	}
+
+	var continueFrom *models.File
+	if id := strings.TrimSpace(body.ContinueFromGenerationID); id != "" {
+		runID, file, msg, err := resolveContinuationSource(user.ID, id, body.RunID)
+		if err != nil {
+			log.Printf("[generation] Error resolving continuation source: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+		}
+		if msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+		continueFrom = file
+		body.RunID = runID
+	}
+
+	refCount := len(body.ReferenceFileIDs) + len(body.LibraryItemIDs)
+	if body.ReferenceBase64 != "" {
+		refCount++
+	}
+	if continueFrom != nil {
+		refCount++
+	}
+	if refCount > model.MaxReferences {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("该模型最多支持 %d 张参考图", model.MaxReferences)})
 	}
 
 	var refFileIDs []string
@@ -817,26 +2347,65 @@ func GenerateVideo(c *fiber.Ctx) error {
 		if fid == "" {
 			continue
 		}
-		file, err := database.GetFileByID(fid)
-		if err != nil || file == nil || file.UserID != user.ID {
-			return c.Status(400).JSON(fiber.Map{"error": "无权限访问参考文件"})
+		if msg := checkReferenceFile(user.ID, fid); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+		refFileIDs = append(refFileIDs, fid)
+	}
+
+	// 处理素材库中的参考图
+	libraryFileIDs, ok := resolveLibraryReferences(user.ID, body.LibraryItemIDs)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "无权限访问素材库条目"})
+	}
+	refFileIDs = append(refFileIDs, libraryFileIDs...)
+
+	// 本次请求新保存的参考图 (续接截帧与 base64)；任务没有创建成功时统一删除
+	var savedRefIDs []string
+	keepSavedRefs := false
+	defer func() {
+		if keepSavedRefs {
+			return
+		}
+		for _, fid := range savedRefIDs {
+			removeReferenceFile(fid)
+		}
+	}()
+
+	// 续接的画面放在最前，其他参考图校验通过后、保存 base64 之前截帧，
+	// 这样缺少 ffmpeg 或截帧失败时不会留下已保存的上传
+	var frameID string
+	if continueFrom != nil {
+		frame, err := continuationFrame(user.ID, continueFrom)
+		if errors.Is(err, fileutil.ErrFrameExtractionUnavailable) {
+			return c.Status(400).JSON(fiber.Map{"error": "服务器未安装 ffmpeg，暂不支持从视频续接"})
+		}
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			return c.Status(429).JSON(fiber.Map{"error": "存储空间已用完，请清理后再试"})
+		}
+		if err != nil {
+			log.Printf("[generation] Error extracting continuation frame: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "截取续接画面失败"})
+		}
+		frameID = frame.ID
+		// 图片节点直接引用原输出，不能随失败清理
+		if frame.ID != continueFrom.ID {
+			savedRefIDs = append(savedRefIDs, frame.ID)
 		}
-		refFileIDs = append(refFileIDs, fid)
 	}
 
 	// 处理base64上传的参考图
 	if body.ReferenceBase64 != "" {
 		savedFile, err := saveBase64ToFile(user.ID, "reference-upload", body.ReferenceBase64, false)
 		if err != nil {
-			log.Printf("[generation] Error saving base64 reference: %v", err)
-			return c.Status(400).JSON(fiber.Map{"error": "参考图处理失败"})
+			return respondReferenceSaveError(c, len(refFileIDs), err)
 		}
 		refFileIDs = append(refFileIDs, savedFile.ID)
+		savedRefIDs = append(savedRefIDs, savedFile.ID)
 	}
 
-	// Only 1 reference for Sora2
-	if len(refFileIDs) > 1 {
-		refFileIDs = refFileIDs[:1]
+	if frameID != "" {
+		refFileIDs = append([]string{frameID}, refFileIDs...)
 	}
 
 	// Handle run ID
@@ -862,6 +2431,11 @@ func GenerateVideo(c *fiber.Ctx) error {
 	maxPos, _ := database.GetMaxNodePosition(user.ID, runID)
 	nextPos := maxPos + 1
 
+	genStatus := "queued"
+	if body.Draft {
+		genStatus = "draft"
+	}
+
 	createdAt := models.Now()
 	gen := &models.Generation{
 		ID:               uuid.New().String(),
@@ -869,7 +2443,7 @@ func GenerateVideo(c *fiber.Ctx) error {
 		Type:             "video",
 		Prompt:           prompt,
 		Model:            model.ID,
-		Status:           "queued",
+		Status:           genStatus,
 		ReferenceFileIDs: refFileIDs,
 		AspectRatio:      &aspectRatio,
 		Duration:         &duration,
@@ -882,20 +2456,71 @@ func GenerateVideo(c *fiber.Ctx) error {
 
 	progress := float64(0)
 	gen.Progress = &progress
+	if requestID != "" {
+		gen.RequestID = &requestID
+	}
+	body.providerOverride.applyTo(gen, providerKeyEnc)
 
 	if err := database.CreateGeneration(gen); err != nil {
-		log.Printf("[generation] Error creating generation: %v", err)
+		log.Printf("[generation] Error creating generation (req %s): %v", requestID, err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
+	keepSavedRefs = true
 
-	log.Printf("[generation] Created video generation task for user %s", user.Username)
+	log.Printf("[generation] Created video generation %s for user %s (req %s)", taskLabel(body.Draft, 1), user.Username, requestID)
 
 	return c.JSON(fiber.Map{
-		"created": toGenerationResponse(gen, token),
+		"created": toGenerationResponse(gen, viewerID),
 		"runId":   runID,
 	})
 }
 
+// resolveContinuationSource checks that a generation can be continued from: it must belong to the
+// user, be a succeeded node of a video run (the given run, when one is set) and still have its output.
+// It returns the run to add the new node to and the source's output file.
+func resolveContinuationSource(userID, generationID, runID string) (string, *models.File, string, error) {
+	source, err := database.GetUserGenerationByID(userID, generationID)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if source == nil || source.RunID == nil || *source.RunID == "" {
+		return "", nil, "续接的节点不存在", nil
+	}
+	if runID != "" && runID != *source.RunID {
+		return "", nil, "只能续接同一流程中的节点", nil
+	}
+	if source.Status != "succeeded" {
+		return "", nil, "只能续接已成功的节点", nil
+	}
+	if source.OutputFileID == nil {
+		return "", nil, "续接节点的结果已过期", nil
+	}
+
+	file, err := database.GetFileByID(*source.OutputFileID)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if file == nil {
+		return "", nil, "续接节点的结果已过期", nil
+	}
+	return *source.RunID, file, "", nil
+}
+
+// continuationFrame returns an image file to use as the continuation reference: the output itself
+// when it is an image, otherwise the last frame of the video saved as a new reference upload
+func continuationFrame(userID string, output *models.File) (*models.File, error) {
+	if strings.HasPrefix(output.MimeType, "image/") {
+		return output, nil
+	}
+	frame, err := fileutil.ExtractLastFrame(output.Path)
+	if err != nil {
+		return nil, err
+	}
+	// 帧来自已生成的视频，不受上传尺寸限制
+	file, _, err := saveReaderToFile(userID, "reference-upload", "image/png", "", bytes.NewReader(frame), 0, false)
+	return file, err
+}
+
 // ========== Video Run Handlers ==========
 
 func ListVideoRuns(c *fiber.Ctx) error {
@@ -906,6 +2531,9 @@ func ListVideoRuns(c *fiber.Ctx) error {
 		log.Printf("[video] Error listing runs: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
+	if runs == nil {
+		runs = []models.VideoRun{} // 保证返回 [] 而不是 null
+	}
 
 	return c.JSON(runs)
 }
@@ -936,6 +2564,51 @@ func CreateVideoRun(c *fiber.Ctx) error {
 	return c.JSON(run)
 }
 
+// DeleteVideoRun 删除流程；其中的生成任务保留在历史记录中，只解除与流程的关联
+func DeleteVideoRun(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	id := c.Params("id")
+
+	err := database.DeleteVideoRun(user.ID, id)
+	if err == sql.ErrNoRows {
+		return respondNotFound(c)
+	}
+	if err != nil {
+		log.Printf("[video] Error deleting run: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[video] Deleted video run %s for user %s", id, user.Username)
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+// ListVideoRunGenerations 按节点顺序返回流程中的全部视频生成任务
+func ListVideoRunGenerations(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	runID := c.Params("id")
+
+	run, err := database.GetVideoRun(user.ID, runID)
+	if err != nil {
+		log.Printf("[video] Error getting run: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if run == nil {
+		return respondNotFound(c)
+	}
+
+	generations, err := database.ListGenerationsByRun(user.ID, run.ID)
+	if err != nil {
+		log.Printf("[video] Error listing run generations: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	items := make([]models.GenerationResponse, len(generations))
+	for i := range generations {
+		items[i] = toGenerationResponse(&generations[i], user.ID)
+	}
+	return c.JSON(items)
+}
+
 // ========== Preset Handlers ==========
 
 func ListPresets(c *fiber.Ctx) error {
@@ -953,6 +2626,7 @@ func ListPresets(c *fiber.Ctx) error {
 			"id":        p.ID,
 			"name":      p.Name,
 			"prompt":    p.Prompt,
+			"variables": models.PromptVariables(p.Prompt),
 			"createdAt": p.CreatedAt,
 		}
 	}
@@ -989,6 +2663,7 @@ func CreatePreset(c *fiber.Ctx) error {
 
 	log.Printf("[preset] Created preset: %s for user %s", name, user.Username)
 
+	preset.Variables = models.PromptVariables(preset.Prompt)
 	return c.JSON(preset)
 }
 
@@ -1006,11 +2681,88 @@ func DeletePreset(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"ok": true})
 }
 
+// ReorderPresets 按给定的 ID 顺序排列预设，未列出的预设排在其后
+func ReorderPresets(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	var body struct {
+		PresetIDs []string `json:"presetIds"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+	}
+	if len(body.PresetIDs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "预设ID列表不能为空"})
+	}
+
+	seen := make(map[string]bool, len(body.PresetIDs))
+	for _, id := range body.PresetIDs {
+		if seen[id] {
+			return c.Status(400).JSON(fiber.Map{"error": "预设ID重复"})
+		}
+		seen[id] = true
+
+		preset, err := database.GetPreset(user.ID, id)
+		if err != nil {
+			log.Printf("[preset] Error getting preset: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+		}
+		if preset == nil {
+			return respondNotFound(c)
+		}
+	}
+
+	if err := database.UpdatePresetOrder(user.ID, body.PresetIDs); err != nil {
+		log.Printf("[preset] Error updating preset order: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "排序更新失败"})
+	}
+
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+// RenderPreset 用 vars 填充预设中的 {name} 占位符，返回可直接用于生成的提示词。
+// 所有占位符都必须提供非空值，否则返回 400 并列出缺失项。
+func RenderPreset(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	id := c.Params("id")
+
+	var body struct {
+		Vars map[string]string `json:"vars"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+		}
+	}
+
+	preset, err := database.GetPreset(user.ID, id)
+	if err != nil {
+		log.Printf("[preset] Error getting preset: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if preset == nil {
+		return respondNotFound(c)
+	}
+
+	prompt, missing := models.RenderPrompt(preset.Prompt, body.Vars)
+	if len(missing) > 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "缺少模板变量: " + strings.Join(missing, ", "),
+			"missing": missing,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"id":     preset.ID,
+		"prompt": prompt,
+	})
+}
+
 // ========== Library Handlers ==========
 
 func ListLibrary(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 	kind := c.Query("kind")
 
 	items, err := database.ListLibrary(user.ID, kind)
@@ -1030,7 +2782,7 @@ func ListLibrary(c *fiber.Ctx) error {
 
 		file, err := database.GetFileByID(item.FileID)
 		if err == nil && file != nil {
-			result[i].File = toStoredFile(file, token)
+			result[i].File = toStoredFile(file, viewerID)
 		}
 	}
 
@@ -1039,7 +2791,7 @@ func ListLibrary(c *fiber.Ctx) error {
 
 func CreateLibraryItem(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 
 	name := strings.TrimSpace(c.FormValue("name"))
 	kind := strings.TrimSpace(c.FormValue("kind"))
@@ -1068,6 +2820,12 @@ func CreateLibraryItem(c *fiber.Ctx) error {
 	}
 
 	savedFile, err := saveBufferToFile(user.ID, "library-item", fh.Header.Get("Content-Type"), fh.Filename, buf, true)
+	if errors.Is(err, ErrStorageQuotaExceeded) {
+		return c.Status(413).JSON(fiber.Map{"error": "存储空间不足"})
+	}
+	if msg, ok := imageDimensionsMessage(err); ok {
+		return c.Status(400).JSON(fiber.Map{"error": "图片" + msg})
+	}
 	if err != nil {
 		log.Printf("[library] Error saving file: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
@@ -1086,7 +2844,74 @@ func CreateLibraryItem(c *fiber.Ctx) error {
 		Kind:      item.Kind,
 		Name:      item.Name,
 		CreatedAt: item.CreatedAt,
-		File:      toStoredFile(savedFile, token),
+		File:      toStoredFile(savedFile, viewerID),
+	})
+}
+
+// CreateLibraryItemFromReference 将已上传的参考图直接保存到素材库，复用同一文件而不重新上传
+func CreateLibraryItemFromReference(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	viewerID := user.ID
+
+	var body struct {
+		ReferenceUploadID string `json:"referenceUploadId"`
+		Kind              string `json:"kind"`
+		Name              string `json:"name"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "请求格式错误"})
+	}
+
+	name := strings.TrimSpace(body.Name)
+	kind := strings.TrimSpace(body.Kind)
+	if name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "名称不能为空"})
+	}
+	if kind != "role" && kind != "scene" {
+		return c.Status(400).JSON(fiber.Map{"error": "类型不正确"})
+	}
+
+	upload, err := database.GetReferenceUpload(user.ID, body.ReferenceUploadID)
+	if err != nil {
+		log.Printf("[library] Error getting reference upload: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if upload == nil {
+		return respondNotFound(c)
+	}
+
+	file, err := database.GetFileByID(upload.FileID)
+	if err != nil {
+		log.Printf("[library] Error getting file: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if file == nil || file.UserID != user.ID {
+		return respondNotFound(c)
+	}
+
+	// Library files must survive retention cleanup and reference trimming
+	if !file.Persistent {
+		if err := database.SetFilePersistent(file.ID, true); err != nil {
+			log.Printf("[library] Error marking file persistent: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+		}
+		file.Persistent = true
+	}
+
+	item, err := database.CreateLibraryItem(user.ID, kind, name, file.ID)
+	if err != nil {
+		log.Printf("[library] Error creating library item: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[library] Created library item %s (%s) from reference %s for user %s", name, kind, upload.ID, user.Username)
+
+	return c.JSON(models.LibraryItemResponse{
+		ID:        item.ID,
+		Kind:      item.Kind,
+		Name:      item.Name,
+		CreatedAt: item.CreatedAt,
+		File:      toStoredFile(file, viewerID),
 	})
 }
 
@@ -1100,7 +2925,7 @@ func DeleteLibraryItem(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 	if item == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+		return respondNotFound(c)
 	}
 
 	if err := database.DeleteLibraryItem(user.ID, id); err != nil {
@@ -1113,11 +2938,54 @@ func DeleteLibraryItem(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"ok": true})
 }
 
+// respondReferenceSaveError rejects the request when a base64 reference can't be stored,
+// rather than generating with fewer references than the user sent. index is 0-based.
+func respondReferenceSaveError(c *fiber.Ctx, index int, err error) error {
+	if errors.Is(err, ErrStorageQuotaExceeded) {
+		return c.Status(429).JSON(fiber.Map{"error": "存储空间已用完，请清理后再试"})
+	}
+	if msg, ok := imageDimensionsMessage(err); ok {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("第 %d 张参考图%s", index+1, msg)})
+	}
+	log.Printf("[generation] Error saving base64 reference #%d: %v", index+1, err)
+	return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("第 %d 张参考图处理失败", index+1)})
+}
+
+// imageDimensionsMessage 将尺寸超限错误转换为包含实际尺寸的提示
+func imageDimensionsMessage(err error) (string, bool) {
+	var dimErr *fileutil.ImageDimensionsError
+	if !errors.As(err, &dimErr) {
+		return "", false
+	}
+	return fmt.Sprintf("尺寸 %dx%d 超出上限 %s", dimErr.Width, dimErr.Height, dimErr.Limit()), true
+}
+
+// resolveLibraryReferences maps library item IDs to their file IDs, preserving order.
+// It returns false if any item is missing or not owned by the user.
+func resolveLibraryReferences(userID string, itemIDs []string) ([]string, bool) {
+	fileIDs := make([]string, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		if id == "" {
+			continue
+		}
+		item, err := database.GetLibraryItem(userID, id)
+		if err != nil {
+			log.Printf("[generation] Error getting library item %s: %v", id, err)
+			return nil, false
+		}
+		if item == nil {
+			return nil, false
+		}
+		fileIDs = append(fileIDs, item.FileID)
+	}
+	return fileIDs, true
+}
+
 // ========== Reference Upload Handlers ==========
 
 func ListReferenceUploads(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 
 	limit := 0
 	if v := c.Query("limit"); v != "" {
@@ -1151,7 +3019,7 @@ func ListReferenceUploads(c *fiber.Ctx) error {
 			CreatedAt: item.CreatedAt,
 		}
 		if file, err := database.GetFileByID(item.FileID); err == nil && file != nil {
-			resp.File = toStoredFile(file, token)
+			resp.File = toStoredFile(file, viewerID)
 			resp.OriginalName = file.OriginalName
 		}
 		result = append(result, resp)
@@ -1162,7 +3030,7 @@ func ListReferenceUploads(c *fiber.Ctx) error {
 
 func CreateReferenceUploads(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -1185,7 +3053,8 @@ func CreateReferenceUploads(c *fiber.Ctx) error {
 		limit = settings.ReferenceHistoryLimit
 	}
 
-	var responses []models.ReferenceUploadResponse
+	responses := make([]models.ReferenceUploadResponse, 0, len(files))
+	saved := 0
 
 	for _, fh := range files {
 		file, err := fh.Open()
@@ -1201,6 +3070,21 @@ func CreateReferenceUploads(c *fiber.Ctx) error {
 		}
 
 		savedFile, err := saveBufferToFile(user.ID, "reference-upload", fh.Header.Get("Content-Type"), fh.Filename, buf, true)
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			// 配额用完后其余文件也无法保存；已保存的随错误一并返回
+			if err := trimReferenceUploads(user.ID, limit); err != nil {
+				log.Printf("[reference] Error trimming uploads: %v", err)
+			}
+			return c.Status(413).JSON(fiber.Map{"error": "存储空间不足", "uploaded": responses})
+		}
+		if msg, ok := imageDimensionsMessage(err); ok {
+			// 被拒的文件也占一项，前端据 error 字段提示用户
+			responses = append(responses, models.ReferenceUploadResponse{
+				OriginalName: fh.Filename,
+				Error:        fmt.Sprintf("%s %s", fh.Filename, msg),
+			})
+			continue
+		}
 		if err != nil {
 			log.Printf("[reference] Error saving upload %s: %v", fh.Filename, err)
 			continue
@@ -1215,10 +3099,16 @@ func CreateReferenceUploads(c *fiber.Ctx) error {
 		response := models.ReferenceUploadResponse{
 			ID:           upload.ID,
 			CreatedAt:    upload.CreatedAt,
-			File:         toStoredFile(savedFile, token),
+			File:         toStoredFile(savedFile, viewerID),
 			OriginalName: fh.Filename, // 包含原始文件名以便前端匹配
 		}
 		responses = append(responses, response)
+		saved++
+	}
+
+	// 全部因尺寸被拒时返回原因，否则前端只会拿到空列表
+	if saved == 0 && len(responses) > 0 {
+		return c.Status(400).JSON(fiber.Map{"error": responses[0].Error})
 	}
 
 	if err := trimReferenceUploads(user.ID, limit); err != nil {
@@ -1238,13 +3128,10 @@ func DeleteReferenceUpload(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 	if upload == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+		return respondNotFound(c)
 	}
 
-	if file, err := database.GetFileByID(upload.FileID); err == nil && file != nil {
-		fileutil.RemoveWithThumb(file.Path)
-		_ = database.DeleteFile(file.ID)
-	}
+	removeReferenceFile(upload.FileID)
 
 	if err := database.DeleteReferenceUpload(user.ID, id); err != nil {
 		log.Printf("[reference] Error deleting upload: %v", err)
@@ -1254,6 +3141,28 @@ func DeleteReferenceUpload(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"ok": true})
 }
 
+// ClearReferenceUploads 清空当前用户的全部参考图，需带 ?confirm=1 防止误操作
+func ClearReferenceUploads(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
+	if c.Query("confirm") != "1" {
+		return c.Status(400).JSON(fiber.Map{"error": "请确认清空全部参考图 (confirm=1)"})
+	}
+
+	deleted, err := database.DeleteAllReferenceUploads(user.ID)
+	if err != nil {
+		log.Printf("[reference] Error clearing uploads: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	for _, item := range deleted {
+		removeReferenceFile(item.FileID)
+	}
+
+	log.Printf("[reference] Cleared %d reference uploads for user %s", len(deleted), user.Username)
+	return c.JSON(fiber.Map{"ok": true, "deleted": len(deleted)})
+}
+
 func trimReferenceUploads(userID string, limit int) error {
 	if limit < 1 {
 		return nil
@@ -1264,10 +3173,7 @@ func trimReferenceUploads(userID string, limit int) error {
 	}
 
 	for _, item := range toDelete {
-		if file, err := database.GetFileByID(item.FileID); err == nil && file != nil {
-			fileutil.RemoveWithThumb(file.Path)
-			_ = database.DeleteFile(file.ID)
-		}
+		removeReferenceFile(item.FileID)
 		if err := database.DeleteReferenceUpload(userID, item.ID); err != nil {
 			log.Printf("[reference] Error deleting old upload %s: %v", item.ID, err)
 		}
@@ -1275,6 +3181,30 @@ func trimReferenceUploads(userID string, limit int) error {
 	return nil
 }
 
+// checkReferenceFile verifies that a referenced file belongs to the user and is an image,
+// so videos or other files are rejected before queuing instead of failing at the provider
+func checkReferenceFile(userID, fileID string) string {
+	file, err := database.GetFileByID(fileID)
+	if err != nil || file == nil || file.UserID != userID {
+		return "无权限访问参考文件"
+	}
+	if !strings.HasPrefix(file.MimeType, "image/") {
+		return fmt.Sprintf("参考文件 %s 不是图片", fileID)
+	}
+	return ""
+}
+
+// removeReferenceFile deletes a reference upload's file unless it was saved to the library
+func removeReferenceFile(fileID string) {
+	if inLibrary, err := database.IsFileInLibrary(fileID); err != nil || inLibrary {
+		return
+	}
+	if file, err := database.GetFileByID(fileID); err == nil && file != nil {
+		fileutil.RemoveWithThumb(file.Path)
+		_ = database.DeleteFile(file.ID)
+	}
+}
+
 // ========== File Handlers ==========
 
 func GetFile(c *fiber.Ctx) error {
@@ -1298,7 +3228,7 @@ func GetFile(c *fiber.Ctx) error {
 
 	// 逻辑修改：如果是拥有者 OR 是公开资源，则允许访问
 	if file == nil || (!isPublicAsset && file.UserID != user.ID) {
-		return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+		return respondNotFound(c)
 	}
 
 	if c.Query("download") == "1" {
@@ -1360,7 +3290,21 @@ func GetPublicFile(c *fiber.Ctx) error {
 
 // ========== Helper Functions ==========
 
-func toGenerationResponse(g *models.Generation, token string) models.GenerationResponse {
+// Cross-user access policy:
+//   - Private resources (generations, presets, library items, reference uploads, files) answer
+//     404 whether the row is missing or belongs to someone else, so IDs can't be probed.
+//   - Review projects/episodes/storyboards are shared and readable by every user, so their
+//     existence is no secret; a non-owner trying to change one gets 403.
+
+func respondNotFound(c *fiber.Ctx) error {
+	return c.Status(404).JSON(fiber.Map{"error": "未找到"})
+}
+
+func respondForbidden(c *fiber.Ctx, msg string) error {
+	return c.Status(403).JSON(fiber.Map{"error": msg})
+}
+
+func toGenerationResponse(g *models.Generation, viewerID string) models.GenerationResponse {
 	resp := models.GenerationResponse{
 		ID:               g.ID,
 		Type:             g.Type,
@@ -1376,6 +3320,7 @@ func toGenerationResponse(g *models.Generation, token string) models.GenerationR
 		AspectRatio:      g.AspectRatio,
 		Duration:         g.Duration,
 		VideoSize:        g.VideoSize,
+		OutputFormat:     g.OutputFormat,
 		ReferenceFileIDs: g.ReferenceFileIDs,
 		RunID:            g.RunID,
 		NodePosition:     g.NodePosition,
@@ -1386,14 +3331,36 @@ func toGenerationResponse(g *models.Generation, token string) models.GenerationR
 	if g.OutputFileID != nil {
 		file, err := database.GetFileByID(*g.OutputFileID)
 		if err == nil && file != nil {
-			resp.OutputFile = toStoredFile(file, token)
+			resp.OutputFile = toStoredFile(file, viewerID)
+		}
+	}
+
+	// 多图结果（如 Gemini 返回多个候选），第一张即 OutputFile
+	if len(g.OutputFileIDs) > 1 {
+		for _, fid := range g.OutputFileIDs {
+			file, err := database.GetFileByID(fid)
+			if err == nil && file != nil {
+				resp.OutputFiles = append(resp.OutputFiles, toStoredFile(file, viewerID))
+			}
 		}
 	}
 
+	// 运行中的任务只在结束时写入耗时，这里按 startedAt 实时计算 (不落库)；结束后以库中的值为准
+	if g.Status == "running" && g.StartedAt != nil && *g.StartedAt > 0 {
+		elapsed := (models.Now() - *g.StartedAt) / 1000
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		resp.ElapsedSeconds = &elapsed
+	}
+
+	// 过期清理会置空 outputFileId，此时与尚未产出结果无法区分，单独标记
+	resp.OutputExpired = g.Status == "succeeded" && resp.OutputFile == nil
+
 	return resp
 }
 
-func toStoredFile(f *models.File, token string) *models.StoredFile {
+func toStoredFile(f *models.File, viewerID string) *models.StoredFile {
 	if f == nil {
 		return nil
 	}
@@ -1402,17 +3369,19 @@ func toStoredFile(f *models.File, token string) *models.StoredFile {
 		MimeType:  f.MimeType,
 		CreatedAt: f.CreatedAt,
 		Filename:  f.OriginalName,
-		URL:       buildClientFileURL(f.ID, token, false),
+		URL:       buildClientFileURL(f.ID, viewerID, false),
 	}
 }
 
-func buildClientFileURL(fileID, token string, download bool) string {
+// buildClientFileURL 生成带文件级访问令牌的地址，避免在 URL 中暴露会话令牌
+func buildClientFileURL(fileID, viewerID string, download bool) string {
 	base := cfg.PublicBaseURL
 	path := fmt.Sprintf("/api/files/%s", fileID)
 
 	params := url.Values{}
-	if token != "" {
-		params.Set("token", token)
+	if viewerID != "" {
+		expiresAt := models.Now() + int64(cfg.FileTokenTTLHours)*3600*1000
+		params.Set("token", crypto.SignFileToken(fileID, viewerID, expiresAt, cfg.FileTokenSecret))
 	}
 	if download {
 		params.Set("download", "1")
@@ -1488,11 +3457,61 @@ func guessExt(mimeType string) string {
 }
 
 func saveBufferToFile(userID, purpose, mimeType, originalName string, buf []byte, persistent bool) (*models.File, error) {
+	// 上传图片的尺寸限制 (UPLOAD_MAX_WIDTH/UPLOAD_MAX_HEIGHT)，生成结果不受限制
+	if purpose != "generation-output" && strings.HasPrefix(mimeType, "image/") {
+		fitted, fittedMime, err := fileutil.FitImage(buf, mimeType, cfg.UploadMaxWidth, cfg.UploadMaxHeight, cfg.UploadDownscale)
+		if err != nil {
+			return nil, err
+		}
+		buf, mimeType = fitted, fittedMime
+	}
+
+	file, _, err := saveReaderToFile(userID, purpose, mimeType, originalName, bytes.NewReader(buf), 0, persistent)
+	return file, err
+}
+
+func SaveBufferToFile(userID, purpose, mimeType, originalName string, buf []byte, persistent bool) (*models.File, error) {
+	return saveBufferToFile(userID, purpose, mimeType, originalName, buf, persistent)
+}
+
+// ErrStorageQuotaExceeded 表示写入会超出用户的存储配额
+var ErrStorageQuotaExceeded = errors.New("存储空间不足")
+
+// storageQuotaBytes 返回每个用户的存储配额 (0 表示不限)
+func storageQuotaBytes() int64 {
+	return int64(cfg.UserStorageQuotaMB) * 1024 * 1024
+}
+
+// checkStorageQuota 判断用户是否还有剩余存储配额，并返回剩余可用字节 (不限时为 0)
+func checkStorageQuota(userID string) (int64, error) {
+	quota := storageQuotaBytes()
+	if quota <= 0 {
+		return 0, nil
+	}
+	used, err := database.GetUserUsage(userID)
+	if err != nil {
+		return 0, err
+	}
+	remaining := quota - used
+	if remaining <= 0 {
+		return 0, ErrStorageQuotaExceeded
+	}
+	return remaining, nil
+}
+
+// saveReaderToFile 将 r 的内容流式写入存储目录 (不整体读入内存)，同时计算 SHA-256
+// maxBytes > 0 时超过上限即中止并删除临时文件；写入同样受用户存储配额限制
+func saveReaderToFile(userID, purpose, mimeType, originalName string, r io.Reader, maxBytes int64, persistent bool) (*models.File, string, error) {
+	remaining, err := checkStorageQuota(userID)
+	if err != nil {
+		return nil, "", err
+	}
+
 	// Ensure storage directory exists
 	storageDir := cfg.StorageDir
 	dir := filepath.Join(storageDir, fmt.Sprintf("u_%s", userID), purpose)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Generate filename
@@ -1501,23 +3520,56 @@ func saveBufferToFile(userID, purpose, mimeType, originalName string, buf []byte
 	filename := fmt.Sprintf("%s.%s", id, ext)
 	filePath := filepath.Join(dir, filename)
 
-	// Write file
-	if err := os.WriteFile(filePath, buf, 0644); err != nil {
-		return nil, err
+	// Write to a temp file first so a failed transfer never leaves a partial file behind
+	tmpPath := filePath + ".part"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hasher := sha256.New()
+	limit := maxBytes
+	if remaining > 0 && (limit <= 0 || remaining < limit) {
+		limit = remaining
+	}
+	src := r
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	written, copyErr := io.Copy(io.MultiWriter(out, hasher), src)
+	closeErr := out.Close()
+	if copyErr == nil && limit > 0 && written > limit {
+		if limit == remaining {
+			copyErr = ErrStorageQuotaExceeded
+		} else {
+			copyErr = fmt.Errorf("文件超过大小上限 (%d 字节)", maxBytes)
+		}
+	}
+	if copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(tmpPath)
+		return nil, "", copyErr
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return nil, "", err
 	}
 
 	// Create database record
-	file, err := database.CreateFile(userID, purpose, mimeType, originalName, filePath, persistent)
+	file, err := database.CreateFile(userID, purpose, mimeType, originalName, filePath, written, persistent)
 	if err != nil {
 		os.Remove(filePath)
-		return nil, err
+		return nil, "", err
 	}
 
-	return file, nil
+	return file, hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func SaveBufferToFile(userID, purpose, mimeType, originalName string, buf []byte, persistent bool) (*models.File, error) {
-	return saveBufferToFile(userID, purpose, mimeType, originalName, buf, persistent)
+func SaveReaderToFile(userID, purpose, mimeType, originalName string, r io.Reader, maxBytes int64, persistent bool) (*models.File, string, error) {
+	return saveReaderToFile(userID, purpose, mimeType, originalName, r, maxBytes, persistent)
 }
 
 // saveBase64ToFile 将base64编码的图片保存为文件
@@ -1588,12 +3640,26 @@ func detectMimeType(buf []byte) string {
 		return "image/webp"
 	}
 
+	// ISO BMFF: .... ftyp <brand> (AVIF / MP4 / MOV)
+	if buf[4] == 'f' && buf[5] == 't' && buf[6] == 'y' && buf[7] == 'p' {
+		switch string(buf[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		case "qt  ":
+			return "video/quicktime"
+		default:
+			return "video/mp4"
+		}
+	}
+
+	// WebM / Matroska: 1A 45 DF A3
+	if buf[0] == 0x1A && buf[1] == 0x45 && buf[2] == 0xDF && buf[3] == 0xA3 {
+		return "video/webm"
+	}
+
 	return "application/octet-stream"
 }
 
-func boolToInt(b bool) int {
-	if b {
-		return 1
-	}
-	return 0
+func DetectMimeType(buf []byte) string {
+	return detectMimeType(buf)
 }
@@ -0,0 +1,764 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nano-backend/internal/database"
+	"nano-backend/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// setupTestDB points cfg at a temp dir and opens a fresh database there for the test
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	orig := *cfg
+	dir := t.TempDir()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.StorageDir = filepath.Join(dir, "storage")
+	cfg.UserStorageQuotaMB = 0
+	if err := database.Init(cfg); err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		*cfg = orig
+	})
+}
+
+// newTestApp returns an app whose requests are authenticated as user (nil = anonymous)
+func newTestApp(user *models.SanitizedUser) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if user != nil {
+			c.Locals("user", user)
+		}
+		return c.Next()
+	})
+	return app
+}
+
+// doJSON sends body as JSON and decodes the response into out (when non-nil), returning the status
+func doJSON(t *testing.T, app *fiber.App, method, target string, body interface{}, out interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return doRequest(t, app, req, out)
+}
+
+func doRequest(t *testing.T, app *fiber.App, req *http.Request, out interface{}) int {
+	t.Helper()
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", req.Method, req.URL, raw, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// newMultipartRequest builds a multipart form with the given fields and, when data is non-nil,
+// one file part under fileField
+func newMultipartRequest(t *testing.T, method, target string, fields map[string]string, fileField, filename, mimeType string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data != nil {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, fileField, filename))
+		header.Set("Content-Type", mimeType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, target, &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+// testPNG encodes a blank w x h PNG
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// createTestImageFile stores a small image file for userID and returns its ID
+func createTestImageFile(t *testing.T, userID, mimeType string) string {
+	t.Helper()
+	dir := filepath.Join(cfg.StorageDir, "u_"+userID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, uuid.New().String())
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := database.CreateFile(userID, "reference-upload", mimeType, "", path, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.ID
+}
+
+// createTestGeneration stores a generation with the given type, model and status
+func createTestGeneration(t *testing.T, userID, genType, model, status string) *models.Generation {
+	t.Helper()
+	now := models.Now()
+	g := &models.Generation{
+		ID:               uuid.New().String(),
+		UserID:           userID,
+		Type:             genType,
+		Prompt:           "a cat",
+		Model:            model,
+		Status:           status,
+		ReferenceFileIDs: []string{},
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := database.CreateGeneration(g); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+var testUser = &models.SanitizedUser{ID: "user-1", Username: "alice", Role: "user"}
+
+func TestEditGenerationStatusGuard(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Patch("/api/generations/:id", EditGeneration)
+
+	tests := []struct {
+		status string
+		want   int
+	}{
+		{"draft", 200},
+		{"queued", 200},
+		{"running", 409},
+		{"succeeded", 409},
+		{"failed", 409},
+		{"canceled", 409},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			g := createTestGeneration(t, testUser.ID, "image", "nano-banana", tt.status)
+			code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"prompt": "a dog"}, nil)
+			if code != tt.want {
+				t.Fatalf("status = %d, want %d", code, tt.want)
+			}
+			stored, _ := database.GetGenerationByID(g.ID)
+			wantPrompt := "a cat"
+			if tt.want == 200 {
+				wantPrompt = "a dog"
+			}
+			if stored.Prompt != wantPrompt {
+				t.Errorf("prompt = %q, want %q", stored.Prompt, wantPrompt)
+			}
+		})
+	}
+}
+
+func TestEditGenerationRejectsOtherUsersGeneration(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Patch("/api/generations/:id", EditGeneration)
+
+	g := createTestGeneration(t, "someone-else", "image", "nano-banana", "queued")
+	if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"prompt": "a dog"}, nil); code != 404 {
+		t.Fatalf("status = %d, want 404", code)
+	}
+}
+
+func TestEditGenerationVideoReferenceLimit(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Patch("/api/generations/:id", EditGeneration)
+
+	g := createTestGeneration(t, testUser.ID, "video", "sora-2", "queued")
+	refs := []string{createTestImageFile(t, testUser.ID, "image/png"), createTestImageFile(t, testUser.ID, "image/png")}
+
+	if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"referenceFileIds": refs}, nil); code != 400 {
+		t.Fatalf("two references: status = %d, want 400", code)
+	}
+	if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"referenceFileIds": refs[:1]}, nil); code != 200 {
+		t.Fatalf("one reference: status = %d, want 200", code)
+	}
+}
+
+func TestEditGenerationRejectsDisabledModel(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Patch("/api/generations/:id", EditGeneration)
+
+	if err := database.UpdateSettings(168, 50, 600, 600, []string{"nano-banana-pro"}); err != nil {
+		t.Fatal(err)
+	}
+	g := createTestGeneration(t, testUser.ID, "image", "nano-banana", "queued")
+
+	if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"model": "nano-banana-pro"}, nil); code != 503 {
+		t.Fatalf("status = %d, want 503", code)
+	}
+	if stored, _ := database.GetGenerationByID(g.ID); stored.Model != "nano-banana" {
+		t.Errorf("model = %q, want unchanged", stored.Model)
+	}
+}
+
+func TestGenerateImageOutputFormats(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Post("/api/generate/image", GenerateImage)
+
+	// webp/avif have no local encoder but are still forwarded to the provider as hints
+	for _, format := range []string{"png", "jpeg", "webp", "avif"} {
+		var resp struct {
+			Created []models.GenerationResponse `json:"created"`
+		}
+		code := doJSON(t, app, "POST", "/api/generate/image", fiber.Map{"prompt": "a cat", "model": "nano-banana", "draft": true, "outputFormat": format}, &resp)
+		if code != 200 || len(resp.Created) != 1 {
+			t.Fatalf("%s: status = %d, created = %d, want 200 with one draft", format, code, len(resp.Created))
+		}
+		if got := resp.Created[0].OutputFormat; got == nil || *got != format {
+			t.Errorf("%s: stored outputFormat = %v", format, got)
+		}
+	}
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	code := doJSON(t, app, "POST", "/api/generate/image", fiber.Map{"prompt": "a cat", "model": "nano-banana", "outputFormat": "gif"}, &resp)
+	if code != 400 || resp.Error != "不支持的输出格式" {
+		t.Errorf("gif: status = %d, error = %q, want 400 不支持的输出格式", code, resp.Error)
+	}
+}
+
+func TestReferencesMustBeImages(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Post("/api/generate/image", GenerateImage)
+	app.Patch("/api/generations/:id", EditGeneration)
+
+	video := createTestImageFile(t, testUser.ID, "video/mp4")
+	image := createTestImageFile(t, testUser.ID, "image/png")
+	wantErr := "参考文件 " + video + " 不是图片"
+
+	bodies := map[string]fiber.Map{
+		"referenceFileIds": {"prompt": "a cat", "model": "nano-banana", "draft": true, "referenceFileIds": []string{image, video}},
+		"referenceList": {"prompt": "a cat", "model": "nano-banana", "draft": true, "referenceList": []fiber.Map{
+			{"type": "fileId", "value": image}, {"type": "fileId", "value": video},
+		}},
+	}
+	for name, body := range bodies {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if code := doJSON(t, app, "POST", "/api/generate/image", body, &resp); code != 400 || resp.Error != wantErr {
+			t.Errorf("%s: status = %d, error = %q, want 400 %q", name, code, resp.Error, wantErr)
+		}
+	}
+
+	g := createTestGeneration(t, testUser.ID, "image", "nano-banana", "queued")
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"referenceFileIds": []string{video}}, &resp); code != 400 || resp.Error != wantErr {
+		t.Errorf("edit: status = %d, error = %q, want 400 %q", code, resp.Error, wantErr)
+	}
+	if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"referenceFileIds": []string{image}}, nil); code != 200 {
+		t.Errorf("edit with an image reference: status = %d, want 200", code)
+	}
+}
+
+func TestEmptyListsAreArrays(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Get("/api/settings/providers", ListProviderProfiles)
+	app.Get("/api/generations", ListGenerations)
+	app.Get("/api/generations/:id/references", ListGenerationReferences)
+	app.Get("/api/video/runs", ListVideoRuns)
+	app.Get("/api/video/runs/:id/generations", ListVideoRunGenerations)
+	app.Get("/api/presets", ListPresets)
+	app.Get("/api/library", ListLibrary)
+	app.Get("/api/reference-uploads", ListReferenceUploads)
+	app.Get("/api/review/projects", ListReviewProjects)
+	app.Get("/api/review/projects/:projectId/episodes", ListReviewEpisodes)
+	app.Get("/api/review/episodes/:episodeId/storyboards", ListReviewStoryboards)
+
+	assertEmptyArray := func(target string) {
+		t.Helper()
+		var raw json.RawMessage
+		if code := doJSON(t, app, "GET", target, nil, &raw); code != 200 {
+			t.Fatalf("%s: status = %d", target, code)
+		}
+		if string(raw) != "[]" {
+			t.Errorf("%s: body = %s, want []", target, raw)
+		}
+	}
+
+	// Top-level lists on a fresh database
+	for _, target := range []string{
+		"/api/settings/providers",
+		"/api/video/runs",
+		"/api/presets",
+		"/api/library",
+		"/api/reference-uploads",
+		"/api/review/projects",
+	} {
+		assertEmptyArray(target)
+	}
+	var page struct {
+		Items json.RawMessage `json:"items"`
+	}
+	if code := doJSON(t, app, "GET", "/api/generations", nil, &page); code != 200 || string(page.Items) != "[]" {
+		t.Errorf("/api/generations: status = %d, items = %s, want 200 []", code, page.Items)
+	}
+
+	// Children of parents that exist but have none
+	run, err := database.CreateVideoRun(testUser.ID, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := createTestGeneration(t, testUser.ID, "image", "nano-banana", "queued")
+	emptyEpisode := createTestEpisode(t, testUser.ID)
+	now := models.Now()
+	emptyProject := &models.ReviewProject{ID: uuid.New().String(), UserID: testUser.ID, Name: "empty", CreatedAt: now, UpdatedAt: now}
+	if err := database.CreateReviewProject(emptyProject); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{
+		"/api/generations/" + g.ID + "/references",
+		"/api/video/runs/" + run.ID + "/generations",
+		"/api/review/projects/" + emptyProject.ID + "/episodes",
+		"/api/review/episodes/" + emptyEpisode.ID + "/storyboards",
+	} {
+		assertEmptyArray(target)
+	}
+	page.Items = nil
+	if code := doJSON(t, app, "GET", "/api/review/episodes/"+emptyEpisode.ID+"/storyboards?status=approved", nil, &page); code != 200 || string(page.Items) != "[]" {
+		t.Errorf("filtered storyboards: status = %d, items = %s, want 200 []", code, page.Items)
+	}
+}
+
+func TestElapsedSecondsIsLiveForRunningGenerations(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Get("/api/generations", ListGenerations)
+	app.Get("/api/generations/:id", GetGeneration)
+
+	startedAt := models.Now() - 90*1000
+	running := createTestGeneration(t, testUser.ID, "image", "nano-banana", "running")
+	finished := createTestGeneration(t, testUser.ID, "image", "nano-banana", "succeeded")
+	queued := createTestGeneration(t, testUser.ID, "image", "nano-banana", "queued")
+	if err := database.UpdateGeneration(running.ID, map[string]interface{}{"startedAt": startedAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.UpdateGeneration(finished.ID, map[string]interface{}{"startedAt": startedAt, "elapsedSeconds": 12}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(source string, g models.GenerationResponse) {
+		t.Helper()
+		switch g.ID {
+		case running.ID:
+			if g.ElapsedSeconds == nil || *g.ElapsedSeconds < 90 || *g.ElapsedSeconds > 95 {
+				t.Errorf("%s: running elapsedSeconds = %v, want about 90", source, g.ElapsedSeconds)
+			}
+		case finished.ID:
+			if g.ElapsedSeconds == nil || *g.ElapsedSeconds != 12 {
+				t.Errorf("%s: finished elapsedSeconds = %v, want the stored 12", source, g.ElapsedSeconds)
+			}
+		case queued.ID:
+			if g.ElapsedSeconds != nil {
+				t.Errorf("%s: queued elapsedSeconds = %d, want null", source, *g.ElapsedSeconds)
+			}
+		}
+	}
+
+	for _, g := range []*models.Generation{running, finished, queued} {
+		var resp models.GenerationResponse
+		if code := doJSON(t, app, "GET", "/api/generations/"+g.ID, nil, &resp); code != 200 {
+			t.Fatalf("GET %s: status = %d", g.ID, code)
+		}
+		check("get", resp)
+	}
+
+	var page struct {
+		Items []models.GenerationResponse `json:"items"`
+	}
+	if code := doJSON(t, app, "GET", "/api/generations", nil, &page); code != 200 || len(page.Items) != 3 {
+		t.Fatalf("list: status = %d, items = %d", code, len(page.Items))
+	}
+	for _, g := range page.Items {
+		check("list", g)
+	}
+}
+
+func TestReferenceLimitBoundaries(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Post("/api/generate/image", GenerateImage)
+	app.Patch("/api/generations/:id", EditGeneration)
+
+	refs := make([]string, 15)
+	for i := range refs {
+		refs[i] = createTestImageFile(t, testUser.ID, "image/png")
+	}
+
+	tests := []struct {
+		name     string
+		override int
+		limit    int
+	}{
+		{"model default", 0, 14},
+		{"IMAGE_MAX_REFERENCES", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.ImageMaxReferences = tt.override
+			wantErr := fmt.Sprintf("该模型最多支持 %d 张参考图", tt.limit)
+
+			atLimit := fiber.Map{"prompt": "a cat", "model": "nano-banana", "draft": true, "referenceFileIds": refs[:tt.limit]}
+			if code := doJSON(t, app, "POST", "/api/generate/image", atLimit, nil); code != 200 {
+				t.Errorf("create with %d references: status = %d, want 200", tt.limit, code)
+			}
+			var resp struct {
+				Error string `json:"error"`
+			}
+			overLimit := fiber.Map{"prompt": "a cat", "model": "nano-banana", "draft": true, "referenceFileIds": refs[:tt.limit+1]}
+			if code := doJSON(t, app, "POST", "/api/generate/image", overLimit, &resp); code != 400 || resp.Error != wantErr {
+				t.Errorf("create with %d references: status = %d, error = %q, want 400 %q", tt.limit+1, code, resp.Error, wantErr)
+			}
+
+			g := createTestGeneration(t, testUser.ID, "image", "nano-banana", "draft")
+			if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"referenceFileIds": refs[:tt.limit]}, nil); code != 200 {
+				t.Errorf("edit with %d references: status = %d, want 200", tt.limit, code)
+			}
+			resp.Error = ""
+			if code := doJSON(t, app, "PATCH", "/api/generations/"+g.ID, fiber.Map{"referenceFileIds": refs[:tt.limit+1]}, &resp); code != 400 || resp.Error != wantErr {
+				t.Errorf("edit with %d references: status = %d, error = %q, want 400 %q", tt.limit+1, code, resp.Error, wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateReferenceUploadsReportsRejectedFiles(t *testing.T) {
+	setupTestDB(t)
+	cfg.UploadMaxWidth, cfg.UploadMaxHeight, cfg.UploadDownscale = 32, 32, false
+	app := newTestApp(testUser)
+	app.Post("/api/reference-uploads", CreateReferenceUploads)
+
+	upload := func(files map[string][]byte, order ...string) *http.Request {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		for _, name := range order {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename=%q`, name))
+			header.Set("Content-Type", "image/png")
+			part, err := w.CreatePart(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(files[name])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/reference-uploads", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		return req
+	}
+	files := map[string][]byte{"small.png": testPNG(t, 16, 16), "big.png": testPNG(t, 64, 64)}
+
+	var resp []models.ReferenceUploadResponse
+	if code := doRequest(t, app, upload(files, "small.png", "big.png"), &resp); code != 200 {
+		t.Fatalf("mixed batch: status = %d, want 200", code)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("mixed batch returned %d entries, want 2: %+v", len(resp), resp)
+	}
+	if resp[0].OriginalName != "small.png" || resp[0].ID == "" || resp[0].File == nil || resp[0].Error != "" {
+		t.Errorf("accepted file entry = %+v", resp[0])
+	}
+	if resp[1].OriginalName != "big.png" || resp[1].ID != "" || !strings.HasPrefix(resp[1].Error, "big.png 尺寸 64x64") {
+		t.Errorf("rejected file entry = %+v", resp[1])
+	}
+
+	var errResp struct {
+		Error string `json:"error"`
+	}
+	if code := doRequest(t, app, upload(files, "big.png"), &errResp); code != 400 || !strings.HasPrefix(errResp.Error, "big.png 尺寸 64x64") {
+		t.Errorf("all rejected: status = %d, error = %q, want 400 with the dimension message", code, errResp.Error)
+	}
+}
+
+func TestAdminRequeueFailedGenerationsRequiresFilter(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(&models.SanitizedUser{ID: "admin-1", Username: "root", Role: "admin"})
+	app.Post("/api/admin/generations/requeue-failed", AdminRequeueFailedGenerations)
+
+	tests := []struct {
+		name string
+		body interface{}
+		want int
+	}{
+		{"no body", nil, 400},
+		{"empty filter", fiber.Map{"until": 1}, 400},
+		{"since", fiber.Map{"since": 1}, 200},
+		{"errorCode", fiber.Map{"errorCode": "timeout"}, 200},
+	}
+	for _, tt := range tests {
+		if code := doJSON(t, app, "POST", "/api/admin/generations/requeue-failed", tt.body, nil); code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
+
+func TestProviderSettingsShowsEffectiveProvider(t *testing.T) {
+	setupTestDB(t)
+	cfg.DefaultProviderAPIKey = ""
+	app := newTestApp(testUser)
+	app.Get("/api/provider", GetProviderSettings)
+
+	get := func() (string, bool) {
+		var resp struct {
+			ProviderHost string `json:"providerHost"`
+			HasAPIKey    bool   `json:"hasApiKey"`
+		}
+		if code := doJSON(t, app, "GET", "/api/provider", nil, &resp); code != 200 {
+			t.Fatalf("GET /api/provider: status = %d", code)
+		}
+		return resp.ProviderHost, resp.HasAPIKey
+	}
+
+	if host, hasKey := get(); host != cfg.DefaultProviderHost || hasKey {
+		t.Errorf("nothing configured: host = %q, hasApiKey = %v, want the server default without a key", host, hasKey)
+	}
+
+	if err := database.SetUserProvider(testUser.ID, "https://saved.example.com", models.ProviderTypeOpenAI, "sk-saved", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateProviderProfile(testUser.ID, "profile", "https://profile.example.com", models.ProviderTypeOpenAI, "sk-profile", true, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if host, hasKey := get(); host != "https://profile.example.com" || !hasKey {
+		t.Errorf("default profile: host = %q, hasApiKey = %v, want the profile", host, hasKey)
+	}
+
+	// An admin lock pins the saved provider, as in the job runner
+	if err := database.SetUserProviderLocked(testUser.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if host, hasKey := get(); host != "https://saved.example.com" || !hasKey {
+		t.Errorf("locked provider: host = %q, hasApiKey = %v, want the saved provider", host, hasKey)
+	}
+}
+
+// countStoredFiles returns how many regular files are under cfg.StorageDir
+func countStoredFiles(t *testing.T) int {
+	t.Helper()
+	n := 0
+	filepath.WalkDir(cfg.StorageDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestGenerateImageRejectionKeepsNoSavedReferences(t *testing.T) {
+	setupTestDB(t)
+	cfg.UploadMaxWidth, cfg.UploadMaxHeight, cfg.UploadDownscale = 32, 32, false
+	app := newTestApp(testUser)
+	app.Post("/api/generate/image", GenerateImage)
+
+	video := createTestImageFile(t, testUser.ID, "video/mp4")
+	small := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG(t, 8, 8))
+	big := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG(t, 64, 64))
+
+	bodies := map[string]fiber.Map{
+		"legacy non-image fileId": {"prompt": "a cat", "model": "nano-banana", "draft": true,
+			"referenceFileIds": []string{video}, "referenceBase64List": []string{small}},
+		"list non-image fileId": {"prompt": "a cat", "model": "nano-banana", "draft": true, "referenceList": []fiber.Map{
+			{"type": "base64", "value": small}, {"type": "fileId", "value": video},
+		}},
+		"list unsupported type": {"prompt": "a cat", "model": "nano-banana", "draft": true, "referenceList": []fiber.Map{
+			{"type": "base64", "value": small}, {"type": "url", "value": "https://example.com/a.png"},
+		}},
+		"library permission": {"prompt": "a cat", "model": "nano-banana", "draft": true,
+			"referenceBase64List": []string{small}, "libraryItemIds": []string{"missing"}},
+		"later save fails": {"prompt": "a cat", "model": "nano-banana", "draft": true,
+			"referenceBase64List": []string{small, big}},
+	}
+	before, _ := database.GetUserUsage(testUser.ID)
+	files := countStoredFiles(t)
+	for name, body := range bodies {
+		if code := doJSON(t, app, "POST", "/api/generate/image", body, nil); code != 400 {
+			t.Errorf("%s: status = %d, want 400", name, code)
+		}
+		if n := countStoredFiles(t); n != files {
+			t.Errorf("%s: %d files left in storage, want %d", name, n, files)
+		}
+		if used, _ := database.GetUserUsage(testUser.ID); used != before {
+			t.Errorf("%s: usage = %d bytes, want %d", name, used, before)
+		}
+	}
+}
+
+// createContinuationSource stores a succeeded node in a new run whose output has the given MIME type
+func createContinuationSource(t *testing.T, userID, mimeType string) (*models.Generation, string) {
+	t.Helper()
+	run, err := database.CreateVideoRun(userID, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := createTestImageFile(t, userID, mimeType)
+	now := models.Now()
+	pos := 1
+	g := &models.Generation{
+		ID:               uuid.New().String(),
+		UserID:           userID,
+		Type:             "video",
+		Prompt:           "a cat",
+		Model:            "sora-2",
+		Status:           "succeeded",
+		ReferenceFileIDs: []string{},
+		RunID:            &run.ID,
+		NodePosition:     &pos,
+		OutputFileID:     &output,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := database.CreateGeneration(g); err != nil {
+		t.Fatal(err)
+	}
+	return g, output
+}
+
+func TestGenerateVideoContinuationFailureKeepsNoSavedReferences(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Post("/api/generate/video", GenerateVideo)
+	small := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG(t, 8, 8))
+
+	// Allow a continuation frame plus an uploaded reference
+	for i := range supportedModels {
+		if supportedModels[i].ID == "sora-2" {
+			orig := supportedModels[i].MaxReferences
+			supportedModels[i].MaxReferences = 2
+			t.Cleanup(func() { supportedModels[i].MaxReferences = orig })
+		}
+	}
+
+	// Without ffmpeg the frame can't be taken, and the base64 reference must not have been saved yet
+	t.Setenv("PATH", "")
+	video, _ := createContinuationSource(t, testUser.ID, "video/mp4")
+	files := countStoredFiles(t)
+	body := fiber.Map{"prompt": "next", "model": "sora-2", "draft": true, "continueFromGenerationId": video.ID, "referenceBase64": small}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if code := doJSON(t, app, "POST", "/api/generate/video", body, &resp); code != 400 || resp.Error != "服务器未安装 ffmpeg，暂不支持从视频续接" {
+		t.Errorf("without ffmpeg: status = %d, error = %q, want 400 for the missing ffmpeg", code, resp.Error)
+	}
+	if n := countStoredFiles(t); n != files {
+		t.Errorf("without ffmpeg: %d files in storage, want %d", n, files)
+	}
+
+	// An image node is referenced directly; a later failure must not delete the source's output
+	image, output := createContinuationSource(t, testUser.ID, "image/png")
+	body = fiber.Map{"prompt": "next", "model": "sora-2", "draft": true, "continueFromGenerationId": image.ID, "referenceBase64": "data:image/png;base64,!!!"}
+	if code := doJSON(t, app, "POST", "/api/generate/video", body, &resp); code != 400 || resp.Error != "第 1 张参考图处理失败" {
+		t.Errorf("bad base64: status = %d, error = %q, want 400 for the reference", code, resp.Error)
+	}
+	if f, err := database.GetFileByID(output); err != nil || f == nil {
+		t.Errorf("continuation source output was removed: %v", err)
+	}
+}
+
+func TestLockedProviderProfilesCannotBeDeleted(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Delete("/api/provider/profiles/:id", DeleteProviderProfile)
+
+	profile, err := database.CreateProviderProfile(testUser.ID, "profile", "https://profile.example.com", models.ProviderTypeOpenAI, "sk-profile", true, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetUserProvider(testUser.ID, "https://saved.example.com", models.ProviderTypeOpenAI, "sk-saved", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetUserProviderLocked(testUser.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if code := doJSON(t, app, "DELETE", "/api/provider/profiles/"+profile.ID, nil, &resp); code != 403 || resp.Error != "服务商设置已被管理员锁定" {
+		t.Errorf("locked: status = %d, error = %q, want 403", code, resp.Error)
+	}
+	if p, err := database.GetProviderProfile(testUser.ID, profile.ID); err != nil || p == nil {
+		t.Errorf("profile was deleted while locked: %v", err)
+	}
+
+	if err := database.SetUserProviderLocked(testUser.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if code := doJSON(t, app, "DELETE", "/api/provider/profiles/"+profile.ID, nil, nil); code != 200 {
+		t.Errorf("unlocked: status = %d, want 200", code)
+	}
+}
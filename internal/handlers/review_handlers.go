@@ -1,10 +1,17 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"nano-backend/internal/database"
+	"nano-backend/internal/fileutil"
 	"nano-backend/internal/middleware"
 	"nano-backend/internal/models"
 
@@ -17,23 +24,24 @@ import (
 // CreateReviewProject 创建影视项目
 func CreateReviewProject(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
-	name := c.FormValue("name")
+	meta, err := parseReviewMetadata(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
+	}
+	name := meta.Name
 
 	if name == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "项目名称不能为空"})
 	}
+	description, ok := meta.reviewDescription("")
+	if !ok {
+		return respondDescriptionTooLong(c)
+	}
 
 	// 处理封面上传 (非必要)
-	var coverFileID string
-	fileHeader, err := c.FormFile("cover")
-	if err == nil {
-		// 复用现有的文件保存逻辑
-		file, _ := fileHeader.Open()
-		buf, _ := io.ReadAll(file)
-		savedFile, err := SaveBufferToFile(user.ID, "project-cover", fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
-		if err == nil {
-			coverFileID = savedFile.ID
-		}
+	coverFileID, err := saveReviewCover(c, user.ID, "project-cover")
+	if err != nil {
+		return respondCoverSaveError(c, err)
 	}
 
 	now := models.Now()
@@ -41,6 +49,7 @@ func CreateReviewProject(c *fiber.Ctx) error {
 		ID:          uuid.New().String(),
 		UserID:      user.ID,
 		Name:        name,
+		Description: description,
 		CoverFileID: coverFileID,
 		CreatedAt:   now,
 		UpdatedAt:   now,
@@ -51,23 +60,94 @@ func CreateReviewProject(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "创建失败"})
 	}
 
-	return c.JSON(project)
+	return c.JSON(toReviewProjectResponse(project, user.ID))
+}
+
+// saveReviewCover 保存可选的封面上传 ("cover" 字段)，未上传时返回空 ID
+func saveReviewCover(c *fiber.Ctx, userID, purpose string) (string, error) {
+	fileHeader, err := c.FormFile("cover")
+	if err != nil {
+		return "", nil
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	buf, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	savedFile, err := SaveBufferToFile(userID, purpose, fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
+	if err != nil {
+		return "", err
+	}
+	return savedFile.ID, nil
+}
+
+// respondCoverSaveError 封面保存失败时拒绝整个请求，而不是悄悄丢弃封面
+func respondCoverSaveError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, ErrStorageQuotaExceeded) {
+		return c.Status(413).JSON(fiber.Map{"error": "存储空间不足"})
+	}
+	if msg, ok := imageDimensionsMessage(err); ok {
+		return c.Status(400).JSON(fiber.Map{"error": "图片" + msg})
+	}
+	log.Printf("[review] Error saving cover: %v", err)
+	return c.Status(500).JSON(fiber.Map{"error": "封面保存失败"})
 }
 
 // ListReviewProjects 获取项目列表
 func ListReviewProjects(c *fiber.Ctx) error {
+	viewerID := middleware.GetCurrentUser(c).ID
+
 	projects, err := database.ListReviewProjects()
 	if err != nil {
 		log.Printf("[review] Error listing projects: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
-	return c.JSON(projects)
+	responses := make([]models.ReviewProjectResponse, len(projects))
+	for i := range projects {
+		responses[i] = toReviewProjectResponse(&projects[i], viewerID)
+	}
+
+	return c.JSON(responses)
 }
 
 // GetReviewProject 获取项目详情
 func GetReviewProject(c *fiber.Ctx) error {
 	id := c.Params("id")
+	viewerID := middleware.GetCurrentUser(c).ID
+
+	project, err := database.GetReviewProject(id)
+	if err != nil {
+		log.Printf("[review] Error getting project: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if project == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "项目不存在"})
+	}
+
+	return c.JSON(toReviewProjectResponse(project, viewerID))
+}
+
+// projectDetailDefaultStoryboards/projectDetailMaxStoryboards 项目详情中每集返回的分镜数 (默认/上限)
+const (
+	projectDetailDefaultStoryboards = 200
+	projectDetailMaxStoryboards     = 500
+)
+
+// GetReviewProjectFull 一次返回项目、全部单集及每集的分镜 (带图片URL)，供项目页一次渲染。
+// 每集最多返回 storyboardLimit 条分镜 (默认 200，上限 500)，其余可通过分镜列表分页获取
+func GetReviewProjectFull(c *fiber.Ctx) error {
+	id := c.Params("id")
+	viewerID := middleware.GetCurrentUser(c).ID
+
+	perEpisode := c.QueryInt("storyboardLimit", projectDetailDefaultStoryboards)
+	if perEpisode <= 0 || perEpisode > projectDetailMaxStoryboards {
+		perEpisode = projectDetailMaxStoryboards
+	}
 
 	project, err := database.GetReviewProject(id)
 	if err != nil {
@@ -78,7 +158,98 @@ func GetReviewProject(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "项目不存在"})
 	}
 
-	return c.JSON(project)
+	episodes, _, err := database.ListReviewEpisodes(id, 0, 0)
+	if err != nil {
+		log.Printf("[review] Error listing episodes: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	storyboards, err := database.ListProjectStoryboards(id, perEpisode)
+	if err != nil {
+		log.Printf("[review] Error listing project storyboards: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	storyboardResponses, err := toReviewStoryboardResponses(storyboards, viewerID)
+	if err != nil {
+		log.Printf("[review] Error loading storyboard images: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	byEpisode := make(map[string][]models.ReviewStoryboardResponse, len(episodes))
+	for _, sb := range storyboardResponses {
+		byEpisode[sb.EpisodeID] = append(byEpisode[sb.EpisodeID], sb)
+	}
+
+	detail := models.ReviewProjectDetailResponse{
+		ReviewProjectResponse: toReviewProjectResponse(project, viewerID),
+		Episodes:              make([]models.ReviewEpisodeDetailResponse, len(episodes)),
+	}
+	for i := range episodes {
+		sbs := byEpisode[episodes[i].ID]
+		if sbs == nil {
+			sbs = []models.ReviewStoryboardResponse{}
+		}
+		detail.Episodes[i] = models.ReviewEpisodeDetailResponse{
+			ReviewEpisodeResponse: toReviewEpisodeResponse(&episodes[i], viewerID),
+			Storyboards:           sbs,
+		}
+	}
+
+	return c.JSON(detail)
+}
+
+// DuplicateReviewProject 复制项目 (含单集和分镜)，用于跨季复用项目结构
+func DuplicateReviewProject(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+	sourceID := c.Params("id")
+
+	source, err := database.GetReviewProject(sourceID)
+	if err != nil {
+		log.Printf("[review] Error getting project for duplicate: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if source == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "项目不存在"})
+	}
+
+	// 权限校验：仅创建者或管理员可复制
+	if source.UserID != user.ID && user.Role != "admin" {
+		return respondForbidden(c, "无权复制他人的项目")
+	}
+
+	meta, err := parseReviewMetadata(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
+	}
+	name := strings.TrimSpace(meta.Name)
+	if name == "" {
+		name = source.Name + " (副本)"
+	}
+
+	now := models.Now()
+	project := &models.ReviewProject{
+		ID:          uuid.New().String(),
+		UserID:      user.ID,
+		Name:        name,
+		Description: source.Description,
+		CoverFileID: source.CoverFileID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if err := database.DuplicateReviewProject(sourceID, project); err != nil {
+		log.Printf("[review] Error duplicating project %s: %v", sourceID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "复制项目失败"})
+	}
+
+	created, err := database.GetReviewProject(project.ID)
+	if err != nil || created == nil {
+		log.Printf("[review] Error getting duplicated project: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	log.Printf("[review] Project %s duplicated to %s by %s", sourceID, project.ID, user.Username)
+	return c.JSON(toReviewProjectResponse(created, user.ID))
 }
 
 // ========== 影视单集 (Episodes) ==========
@@ -87,11 +258,19 @@ func GetReviewProject(c *fiber.Ctx) error {
 func CreateReviewEpisode(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	projectID := c.Params("projectId")
-	name := c.FormValue("name")
+	meta, err := parseReviewMetadata(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
+	}
+	name := meta.Name
 
 	if name == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "单集名称不能为空"})
 	}
+	description, ok := meta.reviewDescription("")
+	if !ok {
+		return respondDescriptionTooLong(c)
+	}
 
 	// 验证项目存在
 	project, err := database.GetReviewProject(projectID)
@@ -104,15 +283,9 @@ func CreateReviewEpisode(c *fiber.Ctx) error {
 	}
 
 	// 处理封面上传 (非必要)
-	var coverFileID string
-	fileHeader, err := c.FormFile("cover")
-	if err == nil {
-		file, _ := fileHeader.Open()
-		buf, _ := io.ReadAll(file)
-		savedFile, err := SaveBufferToFile(user.ID, "episode-cover", fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
-		if err == nil {
-			coverFileID = savedFile.ID
-		}
+	coverFileID, err := saveReviewCover(c, user.ID, "episode-cover")
+	if err != nil {
+		return respondCoverSaveError(c, err)
 	}
 
 	// 获取当前最大排序值
@@ -124,6 +297,7 @@ func CreateReviewEpisode(c *fiber.Ctx) error {
 		ProjectID:   projectID,
 		UserID:      user.ID,
 		Name:        name,
+		Description: description,
 		CoverFileID: coverFileID,
 		SortOrder:   maxOrder + 1,
 		CreatedAt:   now,
@@ -135,25 +309,34 @@ func CreateReviewEpisode(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "创建失败"})
 	}
 
-	return c.JSON(episode)
+	return c.JSON(toReviewEpisodeResponse(episode, user.ID))
 }
 
 // ListReviewEpisodes 获取单集列表
 func ListReviewEpisodes(c *fiber.Ctx) error {
 	projectID := c.Params("projectId")
+	viewerID := middleware.GetCurrentUser(c).ID
 
-	episodes, err := database.ListReviewEpisodes(projectID)
+	limit, offset := reviewPagination(c)
+	episodes, total, err := database.ListReviewEpisodes(projectID, limit, offset)
 	if err != nil {
 		log.Printf("[review] Error listing episodes: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
+	c.Set("X-Total-Count", strconv.Itoa(total))
+
+	responses := make([]models.ReviewEpisodeResponse, len(episodes))
+	for i := range episodes {
+		responses[i] = toReviewEpisodeResponse(&episodes[i], viewerID)
+	}
 
-	return c.JSON(episodes)
+	return c.JSON(responses)
 }
 
 // GetReviewEpisode 获取单集详情
 func GetReviewEpisode(c *fiber.Ctx) error {
 	id := c.Params("id")
+	viewerID := middleware.GetCurrentUser(c).ID
 
 	episode, err := database.GetReviewEpisode(id)
 	if err != nil {
@@ -164,16 +347,84 @@ func GetReviewEpisode(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "单集不存在"})
 	}
 
-	return c.JSON(episode)
+	return c.JSON(toReviewEpisodeResponse(episode, viewerID))
+}
+
+// GetReviewEpisodeContactSheet 将单集分镜图按排序拼成一张 JPEG 联系表，直接输出不落盘
+// 查询参数: columns (1-12，默认 4)、cell (64-1024，默认 320)、status (可选，仅包含该状态的分镜)
+func GetReviewEpisodeContactSheet(c *fiber.Ctx) error {
+	episodeID := c.Params("id")
+
+	columns := c.QueryInt("columns", 4)
+	if columns < 1 || columns > 12 {
+		return c.Status(400).JSON(fiber.Map{"error": "列数需在 1 到 12 之间"})
+	}
+	cellSize := c.QueryInt("cell", 320)
+	if cellSize < 64 || cellSize > 1024 {
+		return c.Status(400).JSON(fiber.Map{"error": "单元格尺寸需在 64 到 1024 之间"})
+	}
+	status := c.Query("status")
+	if status != "" && !models.IsValidStoryboardStatus(status) {
+		return c.Status(400).JSON(fiber.Map{"error": "无效的审阅状态"})
+	}
+
+	episode, err := database.GetReviewEpisode(episodeID)
+	if err != nil {
+		log.Printf("[review] Error getting episode: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if episode == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "单集不存在"})
+	}
+
+	storyboards, _, err := database.ListReviewStoryboards(episodeID, status, 0, 0)
+	if err != nil {
+		log.Printf("[review] Error listing storyboards: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	fileIDs := make([]string, 0, len(storyboards))
+	for _, sb := range storyboards {
+		if sb.ImageFileID != "" {
+			fileIDs = append(fileIDs, sb.ImageFileID)
+		}
+	}
+	files, err := database.GetFilesByIDs(fileIDs)
+	if err != nil {
+		log.Printf("[review] Error loading storyboard images: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	// 保持 sortOrder 顺序
+	paths := make([]string, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		if file, ok := files[id]; ok && strings.HasPrefix(file.MimeType, "image/") {
+			paths = append(paths, file.Path)
+		}
+	}
+
+	width, height := fileutil.ContactSheetSize(len(paths), columns, cellSize)
+	if width*height > fileutil.ContactSheetMaxPixel {
+		return c.Status(400).JSON(fiber.Map{"error": "联系表尺寸过大，请减小单元格尺寸或增加列数"})
+	}
+
+	c.Set("Content-Type", "image/jpeg")
+	c.Set("Content-Disposition", `inline; filename="contact-sheet.jpg"`)
+	if err := fileutil.WriteContactSheet(c.Response().BodyWriter(), paths, columns, cellSize); err != nil {
+		log.Printf("[review] Error rendering contact sheet for episode %s: %v", episodeID, err)
+		c.Response().ResetBody()
+		return c.Status(500).JSON(fiber.Map{"error": "生成联系表失败"})
+	}
+	return nil
 }
 
 // ========== 分镜 (Storyboards) ==========
 
-// CreateReviewStoryboard 创建分镜
+// CreateReviewStoryboard 创建分镜；name 可选，未填写时取图片文件名
 func CreateReviewStoryboard(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	episodeID := c.Params("episodeId")
-	name := c.FormValue("name")
+	name := strings.TrimSpace(c.FormValue("name"))
 
 	// 验证单集存在
 	episode, err := database.GetReviewEpisode(episodeID)
@@ -190,11 +441,20 @@ func CreateReviewStoryboard(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "必须上传分镜图片"})
 	}
+	if name == "" {
+		name = storyboardNameFromFile(fileHeader.Filename)
+	}
 
 	// 读取并保存图片
 	file, _ := fileHeader.Open()
 	buf, _ := io.ReadAll(file)
 	savedFile, err := SaveBufferToFile(user.ID, "storyboard-image", fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
+	if errors.Is(err, ErrStorageQuotaExceeded) {
+		return c.Status(413).JSON(fiber.Map{"error": "存储空间不足"})
+	}
+	if msg, ok := imageDimensionsMessage(err); ok {
+		return c.Status(400).JSON(fiber.Map{"error": "图片" + msg})
+	}
 	if err != nil {
 		log.Printf("[review] Error saving storyboard image: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "图片保存失败"})
@@ -221,43 +481,159 @@ func CreateReviewStoryboard(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "创建失败"})
 	}
 
-	return c.JSON(storyboard)
+	return c.JSON(models.ReviewStoryboardResponse{
+		ReviewStoryboard: *storyboard,
+		ImageURL:         buildClientFileURL(storyboard.ImageFileID, user.ID, false),
+	})
 }
 
-// ListReviewStoryboards 获取分镜列表
-func ListReviewStoryboards(c *fiber.Ctx) error {
+// BatchCreateReviewStoryboards 批量上传图片创建分镜
+// 每张图片单独保存，失败的文件在 errors 中返回；成功的分镜在同一事务中写入
+func BatchCreateReviewStoryboards(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
 	episodeID := c.Params("episodeId")
-	token := middleware.GetToken(c)
+	viewerID := user.ID
 
-	storyboards, err := database.ListReviewStoryboards(episodeID)
+	// 验证单集存在
+	episode, err := database.GetReviewEpisode(episodeID)
 	if err != nil {
-		log.Printf("[review] Error listing storyboards: %v", err)
+		log.Printf("[review] Error getting episode: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
+	if episode == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "单集不存在"})
+	}
 
-	// 构建响应，包含图片URL
-	responses := make([]models.ReviewStoryboardResponse, len(storyboards))
-	for i, sb := range storyboards {
-		responses[i] = models.ReviewStoryboardResponse{
-			ReviewStoryboard: sb,
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "必须上传分镜图片"})
+	}
+	fileHeaders := form.File["images"]
+	if len(fileHeaders) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "必须上传分镜图片"})
+	}
+
+	type fileError struct {
+		Filename string `json:"filename"`
+		Error    string `json:"error"`
+	}
+
+	var failed []fileError
+	var savedFiles []*models.File
+	var storyboards []*models.ReviewStoryboard
+	now := models.Now()
+
+	for _, fh := range fileHeaders {
+		file, err := fh.Open()
+		if err != nil {
+			log.Printf("[review] Error opening storyboard image %s: %v", fh.Filename, err)
+			failed = append(failed, fileError{Filename: fh.Filename, Error: "无法读取文件"})
+			continue
 		}
-		// 获取图片URL
-		if sb.ImageFileID != "" {
-			if file, err := database.GetFileByID(sb.ImageFileID); err == nil && file != nil {
-				responses[i].ImageURL = buildClientFileURL(file.ID, token, false)
+		buf, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			log.Printf("[review] Error reading storyboard image %s: %v", fh.Filename, err)
+			failed = append(failed, fileError{Filename: fh.Filename, Error: "无法读取文件"})
+			continue
+		}
+
+		savedFile, err := SaveBufferToFile(user.ID, "storyboard-image", fh.Header.Get("Content-Type"), fh.Filename, buf, true)
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			failed = append(failed, fileError{Filename: fh.Filename, Error: "存储空间不足"})
+			continue
+		}
+		if msg, ok := imageDimensionsMessage(err); ok {
+			failed = append(failed, fileError{Filename: fh.Filename, Error: "图片" + msg})
+			continue
+		}
+		if err != nil {
+			log.Printf("[review] Error saving storyboard image %s: %v", fh.Filename, err)
+			failed = append(failed, fileError{Filename: fh.Filename, Error: "图片保存失败"})
+			continue
+		}
+		savedFiles = append(savedFiles, savedFile)
+
+		storyboards = append(storyboards, &models.ReviewStoryboard{
+			ID:          uuid.New().String(),
+			UserID:      user.ID,
+			Name:        storyboardNameFromFile(fh.Filename),
+			ImageFileID: savedFile.ID,
+			Status:      models.StoryboardStatusPending,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+	}
+
+	if len(storyboards) > 0 {
+		if err := database.CreateReviewStoryboards(episodeID, storyboards); err != nil {
+			log.Printf("[review] Error batch creating storyboards: %v", err)
+			// 事务已回滚，清理本次保存的图片
+			for _, f := range savedFiles {
+				fileutil.RemoveWithThumb(f.Path)
+				_ = database.DeleteFile(f.ID)
 			}
+			return c.Status(500).JSON(fiber.Map{"error": "创建失败"})
 		}
 	}
 
+	created := make([]models.ReviewStoryboardResponse, len(storyboards))
+	for i, sb := range storyboards {
+		created[i] = models.ReviewStoryboardResponse{
+			ReviewStoryboard: *sb,
+			ImageURL:         buildClientFileURL(sb.ImageFileID, viewerID, false),
+		}
+	}
+	if failed == nil {
+		failed = []fileError{}
+	}
+
+	log.Printf("[review] Batch created %d storyboards (%d failed) for episode %s", len(created), len(failed), episodeID)
+
+	return c.JSON(fiber.Map{
+		"created": created,
+		"errors":  failed,
+	})
+}
+
+// ListReviewStoryboards 获取分镜列表，总数通过 X-Total-Count 返回
+// 传入 status 时仅返回该状态的分镜，响应为 {items, total}；未传时保持原有的数组响应
+func ListReviewStoryboards(c *fiber.Ctx) error {
+	episodeID := c.Params("episodeId")
+	viewerID := middleware.GetCurrentUser(c).ID
+
+	status := c.Query("status")
+	if status != "" && !models.IsValidStoryboardStatus(status) {
+		return c.Status(400).JSON(fiber.Map{"error": "无效的审阅状态"})
+	}
+
+	limit, offset := reviewPagination(c)
+	storyboards, total, err := database.ListReviewStoryboards(episodeID, status, limit, offset)
+	if err != nil {
+		log.Printf("[review] Error listing storyboards: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	c.Set("X-Total-Count", strconv.Itoa(total))
+
+	responses, err := toReviewStoryboardResponses(storyboards, viewerID)
+	if err != nil {
+		log.Printf("[review] Error loading storyboard images: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+
+	if status != "" {
+		return c.JSON(fiber.Map{"items": responses, "total": total})
+	}
 	return c.JSON(responses)
 }
 
 // ReviewStoryboard 审阅/修改分镜状态
 func ReviewStoryboard(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
 	storyboardID := c.Params("id")
 
 	var body struct {
-		Status   string `json:"status"`   // "approved" 或 "rejected"
+		Status   string `json:"status"`   // "pending"、"approved" 或 "rejected"
 		Feedback string `json:"feedback"` // 当 rejected 时必填
 	}
 
@@ -265,7 +641,11 @@ func ReviewStoryboard(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
 	}
 
-	if body.Status == "rejected" && body.Feedback == "" {
+	if !models.IsValidStoryboardStatus(body.Status) {
+		return c.Status(400).JSON(fiber.Map{"error": "无效的审阅状态"})
+	}
+
+	if body.Status == models.StoryboardStatusRejected && body.Feedback == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "未通过时必须填写修改建议"})
 	}
 
@@ -279,7 +659,7 @@ func ReviewStoryboard(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "分镜不存在"})
 	}
 
-	if err := database.UpdateStoryboardStatus(storyboardID, body.Status, body.Feedback); err != nil {
+	if err := database.UpdateStoryboardStatus(storyboardID, body.Status, body.Feedback, user.ID); err != nil {
 		log.Printf("[review] Error updating storyboard status: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "更新失败"})
 	}
@@ -289,6 +669,7 @@ func ReviewStoryboard(c *fiber.Ctx) error {
 
 // ReorderStoryboards 分镜排序 (拖拽后调用)
 func ReorderStoryboards(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
 
 	// 接收一个有序的ID列表
 	var body struct {
@@ -303,12 +684,37 @@ func ReorderStoryboards(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "分镜ID列表不能为空"})
 	}
 
-	// 验证权限
+	// 验证所有分镜存在且属于同一单集
+	var episodeID string
+	seen := make(map[string]bool, len(body.StoryboardIDs))
 	for _, id := range body.StoryboardIDs {
+		if seen[id] {
+			return c.Status(400).JSON(fiber.Map{"error": "分镜ID重复"})
+		}
+		seen[id] = true
+
 		storyboard, err := database.GetReviewStoryboard(id)
 		if err != nil || storyboard == nil {
 			return c.Status(404).JSON(fiber.Map{"error": "分镜不存在或无权限访问"})
 		}
+		if episodeID == "" {
+			episodeID = storyboard.EpisodeID
+		} else if storyboard.EpisodeID != episodeID {
+			return c.Status(400).JSON(fiber.Map{"error": "只能对同一单集下的分镜排序"})
+		}
+	}
+
+	// 验证权限：单集创建者或管理员
+	episode, err := database.GetReviewEpisode(episodeID)
+	if err != nil {
+		log.Printf("[review] Error getting episode: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if episode == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "单集不存在"})
+	}
+	if episode.UserID != user.ID && user.Role != "admin" {
+		return respondForbidden(c, "无权调整他人单集的分镜顺序")
 	}
 
 	// 批量更新排序
@@ -322,6 +728,8 @@ func ReorderStoryboards(c *fiber.Ctx) error {
 
 // ReorderEpisodes 单集排序
 func ReorderEpisodes(c *fiber.Ctx) error {
+	user := middleware.GetCurrentUser(c)
+
 	var body struct {
 		EpisodeIDs []string `json:"episodeIds"`
 	}
@@ -334,12 +742,37 @@ func ReorderEpisodes(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "ID列表不能为空"})
 	}
 
-	// 简单的权限验证：检查这些单集是否存在
+	// 验证所有单集存在且属于同一项目
+	var projectID string
+	seen := make(map[string]bool, len(body.EpisodeIDs))
 	for _, id := range body.EpisodeIDs {
+		if seen[id] {
+			return c.Status(400).JSON(fiber.Map{"error": "单集ID重复"})
+		}
+		seen[id] = true
+
 		ep, err := database.GetReviewEpisode(id)
 		if err != nil || ep == nil {
 			return c.Status(404).JSON(fiber.Map{"error": "单集不存在或无权限访问"})
 		}
+		if projectID == "" {
+			projectID = ep.ProjectID
+		} else if ep.ProjectID != projectID {
+			return c.Status(400).JSON(fiber.Map{"error": "只能对同一项目下的单集排序"})
+		}
+	}
+
+	// 验证权限：项目创建者或管理员
+	project, err := database.GetReviewProject(projectID)
+	if err != nil {
+		log.Printf("[review] Error getting project: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
+	}
+	if project == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "项目不存在"})
+	}
+	if project.UserID != user.ID && user.Role != "admin" {
+		return respondForbidden(c, "无权调整他人项目的单集顺序")
 	}
 
 	// 批量更新排序
@@ -355,7 +788,11 @@ func ReorderEpisodes(c *fiber.Ctx) error {
 func UpdateReviewProject(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	projectID := c.Params("id")
-	name := c.FormValue("name")
+	meta, err := parseReviewMetadata(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
+	}
+	name := meta.Name
 
 	if name == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "项目名称不能为空"})
@@ -373,42 +810,47 @@ func UpdateReviewProject(c *fiber.Ctx) error {
 
 	// 2. 权限校验：非创建者且非管理则报错
 	if existing.UserID != user.ID && user.Role != "admin" {
-		return c.Status(403).JSON(fiber.Map{"error": "无权修改他人的项目"})
+		return respondForbidden(c, "无权修改他人的项目")
+	}
+	description, ok := meta.reviewDescription(existing.Description)
+	if !ok {
+		return respondDescriptionTooLong(c)
 	}
 
 	// 3. 处理封面上传 (可选)
-	var coverFileID string
-	fileHeader, err := c.FormFile("cover")
-	if err == nil {
-		file, _ := fileHeader.Open()
-		buf, _ := io.ReadAll(file)
-		savedFile, err := SaveBufferToFile(user.ID, "project-cover", fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
-		if err == nil {
-			coverFileID = savedFile.ID
-		}
+	coverFileID, err := saveReviewCover(c, user.ID, "project-cover")
+	if err != nil {
+		return respondCoverSaveError(c, err)
 	}
 
 	// 4. 更新数据
-	if err := database.UpdateReviewProject(projectID, name, coverFileID); err != nil {
+	if err := database.UpdateReviewProject(projectID, name, description, coverFileID); err != nil {
 		log.Printf("[review] Error updating project: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "更新失败"})
 	}
+	if coverFileID != "" {
+		removeReplacedFile(existing.CoverFileID)
+	}
 
 	// 5. 返回更新后的项目
 	updatedProject, err := database.GetReviewProject(projectID)
-	if err != nil {
+	if err != nil || updatedProject == nil {
 		log.Printf("[review] Error getting updated project: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
-	return c.JSON(updatedProject)
+	return c.JSON(toReviewProjectResponse(updatedProject, middleware.GetCurrentUser(c).ID))
 }
 
 // UpdateReviewEpisode 更新影视单集
 func UpdateReviewEpisode(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	episodeID := c.Params("id")
-	name := c.FormValue("name")
+	meta, err := parseReviewMetadata(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
+	}
+	name := meta.Name
 
 	if name == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "单集名称不能为空"})
@@ -426,46 +868,47 @@ func UpdateReviewEpisode(c *fiber.Ctx) error {
 
 	// 2. 权限校验：非创建者且非管理则报错
 	if existing.UserID != user.ID && user.Role != "admin" {
-		return c.Status(403).JSON(fiber.Map{"error": "无权修改他人的单集"})
+		return respondForbidden(c, "无权修改他人的单集")
+	}
+	description, ok := meta.reviewDescription(existing.Description)
+	if !ok {
+		return respondDescriptionTooLong(c)
 	}
 
 	// 3. 处理封面上传 (可选)
-	var coverFileID string
-	fileHeader, err := c.FormFile("cover")
-	if err == nil {
-		file, _ := fileHeader.Open()
-		buf, _ := io.ReadAll(file)
-		savedFile, err := SaveBufferToFile(user.ID, "episode-cover", fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
-		if err == nil {
-			coverFileID = savedFile.ID
-		}
+	coverFileID, err := saveReviewCover(c, user.ID, "episode-cover")
+	if err != nil {
+		return respondCoverSaveError(c, err)
 	}
 
 	// 4. 更新数据
-	if err := database.UpdateReviewEpisode(episodeID, name, coverFileID); err != nil {
+	if err := database.UpdateReviewEpisode(episodeID, name, description, coverFileID); err != nil {
 		log.Printf("[review] Error updating episode: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "更新失败"})
 	}
+	if coverFileID != "" {
+		removeReplacedFile(existing.CoverFileID)
+	}
 
 	// 5. 返回更新后的单集
 	updatedEpisode, err := database.GetReviewEpisode(episodeID)
-	if err != nil {
+	if err != nil || updatedEpisode == nil {
 		log.Printf("[review] Error getting updated episode: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "服务器错误"})
 	}
 
-	return c.JSON(updatedEpisode)
+	return c.JSON(toReviewEpisodeResponse(updatedEpisode, middleware.GetCurrentUser(c).ID))
 }
 
-// UpdateReviewStoryboard 更新分镜
+// UpdateReviewStoryboard 更新分镜 (名称/图片)，并将审阅状态重置为 pending；name 可选，未填写时保留原名称
 func UpdateReviewStoryboard(c *fiber.Ctx) error {
 	user := middleware.GetCurrentUser(c)
 	storyboardID := c.Params("id")
-	name := c.FormValue("name")
-
-	if name == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "分镜名称不能为空"})
+	meta, err := parseReviewMetadata(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "格式错误"})
 	}
+	name := strings.TrimSpace(meta.Name)
 
 	// 1. 获取原数据
 	existing, err := database.GetReviewStoryboard(storyboardID)
@@ -479,7 +922,13 @@ func UpdateReviewStoryboard(c *fiber.Ctx) error {
 
 	// 2. 权限校验：非创建者且非管理则报错
 	if existing.UserID != user.ID && user.Role != "admin" {
-		return c.Status(403).JSON(fiber.Map{"error": "无权修改他人的分镜"})
+		return respondForbidden(c, "无权修改他人的分镜")
+	}
+	if name == "" {
+		name = existing.Name
+	}
+	if name == "" {
+		name = untitledStoryboardName
 	}
 
 	// 3. 处理分镜图片 (可选)
@@ -489,6 +938,12 @@ func UpdateReviewStoryboard(c *fiber.Ctx) error {
 		file, _ := fileHeader.Open()
 		buf, _ := io.ReadAll(file)
 		savedFile, err := SaveBufferToFile(user.ID, "storyboard-image", fileHeader.Header.Get("Content-Type"), fileHeader.Filename, buf, true)
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			return c.Status(413).JSON(fiber.Map{"error": "存储空间不足"})
+		}
+		if msg, ok := imageDimensionsMessage(err); ok {
+			return c.Status(400).JSON(fiber.Map{"error": "图片" + msg})
+		}
 		if err != nil {
 			log.Printf("[review] Error saving storyboard image: %v", err)
 			return c.Status(500).JSON(fiber.Map{"error": "图片保存失败"})
@@ -501,6 +956,9 @@ func UpdateReviewStoryboard(c *fiber.Ctx) error {
 		log.Printf("[review] Error updating storyboard: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "更新失败"})
 	}
+	if imageFileID != "" {
+		removeReplacedFile(existing.ImageFileID)
+	}
 
 	// 5. 返回更新后的分镜
 	updatedStoryboard, err := database.GetReviewStoryboard(storyboardID)
@@ -531,7 +989,7 @@ func DeleteReviewProject(c *fiber.Ctx) error {
 
 	// 2. 权限校验
 	if project.UserID != user.ID && user.Role != "admin" {
-		return c.Status(403).JSON(fiber.Map{"error": "无权删除他人的项目"})
+		return respondForbidden(c, "无权删除他人的项目")
 	}
 
 	// 3. 执行删除
@@ -560,7 +1018,7 @@ func DeleteReviewEpisode(c *fiber.Ctx) error {
 
 	// 2. 权限校验
 	if episode.UserID != user.ID && user.Role != "admin" {
-		return c.Status(403).JSON(fiber.Map{"error": "无权删除他人的单集"})
+		return respondForbidden(c, "无权删除他人的单集")
 	}
 
 	// 3. 执行删除
@@ -589,7 +1047,7 @@ func DeleteReviewStoryboard(c *fiber.Ctx) error {
 
 	// 2. 权限校验
 	if storyboard.UserID != user.ID && user.Role != "admin" {
-		return c.Status(403).JSON(fiber.Map{"error": "无权删除他人的分镜"})
+		return respondForbidden(c, "无权删除他人的分镜")
 	}
 
 	// 3. 执行删除
@@ -600,3 +1058,144 @@ func DeleteReviewStoryboard(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{"ok": true})
 }
+
+// ========== Helper Functions ==========
+
+// toReviewProjectResponse 附带封面访问地址，避免前端逐个请求文件接口
+func toReviewProjectResponse(p *models.ReviewProject, viewerID string) models.ReviewProjectResponse {
+	resp := models.ReviewProjectResponse{ReviewProject: *p}
+	if p.CoverFileID != "" {
+		resp.CoverURL = buildClientFileURL(p.CoverFileID, viewerID, false)
+	}
+	return resp
+}
+
+// toReviewEpisodeResponse 附带封面访问地址
+func toReviewEpisodeResponse(e *models.ReviewEpisode, viewerID string) models.ReviewEpisodeResponse {
+	resp := models.ReviewEpisodeResponse{ReviewEpisode: *e}
+	if e.CoverFileID != "" {
+		resp.CoverURL = buildClientFileURL(e.CoverFileID, viewerID, false)
+	}
+	return resp
+}
+
+// toReviewStoryboardResponses 一次查询批量加载图片文件并构建带图片URL的响应；图片已被清理的分镜 imageUrl 为空
+func toReviewStoryboardResponses(storyboards []models.ReviewStoryboard, viewerID string) ([]models.ReviewStoryboardResponse, error) {
+	fileIDs := make([]string, 0, len(storyboards))
+	for _, sb := range storyboards {
+		if sb.ImageFileID != "" {
+			fileIDs = append(fileIDs, sb.ImageFileID)
+		}
+	}
+	files, err := database.GetFilesByIDs(fileIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]models.ReviewStoryboardResponse, len(storyboards))
+	for i, sb := range storyboards {
+		responses[i] = models.ReviewStoryboardResponse{
+			ReviewStoryboard: sb,
+		}
+		if file, ok := files[sb.ImageFileID]; ok {
+			responses[i].ImageURL = buildClientFileURL(file.ID, viewerID, false)
+		}
+	}
+	return responses, nil
+}
+
+// untitledStoryboardName 分镜名称可选；既未填写也无法从文件名得出时使用
+const untitledStoryboardName = "未命名分镜"
+
+// storyboardNameFromFile 以去掉扩展名的图片文件名作为默认分镜名称
+func storyboardNameFromFile(filename string) string {
+	name := strings.TrimSpace(strings.TrimSuffix(filename, filepath.Ext(filename)))
+	if name == "" {
+		return untitledStoryboardName
+	}
+	return name
+}
+
+// maxReviewDescriptionLen 项目/单集简介的长度上限 (字符数)
+const maxReviewDescriptionLen = 2000
+
+// reviewMetadata 审阅实体的文本字段；Description 为 nil 表示未提交
+type reviewMetadata struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description"`
+}
+
+// parseReviewMetadata 从 application/json 或表单 (multipart/urlencoded) 中读取 name/description。
+// JSON 请求无法携带文件，上传封面/图片仍需使用 multipart
+func parseReviewMetadata(c *fiber.Ctx) (*reviewMetadata, error) {
+	var meta reviewMetadata
+	if c.Is("json") {
+		if err := c.BodyParser(&meta); err != nil {
+			return nil, err
+		}
+		meta.Name = strings.TrimSpace(meta.Name)
+		return &meta, nil
+	}
+
+	meta.Name = c.FormValue("name")
+	submitted := false
+	if form, err := c.MultipartForm(); err == nil {
+		_, submitted = form.Value["description"]
+	} else {
+		submitted = c.Request().PostArgs().Has("description")
+	}
+	if submitted {
+		description := c.FormValue("description")
+		meta.Description = &description
+	}
+	return &meta, nil
+}
+
+// reviewDescription 返回要保存的简介；未提交时沿用 current，超长时返回 false
+func (m *reviewMetadata) reviewDescription(current string) (string, bool) {
+	if m.Description == nil {
+		return current, true
+	}
+	description := strings.TrimSpace(*m.Description)
+	return description, utf8.RuneCountInString(description) <= maxReviewDescriptionLen
+}
+
+func respondDescriptionTooLong(c *fiber.Ctx) error {
+	return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("简介不能超过 %d 个字符", maxReviewDescriptionLen)})
+}
+
+// reviewPagination 读取可选的 limit/offset；未传 limit 时返回全部 (兼容旧客户端)
+func reviewPagination(c *fiber.Ctx) (int, int) {
+	limit := c.QueryInt("limit", 0)
+	offset := c.QueryInt("offset", 0)
+	if limit > 500 {
+		limit = 500
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// removeReplacedFile 删除被替换下来的旧图片；仍被其他记录引用时保留
+func removeReplacedFile(fileID string) {
+	if fileID == "" {
+		return
+	}
+	referenced, err := database.IsFileReferenced(fileID)
+	if err != nil {
+		log.Printf("[review] Error checking references for file %s: %v", fileID, err)
+		return
+	}
+	if referenced {
+		return
+	}
+	file, err := database.GetFileByID(fileID)
+	if err != nil || file == nil {
+		return
+	}
+	fileutil.RemoveWithThumb(file.Path)
+	if err := database.DeleteFile(file.ID); err != nil {
+		log.Printf("[review] Error deleting replaced file %s: %v", fileID, err)
+	}
+}
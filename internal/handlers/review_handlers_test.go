@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"nano-backend/internal/database"
+	"nano-backend/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// createTestEpisode stores a project with one episode owned by userID and returns the episode
+func createTestEpisode(t *testing.T, userID string) *models.ReviewEpisode {
+	t.Helper()
+	now := models.Now()
+	project := &models.ReviewProject{ID: uuid.New().String(), UserID: userID, Name: "project", CreatedAt: now, UpdatedAt: now}
+	if err := database.CreateReviewProject(project); err != nil {
+		t.Fatal(err)
+	}
+	episode := &models.ReviewEpisode{ID: uuid.New().String(), ProjectID: project.ID, UserID: userID, Name: "episode", CreatedAt: now, UpdatedAt: now}
+	if err := database.CreateReviewEpisode(episode); err != nil {
+		t.Fatal(err)
+	}
+	return episode
+}
+
+// createTestStoryboard stores a storyboard with a fresh image in the episode
+func createTestStoryboard(t *testing.T, episode *models.ReviewEpisode, status string, sortOrder int) *models.ReviewStoryboard {
+	t.Helper()
+	now := models.Now()
+	sb := &models.ReviewStoryboard{
+		ID:          uuid.New().String(),
+		EpisodeID:   episode.ID,
+		UserID:      episode.UserID,
+		Name:        "shot",
+		ImageFileID: createTestImageFile(t, episode.UserID, "image/png"),
+		Status:      status,
+		SortOrder:   sortOrder,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := database.CreateReviewStoryboard(sb); err != nil {
+		t.Fatal(err)
+	}
+	return sb
+}
+
+func TestListReviewStoryboardsShapeWithStatusFilter(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Get("/episodes/:episodeId/storyboards", ListReviewStoryboards)
+
+	episode := createTestEpisode(t, testUser.ID)
+	createTestStoryboard(t, episode, models.StoryboardStatusRejected, 2)
+	createTestStoryboard(t, episode, models.StoryboardStatusPending, 1)
+	createTestStoryboard(t, episode, models.StoryboardStatusRejected, 0)
+
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", 3},
+		{"?status=rejected", 2},
+		{"?status=approved", 0},
+	} {
+		req := httptest.NewRequest("GET", "/episodes/"+episode.ID+"/storyboards"+tt.query, nil)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Total-Count"); got != strconv.Itoa(tt.want) {
+			t.Errorf("%q: X-Total-Count = %q, want %d", tt.query, got, tt.want)
+		}
+
+		// Unfiltered lists stay a bare array; a status filter answers with {items, total}
+		var items []models.ReviewStoryboardResponse
+		if tt.query == "" {
+			if code := doJSON(t, app, "GET", "/episodes/"+episode.ID+"/storyboards", nil, &items); code != 200 {
+				t.Fatalf("%q: status = %d", tt.query, code)
+			}
+		} else {
+			var page struct {
+				Items []models.ReviewStoryboardResponse `json:"items"`
+				Total *int                              `json:"total"`
+			}
+			if code := doJSON(t, app, "GET", "/episodes/"+episode.ID+"/storyboards"+tt.query, nil, &page); code != 200 {
+				t.Fatalf("%q: status = %d", tt.query, code)
+			}
+			if page.Items == nil || page.Total == nil || *page.Total != tt.want {
+				t.Fatalf("%q: got items=%v total=%v, want {items, total: %d}", tt.query, page.Items, page.Total, tt.want)
+			}
+			items = page.Items
+		}
+		if len(items) != tt.want {
+			t.Fatalf("%q: got %d items, want %d", tt.query, len(items), tt.want)
+		}
+		for i := 1; i < len(items); i++ {
+			if items[i-1].SortOrder > items[i].SortOrder {
+				t.Errorf("%q: items not in sortOrder", tt.query)
+			}
+		}
+	}
+
+	if code := doJSON(t, app, "GET", "/episodes/"+episode.ID+"/storyboards?status=bogus", nil, nil); code != 400 {
+		t.Errorf("invalid status: status = %d, want 400", code)
+	}
+}
+
+func TestCreateReviewStoryboardEmptyName(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Post("/episodes/:episodeId/storyboards", CreateReviewStoryboard)
+	episode := createTestEpisode(t, testUser.ID)
+
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"", "shot-01.png", "shot-01"},
+		{"   ", "shot-02.png", "shot-02"},
+		{"", ".png", untitledStoryboardName},
+		{" Hero ", "shot-03.png", "Hero"},
+	}
+	for _, tt := range tests {
+		req := newMultipartRequest(t, "POST", "/episodes/"+episode.ID+"/storyboards",
+			map[string]string{"name": tt.name}, "image", tt.filename, "image/png", testPNG(t, 8, 8))
+		var sb models.ReviewStoryboardResponse
+		if code := doRequest(t, app, req, &sb); code != 200 {
+			t.Fatalf("name=%q file=%q: status = %d", tt.name, tt.filename, code)
+		}
+		if sb.Name != tt.want {
+			t.Errorf("name=%q file=%q: stored name %q, want %q", tt.name, tt.filename, sb.Name, tt.want)
+		}
+	}
+}
+
+func TestUpdateReviewStoryboardEmptyName(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Put("/storyboards/:id", UpdateReviewStoryboard)
+	episode := createTestEpisode(t, testUser.ID)
+
+	named := createTestStoryboard(t, episode, models.StoryboardStatusPending, 0)
+	unnamed := createTestStoryboard(t, episode, models.StoryboardStatusPending, 1)
+	if err := database.UpdateReviewStoryboard(unnamed.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc string
+		id   string
+		req  func(target string) *http.Request
+		want string
+	}{
+		{"multipart empty name keeps the old name", named.ID, func(target string) *http.Request {
+			return newMultipartRequest(t, "PUT", target, map[string]string{"name": ""}, "", "", "", nil)
+		}, "shot"},
+		{"json blank name keeps the old name", named.ID, func(target string) *http.Request {
+			req := httptest.NewRequest("PUT", target, strings.NewReader(`{"name":"   "}`))
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}, "shot"},
+		{"blank name without an old name", unnamed.ID, func(target string) *http.Request {
+			return newMultipartRequest(t, "PUT", target, map[string]string{"name": " "}, "", "", "", nil)
+		}, untitledStoryboardName},
+	}
+	for _, tt := range tests {
+		var sb models.ReviewStoryboard
+		if code := doRequest(t, app, tt.req("/storyboards/"+tt.id), &sb); code != 200 {
+			t.Fatalf("%s: status = %d", tt.desc, code)
+		}
+		if sb.Name != tt.want {
+			t.Errorf("%s: name = %q, want %q", tt.desc, sb.Name, tt.want)
+		}
+	}
+}
+
+func TestUpdateReviewStoryboardRemovesReplacedImage(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Put("/storyboards/:id", UpdateReviewStoryboard)
+	episode := createTestEpisode(t, testUser.ID)
+
+	replace := func(sb *models.ReviewStoryboard) *models.ReviewStoryboard {
+		t.Helper()
+		req := newMultipartRequest(t, "PUT", "/storyboards/"+sb.ID, nil, "image", "new.png", "image/png", testPNG(t, 8, 8))
+		var updated models.ReviewStoryboard
+		if code := doRequest(t, app, req, &updated); code != 200 {
+			t.Fatalf("status = %d", code)
+		}
+		if updated.ImageFileID == "" || updated.ImageFileID == sb.ImageFileID {
+			t.Fatalf("imageFileId = %q, want a new file", updated.ImageFileID)
+		}
+		return &updated
+	}
+
+	// Sole user of the old image: row and file on disk are removed
+	sb := createTestStoryboard(t, episode, models.StoryboardStatusPending, 0)
+	old, _ := database.GetFileByID(sb.ImageFileID)
+	replace(sb)
+	if f, _ := database.GetFileByID(old.ID); f != nil {
+		t.Error("replaced image row still exists")
+	}
+	if _, err := os.Stat(old.Path); !os.IsNotExist(err) {
+		t.Errorf("replaced image still on disk: %v", err)
+	}
+
+	// Old image still used as a project cover: kept
+	shared := createTestStoryboard(t, episode, models.StoryboardStatusPending, 1)
+	sharedFile, _ := database.GetFileByID(shared.ImageFileID)
+	now := models.Now()
+	project := &models.ReviewProject{ID: uuid.New().String(), UserID: testUser.ID, Name: "p", CoverFileID: shared.ImageFileID, CreatedAt: now, UpdatedAt: now}
+	if err := database.CreateReviewProject(project); err != nil {
+		t.Fatal(err)
+	}
+	replace(shared)
+	if f, _ := database.GetFileByID(sharedFile.ID); f == nil {
+		t.Error("image still used as a cover was deleted")
+	}
+	if _, err := os.Stat(sharedFile.Path); err != nil {
+		t.Errorf("image still used as a cover removed from disk: %v", err)
+	}
+}
+
+func TestReorderStoryboardsAcrossEpisodes(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Put("/storyboards/reorder", ReorderStoryboards)
+
+	ep1 := createTestEpisode(t, testUser.ID)
+	ep2 := createTestEpisode(t, testUser.ID)
+	a := createTestStoryboard(t, ep1, models.StoryboardStatusPending, 0)
+	b := createTestStoryboard(t, ep1, models.StoryboardStatusPending, 1)
+	x := createTestStoryboard(t, ep2, models.StoryboardStatusPending, 0)
+
+	sortOrders := func() []int {
+		var orders []int
+		for _, id := range []string{a.ID, b.ID, x.ID} {
+			sb, _ := database.GetReviewStoryboard(id)
+			orders = append(orders, sb.SortOrder)
+		}
+		return orders
+	}
+	before := sortOrders()
+
+	for _, ids := range [][]string{{b.ID, x.ID, a.ID}, {x.ID, a.ID}} {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if code := doJSON(t, app, "PUT", "/storyboards/reorder", fiber.Map{"storyboardIds": ids}, &resp); code != 400 || resp.Error != "只能对同一单集下的分镜排序" {
+			t.Errorf("%v: status = %d, error = %q, want 400 same-episode error", ids, code, resp.Error)
+		}
+	}
+	if got := sortOrders(); !reflect.DeepEqual(got, before) {
+		t.Errorf("sort orders changed by a rejected reorder: %v -> %v", before, got)
+	}
+
+	if code := doJSON(t, app, "PUT", "/storyboards/reorder", fiber.Map{"storyboardIds": []string{b.ID, a.ID}}, nil); code != 200 {
+		t.Fatalf("same-episode reorder: status = %d", code)
+	}
+	sa, _ := database.GetReviewStoryboard(a.ID)
+	sb, _ := database.GetReviewStoryboard(b.ID)
+	if sb.SortOrder >= sa.SortOrder {
+		t.Errorf("after reorder b=%d a=%d, want b before a", sb.SortOrder, sa.SortOrder)
+	}
+}
+
+func TestReorderEpisodesAcrossProjects(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Put("/episodes/reorder", ReorderEpisodes)
+
+	first := createTestEpisode(t, testUser.ID)
+	now := models.Now()
+	second := &models.ReviewEpisode{ID: uuid.New().String(), ProjectID: first.ProjectID, UserID: testUser.ID, Name: "second", SortOrder: 1, CreatedAt: now, UpdatedAt: now}
+	if err := database.CreateReviewEpisode(second); err != nil {
+		t.Fatal(err)
+	}
+	elsewhere := createTestEpisode(t, testUser.ID)
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if code := doJSON(t, app, "PUT", "/episodes/reorder", fiber.Map{"episodeIds": []string{second.ID, elsewhere.ID, first.ID}}, &resp); code != 400 || resp.Error != "只能对同一项目下的单集排序" {
+		t.Errorf("cross-project: status = %d, error = %q, want 400 same-project error", code, resp.Error)
+	}
+	if ep, _ := database.GetReviewEpisode(elsewhere.ID); ep.ProjectID != elsewhere.ProjectID || ep.SortOrder != elsewhere.SortOrder {
+		t.Errorf("episode in the other project changed: %+v", ep)
+	}
+
+	if code := doJSON(t, app, "PUT", "/episodes/reorder", fiber.Map{"episodeIds": []string{second.ID, first.ID}}, nil); code != 200 {
+		t.Fatalf("same-project reorder: status = %d", code)
+	}
+	e1, _ := database.GetReviewEpisode(first.ID)
+	e2, _ := database.GetReviewEpisode(second.ID)
+	if e2.SortOrder >= e1.SortOrder {
+		t.Errorf("after reorder second=%d first=%d, want second before first", e2.SortOrder, e1.SortOrder)
+	}
+}
+
+func TestReviewStoryboardStatusValidation(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp(testUser)
+	app.Patch("/storyboards/:id/status", ReviewStoryboard)
+	episode := createTestEpisode(t, testUser.ID)
+	sb := createTestStoryboard(t, episode, models.StoryboardStatusPending, 0)
+
+	tests := []struct {
+		body    fiber.Map
+		want    int
+		wantErr string
+	}{
+		{fiber.Map{"status": "done"}, 400, "无效的审阅状态"},
+		{fiber.Map{"status": "APPROVED"}, 400, "无效的审阅状态"},
+		{fiber.Map{"status": ""}, 400, "无效的审阅状态"},
+		{fiber.Map{}, 400, "无效的审阅状态"},
+		{fiber.Map{"status": "rejected"}, 400, "未通过时必须填写修改建议"},
+		{fiber.Map{"status": "approved"}, 200, ""},
+		{fiber.Map{"status": "rejected", "feedback": "too dark"}, 200, ""},
+		{fiber.Map{"status": "pending"}, 200, ""},
+	}
+	for _, tt := range tests {
+		before, _ := database.GetReviewStoryboard(sb.ID)
+		var resp struct {
+			Error string `json:"error"`
+		}
+		code := doJSON(t, app, "PATCH", "/storyboards/"+sb.ID+"/status", tt.body, &resp)
+		if code != tt.want || resp.Error != tt.wantErr {
+			t.Errorf("%v: status = %d, error = %q, want %d %q", tt.body, code, resp.Error, tt.want, tt.wantErr)
+		}
+		after, _ := database.GetReviewStoryboard(sb.ID)
+		if tt.want == 200 && after.Status != tt.body["status"] {
+			t.Errorf("%v: stored status = %q", tt.body, after.Status)
+		}
+		if tt.want != 200 && after.Status != before.Status {
+			t.Errorf("%v: rejected update changed status %q -> %q", tt.body, before.Status, after.Status)
+		}
+	}
+}
+
+func TestReviewCoverDimensionsRejected(t *testing.T) {
+	setupTestDB(t)
+	cfg.UploadMaxWidth, cfg.UploadMaxHeight, cfg.UploadDownscale = 32, 32, false
+	app := newTestApp(testUser)
+	app.Post("/projects", CreateReviewProject)
+	app.Put("/projects/:id", UpdateReviewProject)
+	app.Put("/episodes/:id", UpdateReviewEpisode)
+	episode := createTestEpisode(t, testUser.ID)
+
+	for _, target := range []string{"POST /projects", "PUT /projects/" + episode.ProjectID, "PUT /episodes/" + episode.ID} {
+		method, path, _ := strings.Cut(target, " ")
+		req := newMultipartRequest(t, method, path, map[string]string{"name": "cover"}, "cover", "cover.png", "image/png", testPNG(t, 64, 64))
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if code := doRequest(t, app, req, &resp); code != 400 || !strings.HasPrefix(resp.Error, "图片尺寸 64x64") {
+			t.Errorf("%s: status = %d, error = %q, want 400 with the dimension message", target, code, resp.Error)
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package jobs
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -14,20 +21,30 @@ import (
 	"nano-backend/internal/config"
 	"nano-backend/internal/crypto"
 	"nano-backend/internal/database"
+	"nano-backend/internal/fileutil"
 	"nano-backend/internal/gemini"
 	"nano-backend/internal/grsai"
 	"nano-backend/internal/handlers"
 	"nano-backend/internal/models"
+	"nano-backend/internal/openai"
 )
 
 var (
 	cfg        *config.Config
-	activeJobs sync.Map // map[generationID]bool
+	activeJobs sync.Map // map[generationID]context.CancelFunc
+
+	// runnerCtx is canceled on shutdown so in-flight provider calls are interrupted
+	runnerCtx    context.Context
+	runnerCancel context.CancelFunc
+
+	// runJob processes one claimed generation; tests replace it
+	runJob = runGeneration
 )
 
 // StartJobRunner starts the background job runner
 func StartJobRunner(c *config.Config) {
 	cfg = c
+	runnerCtx, runnerCancel = context.WithCancel(context.Background())
 
 	// Run immediately
 	go tick()
@@ -35,14 +52,49 @@ func StartJobRunner(c *config.Config) {
 	// Run every 3 seconds
 	ticker := time.NewTicker(3 * time.Second)
 	go func() {
-		for range ticker.C {
-			tick()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runnerCtx.Done():
+				return
+			case <-ticker.C:
+				tick()
+			}
 		}
 	}()
 
 	log.Printf("[jobs] Job runner started")
 }
 
+// StopJobRunner stops picking up new jobs and cancels in-flight provider calls.
+// Interrupted generations stay queued/running and are resumed on next start.
+func StopJobRunner() {
+	if runnerCancel != nil {
+		runnerCancel()
+		log.Printf("[jobs] Job runner stopped")
+	}
+}
+
+// CancelGeneration interrupts an in-flight generation, returning false if it isn't running
+func CancelGeneration(generationID string) bool {
+	cancel, ok := activeJobs.Load(generationID)
+	if !ok {
+		return false
+	}
+	cancel.(context.CancelFunc)()
+	return true
+}
+
+// ActiveGenerationIDs lists the generations currently being processed by this runner
+func ActiveGenerationIDs() []string {
+	var ids []string
+	activeJobs.Range(func(key, _ any) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	return ids
+}
+
 func tick() {
 	generations, err := database.GetPendingGenerations()
 	if err != nil {
@@ -57,18 +109,34 @@ func tick() {
 		}
 
 		// Mark as active and process
-		activeJobs.Store(g.ID, true)
+		ctx, cancel := context.WithCancel(runnerCtx)
+		activeJobs.Store(g.ID, cancel)
 		go func(gen models.Generation) {
 			defer activeJobs.Delete(gen.ID)
-			if err := runGeneration(&gen); err != nil {
+			defer cancel()
+			// Contain panics to this job; runs before the active marker is removed so the
+			// generation is already failed when the next tick could pick it up again
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[jobs] Panic running generation %s: %v\n%s", gen.ID, r, debug.Stack())
+					if err := updateFailed(gen.ID, "生成任务内部错误"); err != nil {
+						log.Printf("[jobs] Error marking generation %s failed after panic: %v", gen.ID, err)
+					}
+				}
+			}()
+			if err := runJob(ctx, &gen); err != nil {
 				log.Printf("[jobs] Error running generation %s: %v", gen.ID, err)
 			}
 		}(g)
 	}
 }
 
-func runGeneration(g *models.Generation) error {
-	log.Printf("[jobs] Starting generation %s (type=%s, model=%s)", g.ID, g.Type, g.Model)
+func runGeneration(ctx context.Context, g *models.Generation) error {
+	requestID := ""
+	if g.RequestID != nil {
+		requestID = *g.RequestID
+	}
+	log.Printf("[jobs] Starting generation %s (type=%s, model=%s, req=%s)", g.ID, g.Type, g.Model, requestID)
 
 	// Update status to running
 	updates := map[string]interface{}{
@@ -77,12 +145,15 @@ func runGeneration(g *models.Generation) error {
 	if g.StartedAt == nil || *g.StartedAt == 0 {
 		updates["startedAt"] = models.Now()
 	}
-	if err := database.UpdateGeneration(g.ID, updates); err != nil {
+	if err := database.ClaimGeneration(g.ID, updates); err == sql.ErrNoRows {
+		log.Printf("[jobs] Generation %s was canceled before it started", g.ID)
+		return nil
+	} else if err != nil {
 		return err
 	}
 
 	// Get provider credentials
-	providerHost, apiKey, err := getEffectiveProvider(g.UserID)
+	providerHost, providerType, apiKey, err := resolveGenerationProvider(g)
 	if err != nil {
 		return updateFailedWithCode(g.ID, err.Error(), models.ErrorCodeAPIError)
 	}
@@ -90,15 +161,40 @@ func runGeneration(g *models.Generation) error {
 	timeoutSeconds := resolveJobTimeoutSeconds(g.Type)
 	log.Printf("[jobs] Using timeoutSeconds=%d for generation %s (type=%s)", timeoutSeconds, g.ID, g.Type)
 
+	switch resolveProviderType(providerHost, providerType) {
+	case models.ProviderTypeOpenAI:
+		return runOpenAIGeneration(ctx, g, providerHost, apiKey, timeoutSeconds)
+	case models.ProviderTypeGemini:
+		return runGeminiGeneration(ctx, g, providerHost, apiKey, timeoutSeconds)
+	default:
+		return runGRSAIGeneration(ctx, g, providerHost, apiKey, timeoutSeconds)
+	}
+}
+
+// resolveProviderType returns the explicitly configured provider type, or infers it from the host
+func resolveProviderType(providerHost, providerType string) string {
+	if providerType != models.ProviderTypeAuto {
+		return providerType
+	}
+
 	// Check if using Gemini API (including modelverse.cn)
 	isGeminiAPI := strings.Contains(providerHost, "yunwu.ai") || strings.Contains(providerHost, "gemini") || strings.Contains(providerHost, "google") || strings.Contains(providerHost, "modelverse.cn")
-
 	if isGeminiAPI {
-		return runGeminiGeneration(g, providerHost, apiKey, timeoutSeconds)
+		return models.ProviderTypeGemini
 	}
 
 	// Use GRS AI API
-	return runGRSAIGeneration(g, providerHost, apiKey, timeoutSeconds)
+	return models.ProviderTypeGRSAI
+}
+
+// sleepContext waits for d, returning early with the context's error if it is canceled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
 }
 
 func updateFailed(generationID, errMsg string) error {
@@ -122,6 +218,64 @@ func updateFailedWithCode(generationID, errMsg string, errorCode models.Generati
 	return database.UpdateGeneration(generationID, updates)
 }
 
+// providerErrorCode classifies a provider failure by its HTTP status when one is available,
+// falling back to sniffing the message
+func providerErrorCode(err error) models.GenerationErrorCode {
+	code := identifyErrorCode(err.Error())
+
+	if code == models.ErrorCodeInsufficientQuota {
+		return code
+	}
+
+	var respErr *grsai.ResponseError
+	if errors.As(err, &respErr) {
+		return responseErrorCode(respErr, code)
+	}
+	if errors.Is(err, grsai.ErrMalformedResponse) {
+		return models.ErrorCodeAPIError
+	}
+
+	var statusCode int
+	var retryable bool
+	var grsaiErr *grsai.APIError
+	var openaiErr *openai.APIError
+	switch {
+	case errors.As(err, &grsaiErr):
+		statusCode, retryable = grsaiErr.StatusCode, grsaiErr.Retryable()
+	case errors.As(err, &openaiErr):
+		statusCode, retryable = openaiErr.StatusCode, openaiErr.Retryable()
+	default:
+		return code
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return models.ErrorCodeInvalidAPIKey
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return models.ErrorCodeTimeout
+	case retryable:
+		return models.ErrorCodeAPIError
+	case statusCode >= 400:
+		return models.ErrorCodeInvalidRequest
+	}
+	return code
+}
+
+// responseErrorCode classifies an error reported inside a 2xx body. Gateways often put a
+// machine-readable code such as "insufficient_quota" next to the message, so check that first.
+func responseErrorCode(err *grsai.ResponseError, fromMessage models.GenerationErrorCode) models.GenerationErrorCode {
+	lowerCode := strings.ToLower(err.Code)
+	switch {
+	case strings.Contains(lowerCode, "quota") || strings.Contains(lowerCode, "balance"):
+		return models.ErrorCodeInsufficientQuota
+	case strings.Contains(lowerCode, "api_key") || strings.Contains(lowerCode, "auth"):
+		return models.ErrorCodeInvalidAPIKey
+	case fromMessage != models.ErrorCodeUnknown:
+		return fromMessage
+	}
+	return models.ErrorCodeAPIError
+}
+
 func identifyErrorCode(errMsg string) models.GenerationErrorCode {
 	lowerMsg := strings.ToLower(errMsg)
 
@@ -204,49 +358,168 @@ func resolveJobTimeoutSeconds(genType string) int {
 	return timeoutSeconds
 }
 
-func getEffectiveProvider(userID string) (string, string, error) {
-	provider, err := database.GetUserProvider(userID)
-	if err != nil {
-		return "", "", err
+// resolveGenerationProvider uses the provider given with the request (inline or a saved profile)
+// when the generation carries one, and the user's effective provider otherwise
+func resolveGenerationProvider(g *models.Generation) (string, string, crypto.SecretString, error) {
+	if g.ProviderProfileID != nil && *g.ProviderProfileID != "" {
+		profile, err := database.GetProviderProfile(g.UserID, *g.ProviderProfileID)
+		if err != nil {
+			return "", "", "", err
+		}
+		if profile == nil {
+			return "", "", "", fmt.Errorf("所选服务商配置已被删除")
+		}
+		return database.ProfileProvider(profile, cfg)
+	}
+	if g.ProviderKeyEnc == nil {
+		return database.GetEffectiveProvider(g.UserID, cfg)
+	}
+	if *g.ProviderKeyEnc == "" {
+		// 任务结束时已清除本次请求的密钥，不能改用用户的默认服务商
+		return "", "", "", fmt.Errorf("本次请求指定的接口密钥已清除")
+	}
+
+	decrypted, err := crypto.DecryptText(*g.ProviderKeyEnc, cfg.APIKeyEncryptionSecret)
+	if err != nil || decrypted == "" {
+		return "", "", "", fmt.Errorf("本次请求指定的接口密钥无效")
 	}
 
 	host := cfg.DefaultProviderHost
-	apiKey := cfg.DefaultProviderAPIKey
-
-	if provider != nil {
-		host = provider.ProviderHost
-		if provider.APIKeyEnc != "" {
-			decrypted, err := crypto.DecryptText(provider.APIKeyEnc, cfg.APIKeyEncryptionSecret)
-			if err == nil && decrypted != "" {
-				apiKey = decrypted
-			}
+	providerType := models.ProviderTypeAuto
+	if g.ProviderHost == nil {
+		// 只覆盖了密钥时沿用用户保存的服务地址
+		provider, err := database.GetUserProvider(g.UserID)
+		if err != nil {
+			return "", "", "", err
+		}
+		if provider != nil {
+			host = provider.ProviderHost
+			providerType = provider.ProviderType
 		}
+	} else {
+		host = *g.ProviderHost
+	}
+	if g.ProviderType != nil {
+		providerType = *g.ProviderType
 	}
 
-	if apiKey == "" {
-		return "", "", fmt.Errorf("未配置接口密钥，请在接口设置中填写。")
+	return host, providerType, crypto.SecretString(decrypted), nil
+}
+
+// downloadMaxAttempts bounds how many times an interrupted download is resumed
+const downloadMaxAttempts = 3
+
+// downloadTimeout is the per-attempt HTTP timeout for fetching results, independent of the
+// generation timeout so a hung transfer doesn't hold a job slot for the whole generation window
+func downloadTimeout() time.Duration {
+	if cfg.DownloadTimeoutSeconds > 0 {
+		return time.Duration(cfg.DownloadTimeoutSeconds) * time.Second
+	}
+	return 120 * time.Second
+}
+
+// maxRemoteFileBytes caps a single downloaded provider result
+const maxRemoteFileBytes = 1 << 30
+
+// errNonMediaContent means the result URL served something other than an image or video
+var errNonMediaContent = errors.New("服务商返回的结果不是图片或视频")
+
+// downloadAuth carries the provider's API key for result URLs that require it; nil means anonymous downloads
+type downloadAuth struct {
+	host   string
+	apiKey crypto.SecretString
+}
+
+// newDownloadAuth returns the credentials to forward on result downloads, or nil when the
+// provider type hasn't opted in via DOWNLOAD_AUTH_PROVIDERS
+func newDownloadAuth(providerHost, providerType string, apiKey crypto.SecretString) *downloadAuth {
+	if !cfg.ForwardsDownloadAuth(providerType) {
+		return nil
 	}
+	parsed, err := neturl.Parse(providerHost)
+	if err != nil || parsed.Hostname() == "" {
+		return nil
+	}
+	return &downloadAuth{host: parsed.Hostname(), apiKey: apiKey}
+}
 
-	return host, apiKey, nil
+// apply adds the bearer token only when the request goes to the provider's own host,
+// so the key never leaks to third-party storage URLs
+func (a *downloadAuth) apply(req *http.Request) {
+	if a == nil || !strings.EqualFold(req.URL.Hostname(), a.host) {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+a.apiKey.Reveal())
 }
 
-func fetchAndStoreRemoteFile(userID, purpose, url string, persistent bool, timeoutSeconds int) (*models.File, error) {
+func fetchAndStoreRemoteFile(ctx context.Context, userID, purpose, url string, persistent bool, outputFormat *string, auth *downloadAuth) (*models.File, error) {
 	log.Printf("[jobs] Fetching remote file: %s", url)
 
-	// 增加下载文件的超时时间，支持大文件和多任务并发
-	timeout := 120 * time.Second
-	if timeoutSeconds > 0 {
-		timeout = time.Duration(timeoutSeconds) * time.Second
+	rawBody, mimeType, err := openRemoteFile(ctx, url, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer rawBody.Close()
+
+	// 按文件头核对内容类型，避免把服务商的错误页当作结果保存
+	body := bufio.NewReader(rawBody)
+	head, err := body.Peek(12)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	sniffed := handlers.DetectMimeType(head)
+	if !strings.HasPrefix(sniffed, "image/") && !strings.HasPrefix(sniffed, "video/") {
+		log.Printf("[jobs] Rejecting non-media result from %s (Content-Type=%s, head=%q)", url, mimeType, head)
+		return nil, errNonMediaContent
+	}
+	if sniffed != mimeType {
+		log.Printf("[jobs] Content-Type mismatch for %s: header=%s, sniffed=%s; using sniffed", url, mimeType, sniffed)
+		mimeType = sniffed
+	}
+
+	// 需要转码的图片体积有限，仍在内存中处理；其余直接流式写盘
+	if wantsTranscode(mimeType, outputFormat) {
+		buf, err := io.ReadAll(io.LimitReader(body, maxRemoteFileBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > maxRemoteFileBytes {
+			return nil, fmt.Errorf("文件超过大小上限 (%d 字节)", maxRemoteFileBytes)
+		}
+		log.Printf("[jobs] Downloaded %d bytes, mimeType=%s", len(buf), mimeType)
+		buf, mimeType = applyOutputFormat(buf, mimeType, outputFormat)
+		return handlers.SaveBufferToFile(userID, purpose, mimeType, "", buf, persistent)
 	}
-	client := &http.Client{Timeout: timeout}
-	resp, err := client.Get(url)
+
+	file, sum, err := handlers.SaveReaderToFile(userID, purpose, mimeType, "", body, maxRemoteFileBytes, persistent)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	log.Printf("[jobs] Stored remote file %s, mimeType=%s, sha256=%s", file.ID, mimeType, sum)
+	return file, nil
+}
 
+// openRemoteFile GETs url and returns a body that transparently resumes with a Range request
+// if the transfer is cut off midway and the server accepts ranges
+func openRemoteFile(ctx context.Context, url string, auth *downloadAuth) (io.ReadCloser, string, error) {
+	client := &http.Client{Timeout: downloadTimeout()}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	auth.apply(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("下载远程文件失败：HTTP %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("下载远程文件失败：HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxRemoteFileBytes {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("文件超过大小上限 (%d 字节)", maxRemoteFileBytes)
 	}
 
 	mimeType := resp.Header.Get("Content-Type")
@@ -254,39 +527,118 @@ func fetchAndStoreRemoteFile(userID, purpose, url string, persistent bool, timeo
 		mimeType = "application/octet-stream"
 	}
 
-	buf, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	return &resumableBody{
+		ctx:      ctx,
+		client:   client,
+		url:      url,
+		auth:     auth,
+		body:     resp.Body,
+		rangeOK:  resp.Header.Get("Accept-Ranges") == "bytes",
+		attempts: 1,
+	}, mimeType, nil
+}
+
+// resumableBody reads a download, reopening it from the current offset after a read error
+type resumableBody struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	auth     *downloadAuth
+	body     io.ReadCloser
+	offset   int64
+	rangeOK  bool
+	attempts int
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	if err == nil || err == io.EOF || !b.rangeOK || b.ctx.Err() != nil || b.attempts >= downloadMaxAttempts {
+		return n, err
 	}
 
-	log.Printf("[jobs] Downloaded %d bytes, mimeType=%s", len(buf), mimeType)
+	log.Printf("[jobs] Download interrupted after %d bytes, resuming (attempt %d): %v", b.offset, b.attempts+1, err)
+	if resumeErr := b.resume(); resumeErr != nil {
+		log.Printf("[jobs] Resume failed: %v", resumeErr)
+		return n, err
+	}
+	return n, nil
+}
+
+func (b *resumableBody) resume() error {
+	b.attempts++
+	req, err := http.NewRequestWithContext(b.ctx, "GET", b.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	b.auth.apply(req)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// 已写出的字节无法回退，服务器不支持续传时只能放弃
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	b.body.Close()
+	b.body = resp.Body
+	return nil
+}
 
-	return handlers.SaveBufferToFile(userID, purpose, mimeType, "", buf, persistent)
+func (b *resumableBody) Close() error {
+	return b.body.Close()
 }
 
-// fileToBase64Data 读取文件并转换为base64 data URL格式
-func fileToBase64Data(fileID string) (string, error) {
+// readReferenceFile loads a reference image for sending to a provider, shrinking it to
+// REFERENCE_MAX_EDGE when configured. The stored file is left untouched.
+func readReferenceFile(fileID string) ([]byte, string, error) {
 	file, err := database.GetFileByID(fileID)
 	if err != nil || file == nil {
-		return "", fmt.Errorf("文件不存在: %s", fileID)
+		return nil, "", fmt.Errorf("文件不存在: %s", fileID)
 	}
 
-	// 读取文件内容
 	buf, err := os.ReadFile(file.Path)
 	if err != nil {
-		return "", fmt.Errorf("读取文件失败: %w", err)
+		return nil, "", fmt.Errorf("读取文件失败: %w", err)
+	}
+
+	if edge := cfg.ReferenceMaxEdge; edge > 0 && strings.HasPrefix(file.MimeType, "image/") {
+		resized, mimeType, err := fileutil.FitImage(buf, file.MimeType, edge, edge, true)
+		if err != nil {
+			// Fall back to the original rather than dropping the reference
+			log.Printf("[jobs] Error downscaling reference %s: %v", fileID, err)
+			return buf, file.MimeType, nil
+		}
+		if len(resized) != len(buf) {
+			log.Printf("[jobs] Downscaled reference %s to max edge %d (%d -> %d bytes)", fileID, edge, len(buf), len(resized))
+		}
+		return resized, mimeType, nil
+	}
+	return buf, file.MimeType, nil
+}
+
+// fileToBase64Data 读取文件并转换为base64 data URL格式
+func fileToBase64Data(fileID string) (string, error) {
+	buf, mimeType, err := readReferenceFile(fileID)
+	if err != nil {
+		return "", err
 	}
 
 	// 转换为base64 data URL格式
 	base64Str := base64.StdEncoding.EncodeToString(buf)
-	dataURL := fmt.Sprintf("data:%s;base64,%s", file.MimeType, base64Str)
+	dataURL := fmt.Sprintf("data:%s;base64,%s", mimeType, base64Str)
 
 	return dataURL, nil
 }
 
 // runGRSAIGeneration handles GRS AI API generation
-func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeoutSeconds int) error {
+func runGRSAIGeneration(ctx context.Context, g *models.Generation, providerHost string, apiKey crypto.SecretString, timeoutSeconds int) error {
 	client := grsai.NewClient(providerHost, apiKey, time.Duration(timeoutSeconds)*time.Second)
+	if cfg.ReportsFractionProgress(providerHost) {
+		client.ProgressScale = 1
+	}
 
 	// Build reference URLs - 将文件转为base64传给API
 	refURLs := make([]string, 0)
@@ -317,7 +669,12 @@ func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeo
 				imageSize = *g.ImageSize
 			}
 
-			taskResp, err = client.CreateNanoBananaTask(g.Model, g.Prompt, aspectRatio, imageSize, refURLs)
+			outputFormat := ""
+			if g.OutputFormat != nil {
+				outputFormat = *g.OutputFormat
+			}
+
+			taskResp, err = client.CreateNanoBananaTask(ctx, g.Model, g.Prompt, aspectRatio, imageSize, outputFormat, refURLs)
 		} else if g.Type == "video" {
 			aspectRatio := "9:16"
 			if g.AspectRatio != nil {
@@ -336,16 +693,19 @@ func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeo
 				refURL = refURLs[0]
 			}
 
-			taskResp, err = client.CreateSoraVideoTask(g.Model, g.Prompt, refURL, aspectRatio, duration, videoSize)
+			taskResp, err = client.CreateSoraVideoTask(ctx, g.Model, g.Prompt, refURL, aspectRatio, duration, videoSize)
 		}
 
 		if err != nil {
-			return updateFailed(g.ID, err.Error())
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return updateFailedWithCode(g.ID, err.Error(), providerErrorCode(err))
 		}
 
 		// Check if task completed immediately
 		if taskResp.Finished && taskResp.Result != nil {
-			return handleGRSAISucceeded(g.ID, g.UserID, taskResp.Result, timeoutSeconds)
+			return handleGRSAISucceeded(ctx, g, taskResp.Result, newDownloadAuth(providerHost, models.ProviderTypeGRSAI, apiKey))
 		}
 
 		// Save provider task ID
@@ -388,8 +748,17 @@ func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeo
 		}
 
 		// Query result
-		result, err := client.GetTaskResult(*latest.ProviderTaskID)
+		result, err := client.GetTaskResult(ctx, *latest.ProviderTaskID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
+			// Client errors (bad task id, invalid key...) won't fix themselves by polling
+			var apiErr *grsai.APIError
+			if errors.As(err, &apiErr) && !apiErr.Retryable() {
+				return updateFailedWithCode(g.ID, err.Error(), providerErrorCode(err))
+			}
+
 			// Transient error, log every 10 attempts
 			if attempts%10 == 0 {
 				log.Printf("[jobs] Error querying task result (attempt %d): %v", attempts, err)
@@ -397,7 +766,9 @@ func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeo
 					"error": err.Error(),
 				})
 			}
-			time.Sleep(2 * time.Second)
+			if err := sleepContext(ctx, 2*time.Second); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -410,7 +781,7 @@ func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeo
 
 		// Check status
 		if result.Status == "succeeded" {
-			return handleGRSAISucceeded(g.ID, g.UserID, result, timeoutSeconds)
+			return handleGRSAISucceeded(ctx, g, result, newDownloadAuth(providerHost, models.ProviderTypeGRSAI, apiKey))
 		}
 
 		if result.Status == "failed" {
@@ -423,25 +794,33 @@ func runGRSAIGeneration(g *models.Generation, providerHost, apiKey string, timeo
 			return updateFailed(g.ID, errMsg)
 		}
 
-		time.Sleep(2 * time.Second)
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
 	}
 
 	return updateFailedWithCode(g.ID, "等待结果超时", models.ErrorCodeTimeout)
 }
 
 // handleGRSAISucceeded handles successful GRS AI generation
-func handleGRSAISucceeded(generationID, userID string, result *grsai.TaskResult, timeoutSeconds int) error {
+func handleGRSAISucceeded(ctx context.Context, g *models.Generation, result *grsai.TaskResult, auth *downloadAuth) error {
 	url := grsai.ExtractFirstResultURL(result)
 	if url == "" {
-		return updateFailedWithCode(generationID, "未返回结果地址", models.ErrorCodeAPIError)
+		return updateFailedWithCode(g.ID, "未返回结果地址", models.ErrorCodeAPIError)
 	}
 
 	log.Printf("[jobs] Downloading result from: %s", url)
 
 	// Download and store the file
-	file, err := fetchAndStoreRemoteFile(userID, "generation-output", url, false, timeoutSeconds)
+	file, err := fetchAndStoreRemoteFile(ctx, g.UserID, "generation-output", url, false, g.OutputFormat, auth)
 	if err != nil {
-		return updateFailedWithCode(generationID, "下载失败："+err.Error(), models.ErrorCodeNetworkError)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errNonMediaContent) {
+			return updateFailedWithCode(g.ID, err.Error(), models.ErrorCodeAPIError)
+		}
+		return updateFailedWithCode(g.ID, "下载失败："+err.Error(), models.ErrorCodeNetworkError)
 	}
 
 	log.Printf("[jobs] Downloaded and stored file: %s", file.ID)
@@ -452,14 +831,14 @@ func handleGRSAISucceeded(generationID, userID string, result *grsai.TaskResult,
 		"outputFileId":      file.ID,
 		"providerResultUrl": url,
 	}
-	if elapsed := resolveElapsedSeconds(generationID); elapsed != nil {
+	if elapsed := resolveElapsedSeconds(g.ID); elapsed != nil {
 		updates["elapsedSeconds"] = *elapsed
 	}
-	return database.UpdateGeneration(generationID, updates)
+	return database.UpdateGeneration(g.ID, updates)
 }
 
 // runGeminiGeneration handles Gemini 3 Pro API generation
-func runGeminiGeneration(g *models.Generation, providerHost, apiKey string, timeoutSeconds int) error {
+func runGeminiGeneration(ctx context.Context, g *models.Generation, providerHost string, apiKey crypto.SecretString, timeoutSeconds int) error {
 	// Gemini API only supports image generation
 	if g.Type != "image" {
 		return updateFailedWithCode(g.ID, "Gemini API 暂不支持视频生成", models.ErrorCodeUnsupportedFeature)
@@ -470,19 +849,13 @@ func runGeminiGeneration(g *models.Generation, providerHost, apiKey string, time
 	// Build reference images
 	referenceImages := make([]gemini.ReferenceImage, 0)
 	for _, fid := range g.ReferenceFileIDs {
-		file, err := database.GetFileByID(fid)
-		if err != nil || file == nil {
-			log.Printf("[jobs] Error getting file %s: %v", fid, err)
-			continue
-		}
-
-		buf, err := os.ReadFile(file.Path)
+		buf, mimeType, err := readReferenceFile(fid)
 		if err != nil {
 			log.Printf("[jobs] Error reading file %s: %v", fid, err)
 			continue
 		}
 
-		refImage, err := gemini.FileToReferenceImage(file.MimeType, buf)
+		refImage, err := gemini.FileToReferenceImage(mimeType, buf)
 		if err != nil {
 			log.Printf("[jobs] Error converting file %s to reference image: %v", fid, err)
 			continue
@@ -505,9 +878,12 @@ func runGeminiGeneration(g *models.Generation, providerHost, apiKey string, time
 		g.Prompt, aspectRatio, imageSize, len(referenceImages))
 
 	// Call Gemini API
-	resp, err := client.CreateImageTask(g.Prompt, aspectRatio, imageSize, referenceImages)
+	resp, err := client.CreateImageTask(ctx, g.Prompt, aspectRatio, imageSize, referenceImages)
 	if err != nil {
 		log.Printf("[jobs] Gemini API call failed: %v", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return updateFailed(g.ID, err.Error())
 	}
 
@@ -519,36 +895,34 @@ func runGeminiGeneration(g *models.Generation, providerHost, apiKey string, time
 		return updateFailedWithCode(g.ID, "未返回生成结果", models.ErrorCodeAPIError)
 	}
 
-	// Store the first image
+	// Store the first image as the primary output
 	firstImageURL := imageURLs[0]
 	log.Printf("[jobs] Got Gemini result: %s", firstImageURL)
 
-	// Parse data URL and store file
-	parts := strings.SplitN(firstImageURL, ",", 2)
-	if len(parts) != 2 {
-		return updateFailedWithCode(g.ID, "无效的图片数据格式", models.ErrorCodeInvalidRequest)
-	}
-
-	mimeType := strings.TrimPrefix(parts[0], "data:")
-	mimeType = strings.TrimSuffix(mimeType, ";base64")
-
-	base64Data := parts[1]
-	imageData, err := base64.StdEncoding.DecodeString(base64Data)
-	if err != nil {
-		return updateFailedWithCode(g.ID, "解码图片数据失败："+err.Error(), models.ErrorCodeAPIError)
-	}
-
-	file, err := handlers.SaveBufferToFile(g.UserID, "generation-output", mimeType, "", imageData, false)
+	file, err := storeDataURLImage(g.UserID, firstImageURL, g.OutputFormat)
 	if err != nil {
-		return updateFailedWithCode(g.ID, "保存图片失败："+err.Error(), models.ErrorCodeAPIError)
+		return updateFailedWithCode(g.ID, err.Error(), models.ErrorCodeAPIError)
 	}
 
 	log.Printf("[jobs] Stored Gemini result file: %s", file.ID)
 
+	// Store any additional candidates alongside it
+	outputFileIDs := []string{file.ID}
+	for i, imageURL := range imageURLs[1:] {
+		extra, err := storeDataURLImage(g.UserID, imageURL, g.OutputFormat)
+		if err != nil {
+			log.Printf("[jobs] Skipping Gemini result %d: %v", i+1, err)
+			continue
+		}
+		outputFileIDs = append(outputFileIDs, extra.ID)
+	}
+	outputFileIDsJSON, _ := json.Marshal(outputFileIDs)
+
 	updates := map[string]interface{}{
 		"status":            "succeeded",
 		"progress":          100.0,
 		"outputFileId":      file.ID,
+		"outputFileIds":     string(outputFileIDsJSON),
 		"providerResultUrl": firstImageURL,
 	}
 	if elapsed := resolveElapsedSeconds(g.ID); elapsed != nil {
@@ -556,3 +930,151 @@ func runGeminiGeneration(g *models.Generation, providerHost, apiKey string, time
 	}
 	return database.UpdateGeneration(g.ID, updates)
 }
+
+// runOpenAIGeneration handles generation through an OpenAI-compatible images endpoint
+func runOpenAIGeneration(ctx context.Context, g *models.Generation, providerHost string, apiKey crypto.SecretString, timeoutSeconds int) error {
+	if g.Type != "image" {
+		return updateFailedWithCode(g.ID, "OpenAI 兼容接口暂不支持视频生成", models.ErrorCodeUnsupportedFeature)
+	}
+
+	client := openai.NewClient(providerHost, apiKey, time.Duration(timeoutSeconds)*time.Second)
+
+	references := make([]openai.ReferenceImage, 0, len(g.ReferenceFileIDs))
+	for _, fid := range g.ReferenceFileIDs {
+		buf, mimeType, err := readReferenceFile(fid)
+		if err != nil {
+			log.Printf("[jobs] Error reading file %s: %v", fid, err)
+			continue
+		}
+		references = append(references, openai.ReferenceImage{MimeType: mimeType, Data: buf})
+	}
+
+	// The images API has a fixed set of sizes; imageSize (1K/2K/4K) has no equivalent
+	size := ""
+	if g.AspectRatio != nil {
+		size = openai.SizeForAspect(*g.AspectRatio)
+	}
+
+	resp, err := client.CreateImage(ctx, openai.ImageRequest{
+		Model:  g.Model,
+		Prompt: g.Prompt,
+		Size:   size,
+	}, references)
+	if err != nil {
+		log.Printf("[jobs] OpenAI-compatible API call failed: %v", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return updateFailedWithCode(g.ID, err.Error(), providerErrorCode(err))
+	}
+	if len(resp.Data) == 0 {
+		return updateFailedWithCode(g.ID, "未返回生成结果", models.ErrorCodeAPIError)
+	}
+
+	auth := newDownloadAuth(providerHost, models.ProviderTypeOpenAI, apiKey)
+	var outputFileIDs []string
+	providerResultURL := ""
+	for i, item := range resp.Data {
+		var file *models.File
+		var err error
+		switch {
+		case item.B64JSON != "":
+			mimeType := handlers.DetectMimeType(decodeHead(item.B64JSON))
+			if !strings.HasPrefix(mimeType, "image/") {
+				mimeType = "image/png"
+			}
+			file, err = storeDataURLImage(g.UserID, "data:"+mimeType+";base64,"+item.B64JSON, g.OutputFormat)
+		case item.URL != "":
+			if providerResultURL == "" {
+				providerResultURL = item.URL
+			}
+			file, err = fetchAndStoreRemoteFile(ctx, g.UserID, "generation-output", item.URL, false, g.OutputFormat, auth)
+		default:
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[jobs] Skipping OpenAI-compatible result %d: %v", i, err)
+			continue
+		}
+		outputFileIDs = append(outputFileIDs, file.ID)
+	}
+	if len(outputFileIDs) == 0 {
+		return updateFailedWithCode(g.ID, "保存生成结果失败", models.ErrorCodeAPIError)
+	}
+
+	log.Printf("[jobs] Stored %d OpenAI-compatible result file(s) for generation %s", len(outputFileIDs), g.ID)
+
+	outputFileIDsJSON, _ := json.Marshal(outputFileIDs)
+	updates := map[string]interface{}{
+		"status":        "succeeded",
+		"progress":      100.0,
+		"outputFileId":  outputFileIDs[0],
+		"outputFileIds": string(outputFileIDsJSON),
+	}
+	if providerResultURL != "" {
+		updates["providerResultUrl"] = providerResultURL
+	}
+	if elapsed := resolveElapsedSeconds(g.ID); elapsed != nil {
+		updates["elapsedSeconds"] = *elapsed
+	}
+	return database.UpdateGeneration(g.ID, updates)
+}
+
+// decodeHead decodes just enough of a base64 payload to sniff its file signature
+func decodeHead(b64 string) []byte {
+	if len(b64) > 24 {
+		b64 = b64[:24]
+	}
+	head, _ := base64.StdEncoding.DecodeString(b64)
+	return head
+}
+
+// storeDataURLImage decodes a base64 data URL and stores it as a generation output file
+func storeDataURLImage(userID, dataURL string, outputFormat *string) (*models.File, error) {
+	parts := strings.SplitN(dataURL, ",", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("无效的图片数据格式")
+	}
+
+	mimeType := strings.TrimPrefix(parts[0], "data:")
+	mimeType = strings.TrimSuffix(mimeType, ";base64")
+
+	imageData, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("解码图片数据失败：%v", err)
+	}
+	imageData, mimeType = applyOutputFormat(imageData, mimeType, outputFormat)
+
+	file, err := handlers.SaveBufferToFile(userID, "generation-output", mimeType, "", imageData, false)
+	if err != nil {
+		return nil, fmt.Errorf("保存图片失败：%v", err)
+	}
+	return file, nil
+}
+
+// wantsTranscode reports whether an output of mimeType should be re-encoded to outputFormat.
+// Formats without a local encoder (webp, avif) are left to the provider and the original is kept.
+func wantsTranscode(mimeType string, outputFormat *string) bool {
+	return cfg.TranscodeOutputs && outputFormat != nil && fileutil.CanTranscode(*outputFormat) && strings.HasPrefix(mimeType, "image/")
+}
+
+// applyOutputFormat transcodes an image output to the requested format when enabled,
+// keeping the original if the format can't be produced
+func applyOutputFormat(buf []byte, mimeType string, outputFormat *string) ([]byte, string) {
+	if !wantsTranscode(mimeType, outputFormat) {
+		return buf, mimeType
+	}
+
+	out, outMime, err := fileutil.TranscodeImage(buf, mimeType, *outputFormat)
+	if err != nil {
+		log.Printf("[jobs] Keeping original %s output, transcode to %s failed: %v", mimeType, *outputFormat, err)
+		return buf, mimeType
+	}
+	if outMime != mimeType {
+		log.Printf("[jobs] Transcoded output %s -> %s (%d -> %d bytes)", mimeType, outMime, len(buf), len(out))
+	}
+	return out, outMime
+}
@@ -0,0 +1,346 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"flag"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nano-backend/internal/config"
+	"nano-backend/internal/database"
+	"nano-backend/internal/grsai"
+	"nano-backend/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// setupTestConfig installs a fresh config for the test and restores the previous one afterwards
+func setupTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	orig := cfg
+	cfg = config.Load()
+	t.Cleanup(func() { cfg = orig })
+	return cfg
+}
+
+// setupTestDB installs a config pointing at a temp dir and opens a fresh database there
+func setupTestDB(t *testing.T) *config.Config {
+	t.Helper()
+	c := setupTestConfig(t)
+	dir := t.TempDir()
+	c.DataDir = filepath.Join(dir, "data")
+	c.StorageDir = filepath.Join(dir, "storage")
+	if err := database.Init(c); err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return c
+}
+
+// createTestGeneration stores a queued image generation for userID
+func createTestGeneration(t *testing.T, userID string) *models.Generation {
+	t.Helper()
+	now := models.Now()
+	g := &models.Generation{
+		ID:               uuid.New().String(),
+		UserID:           userID,
+		Type:             "image",
+		Prompt:           "a cat",
+		Model:            "nano-banana",
+		Status:           "queued",
+		ReferenceFileIDs: []string{},
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := database.CreateGeneration(g); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// newHeaderServer records the Authorization header of every request it serves
+func newHeaderServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *[]string) {
+	t.Helper()
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &seen
+}
+
+func servePNG(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Write([]byte("\x89PNG\r\n\x1a\n0000"))
+}
+
+func TestDownloadAuthOnlyForProviderHost(t *testing.T) {
+	c := setupTestConfig(t)
+	c.DownloadAuthProviders = "openai"
+
+	// Both servers listen on 127.0.0.1; addressing the other one as localhost makes it a different host
+	provider, providerSeen := newHeaderServer(t, servePNG)
+	storage, storageSeen := newHeaderServer(t, servePNG)
+	storageURL := strings.Replace(storage.URL, "127.0.0.1", "localhost", 1)
+
+	auth := newDownloadAuth(provider.URL, "openai", "sk-test")
+	if auth == nil {
+		t.Fatal("newDownloadAuth returned nil for an opted-in provider")
+	}
+
+	for _, url := range []string{provider.URL + "/result.png", storageURL + "/result.png"} {
+		body, _, err := openRemoteFile(context.Background(), url, auth)
+		if err != nil {
+			t.Fatalf("openRemoteFile(%s): %v", url, err)
+		}
+		body.Close()
+	}
+
+	if got := *providerSeen; len(got) != 1 || got[0] != "Bearer sk-test" {
+		t.Errorf("provider host saw Authorization %q, want the bearer token", got)
+	}
+	if got := *storageSeen; len(got) != 1 || got[0] != "" {
+		t.Errorf("other host saw Authorization %q, want none", got)
+	}
+}
+
+func TestDownloadAuthNotForwardedAcrossRedirect(t *testing.T) {
+	c := setupTestConfig(t)
+	c.DownloadAuthProviders = "openai"
+
+	storage, storageSeen := newHeaderServer(t, servePNG)
+	storageURL := strings.Replace(storage.URL, "127.0.0.1", "localhost", 1)
+	provider, providerSeen := newHeaderServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, storageURL+"/result.png", http.StatusFound)
+	})
+
+	body, _, err := openRemoteFile(context.Background(), provider.URL+"/result.png", newDownloadAuth(provider.URL, "openai", "sk-test"))
+	if err != nil {
+		t.Fatalf("openRemoteFile: %v", err)
+	}
+	body.Close()
+
+	if got := *providerSeen; len(got) != 1 || got[0] != "Bearer sk-test" {
+		t.Errorf("provider host saw Authorization %q, want the bearer token", got)
+	}
+	if got := *storageSeen; len(got) != 1 || got[0] != "" {
+		t.Errorf("redirect target saw Authorization %q, want none", got)
+	}
+}
+
+func TestDownloadAuthRequiresOptIn(t *testing.T) {
+	c := setupTestConfig(t)
+	c.DownloadAuthProviders = "openai"
+
+	if auth := newDownloadAuth("https://api.example.com", "grsai", "sk-test"); auth != nil {
+		t.Errorf("newDownloadAuth = %+v for a provider type that did not opt in, want nil", auth)
+	}
+
+	provider, seen := newHeaderServer(t, servePNG)
+	body, _, err := openRemoteFile(context.Background(), provider.URL+"/result.png", nil)
+	if err != nil {
+		t.Fatalf("openRemoteFile: %v", err)
+	}
+	body.Close()
+	if got := *seen; len(got) != 1 || got[0] != "" {
+		t.Errorf("anonymous download sent Authorization %q", got)
+	}
+}
+
+func TestTickContainsPanickingJob(t *testing.T) {
+	setupTestDB(t)
+	panicking := createTestGeneration(t, "user-1")
+	healthy := createTestGeneration(t, "user-1")
+
+	origCtx, origRun := runnerCtx, runJob
+	runnerCtx = context.Background()
+	runJob = func(ctx context.Context, g *models.Generation) error {
+		if g.ID == panicking.ID {
+			panic("boom")
+		}
+		return database.UpdateGeneration(g.ID, map[string]interface{}{"status": "succeeded"})
+	}
+	t.Cleanup(func() { runnerCtx, runJob = origCtx, origRun })
+
+	tick()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ActiveGenerationIDs()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs still active: %v", ActiveGenerationIDs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g, err := database.GetGenerationByID(panicking.ID)
+	if err != nil || g == nil {
+		t.Fatalf("GetGenerationByID: %v", err)
+	}
+	if g.Status != "failed" || g.Error == nil || *g.Error != "生成任务内部错误" {
+		t.Errorf("panicking job: status=%s error=%v, want failed with the internal error message", g.Status, g.Error)
+	}
+
+	g, err = database.GetGenerationByID(healthy.ID)
+	if err != nil || g == nil {
+		t.Fatalf("GetGenerationByID: %v", err)
+	}
+	if g.Status != "succeeded" {
+		t.Errorf("healthy job status = %s, want succeeded", g.Status)
+	}
+}
+
+// createTestPNG stores a w x h PNG for userID and returns its file ID
+func createTestPNG(t *testing.T, c *config.Config, userID string, w, h int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(c.StorageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(c.StorageDir, uuid.New().String()+".png")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := database.CreateFile(userID, "reference-upload", "image/png", "", path, int64(buf.Len()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.ID
+}
+
+// dataURLBounds decodes an image data URL and returns its dimensions
+func dataURLBounds(t *testing.T, dataURL string) (int, int) {
+	t.Helper()
+	_, payload, ok := strings.Cut(dataURL, ";base64,")
+	if !ok {
+		t.Fatalf("not a base64 data URL: %.40q", dataURL)
+	}
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf.Width, conf.Height
+}
+
+func TestFileToBase64DataShrinksOversizedReference(t *testing.T) {
+	c := setupTestDB(t)
+	c.ReferenceMaxEdge = 64
+	fileID := createTestPNG(t, c, "user-1", 400, 200)
+
+	dataURL, err := fileToBase64Data(fileID)
+	if err != nil {
+		t.Fatalf("fileToBase64Data: %v", err)
+	}
+	if w, h := dataURLBounds(t, dataURL); w != 64 || h != 32 {
+		t.Errorf("encoded reference is %dx%d, want 64x32", w, h)
+	}
+}
+
+func TestFileToBase64DataKeepsReferenceWithoutLimit(t *testing.T) {
+	c := setupTestDB(t)
+	c.ReferenceMaxEdge = 0
+	fileID := createTestPNG(t, c, "user-1", 400, 200)
+
+	dataURL, err := fileToBase64Data(fileID)
+	if err != nil {
+		t.Fatalf("fileToBase64Data: %v", err)
+	}
+	if w, h := dataURLBounds(t, dataURL); w != 400 || h != 200 {
+		t.Errorf("encoded reference is %dx%d, want the original 400x200", w, h)
+	}
+}
+
+func TestHTMLResultIsRejected(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"honest content type", "text/html; charset=utf-8"},
+		{"claims to be an image", "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte("<!DOCTYPE html><html><body>Access denied</body></html>"))
+			}))
+			t.Cleanup(srv.Close)
+
+			g := createTestGeneration(t, "user-1")
+			result := &grsai.TaskResult{Status: "succeeded"}
+			result.Results = append(result.Results, struct {
+				URL string `json:"url,omitempty"`
+				PID string `json:"pid,omitempty"`
+			}{URL: srv.URL + "/result.png"})
+
+			if err := handleGRSAISucceeded(context.Background(), g, result, nil); err != nil {
+				t.Fatalf("handleGRSAISucceeded: %v", err)
+			}
+
+			stored, err := database.GetGenerationByID(g.ID)
+			if err != nil || stored == nil {
+				t.Fatalf("GetGenerationByID: %v", err)
+			}
+			if stored.Status != "failed" || stored.ErrorCode == nil || *stored.ErrorCode != models.ErrorCodeAPIError {
+				t.Errorf("status=%s errorCode=%v, want failed with %s", stored.Status, stored.ErrorCode, models.ErrorCodeAPIError)
+			}
+			if stored.Error == nil || *stored.Error != errNonMediaContent.Error() {
+				t.Errorf("error = %v, want %q", stored.Error, errNonMediaContent)
+			}
+			if stored.OutputFileID != nil {
+				t.Errorf("outputFileId = %s, want none", *stored.OutputFileID)
+			}
+			if used, _ := database.GetUserUsage("user-1"); used != 0 {
+				t.Errorf("user usage = %d bytes, want nothing stored", used)
+			}
+		})
+	}
+}
+
+func TestApplyOutputFormatKeepsOriginalWithoutEncoder(t *testing.T) {
+	c := setupTestConfig(t)
+	c.TranscodeOutputs = true
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"webp", "avif"} {
+		out, mimeType := applyOutputFormat(buf.Bytes(), "image/png", &format)
+		if mimeType != "image/png" || !bytes.Equal(out, buf.Bytes()) {
+			t.Errorf("%s: got %s output, want the original PNG", format, mimeType)
+		}
+	}
+
+	jpeg := "jpeg"
+	if _, mimeType := applyOutputFormat(buf.Bytes(), "image/png", &jpeg); mimeType != "image/jpeg" {
+		t.Errorf("jpeg: got %s output, want image/jpeg", mimeType)
+	}
+}
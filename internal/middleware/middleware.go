@@ -4,17 +4,26 @@ import (
 	"log"
 	"strings"
 
+	"nano-backend/internal/crypto"
 	"nano-backend/internal/database"
 	"nano-backend/internal/models"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-// AuthMiddleware validates the user's token
+// AuthMiddleware validates the user's token from the Authorization header
 func AuthMiddleware(c *fiber.Ctx) error {
-	token := getTokenFromRequest(c)
+	return authenticate(c, false)
+}
+
+func authenticate(c *fiber.Ctx, allowQuery bool) error {
+	token := getTokenFromRequest(c, allowQuery)
 	if token == "" {
-		log.Printf("[auth] No token provided for %s %s", c.Method(), c.Path())
+		if !allowQuery && c.Query("token") != "" {
+			log.Printf("[auth] Deprecated: session token in query string rejected for %s %s, use the Authorization header", c.Method(), c.Path())
+		} else {
+			log.Printf("[auth] No token provided for %s %s", c.Method(), c.Path())
+		}
 		return c.Status(401).JSON(fiber.Map{"error": "未登录或登录已过期"})
 	}
 
@@ -42,18 +51,63 @@ func AuthMiddleware(c *fiber.Ctx) error {
 
 	// Set user in context
 	c.Locals("user", &models.SanitizedUser{
-		ID:       user.ID,
-		Username: user.Username,
-		Role:     user.Role,
+		ID:             user.ID,
+		Username:       user.Username,
+		Role:           user.Role,
+		ImpersonatedBy: session.ImpersonatedBy,
 	})
 	c.Locals("token", token)
 
+	// Audit every state-changing request made under an impersonation session
+	if session.ImpersonatedBy != "" && c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+		log.Printf("[audit] Admin %s acting as user %s: %s %s (req=%s)", session.ImpersonatedBy, user.Username, c.Method(), c.Path(), GetRequestID(c))
+	}
+
 	return c.Next()
 }
 
-// RequireAdmin checks if the user is an admin
+// FileAuthMiddleware authenticates file reads, accepting either a session or a file-scoped access token
+func FileAuthMiddleware(secret string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := c.Query("token")
+		if c.Get("Authorization") != "" || token == "" {
+			return authenticate(c, true)
+		}
+
+		userID, ok := crypto.VerifyFileToken(token, c.Params("id"), secret, models.Now())
+		if !ok {
+			// Older clients still put the session token in file URLs
+			return authenticate(c, true)
+		}
+
+		user, err := database.GetUserByID(userID)
+		if err != nil || user == nil {
+			log.Printf("[auth] User not found for file token: %s", userID)
+			return c.Status(401).JSON(fiber.Map{"error": "未登录或登录已过期"})
+		}
+		// File tokens are not tied to a session, so disabling the account is what revokes them
+		if user.Disabled {
+			return c.Status(401).JSON(fiber.Map{"error": "未登录或登录已过期"})
+		}
+
+		c.Locals("user", &models.SanitizedUser{
+			ID:       user.ID,
+			Username: user.Username,
+			Role:     user.Role,
+		})
+
+		return c.Next()
+	}
+}
+
+// RequireAdmin checks if the user is an admin. It must be mounted after AuthMiddleware;
+// without an authenticated user it answers 401 rather than panicking.
 func RequireAdmin(c *fiber.Ctx) error {
-	user := c.Locals("user").(*models.SanitizedUser)
+	user := GetCurrentUser(c)
+	if user == nil {
+		log.Printf("[auth] RequireAdmin reached without an authenticated user for %s %s", c.Method(), c.Path())
+		return c.Status(401).JSON(fiber.Map{"error": "未登录或登录已过期"})
+	}
 	if user.Role != "admin" {
 		log.Printf("[auth] User %s attempted admin action without permission", user.Username)
 		return c.Status(403).JSON(fiber.Map{"error": "无权限"})
@@ -61,13 +115,24 @@ func RequireAdmin(c *fiber.Ctx) error {
 	return c.Next()
 }
 
-// GetCurrentUser returns the current user from context
+// GetCurrentUser returns the current user from context, or nil when the request isn't authenticated
 func GetCurrentUser(c *fiber.Ctx) *models.SanitizedUser {
-	user := c.Locals("user")
-	if user == nil {
-		return nil
+	user, _ := c.Locals("user").(*models.SanitizedUser)
+	return user
+}
+
+// IsImpersonating reports whether the current session was issued via admin impersonation
+func IsImpersonating(c *fiber.Ctx) bool {
+	user := GetCurrentUser(c)
+	return user != nil && user.ImpersonatedBy != ""
+}
+
+// GetRequestID returns the request ID assigned by the requestid middleware
+func GetRequestID(c *fiber.Ctx) string {
+	if id, ok := c.Locals("requestid").(string); ok {
+		return id
 	}
-	return user.(*models.SanitizedUser)
+	return ""
 }
 
 // GetToken returns the current token from context
@@ -79,7 +144,8 @@ func GetToken(c *fiber.Ctx) string {
 	return token.(string)
 }
 
-func getTokenFromRequest(c *fiber.Ctx) string {
+// getTokenFromRequest reads the session token; the query string is only honoured for file reads
+func getTokenFromRequest(c *fiber.Ctx, allowQuery bool) string {
 	// Try Authorization header
 	auth := c.Get("Authorization")
 	if auth != "" {
@@ -88,7 +154,11 @@ func getTokenFromRequest(c *fiber.Ctx) string {
 		}
 	}
 
-	// Try query parameter
+	if !allowQuery {
+		return ""
+	}
+
+	// Try query parameter (<img src> cannot send headers)
 	token := c.Query("token")
 	if token != "" {
 		return token
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nano-backend/internal/config"
+	"nano-backend/internal/crypto"
+	"nano-backend/internal/database"
+	"nano-backend/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		user *models.SanitizedUser
+		want int
+	}{
+		{"mounted without AuthMiddleware", nil, fiber.StatusUnauthorized},
+		{"regular user", &models.SanitizedUser{ID: "u1", Username: "alice", Role: "user"}, fiber.StatusForbidden},
+		{"admin", &models.SanitizedUser{ID: "u2", Username: "root", Role: "admin"}, fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				if tt.user != nil {
+					c.Locals("user", tt.user)
+				}
+				return c.Next()
+			})
+			app.Get("/admin", RequireAdmin, func(c *fiber.Ctx) error {
+				return c.SendStatus(fiber.StatusOK)
+			})
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/admin", nil), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileAuthMiddlewareToken(t *testing.T) {
+	cfg := config.Load()
+	dir := t.TempDir()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.StorageDir = filepath.Join(dir, "storage")
+	if err := database.Init(cfg); err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	t.Cleanup(database.Close)
+	user, err := database.CreateUser("alice", "alice-password", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/api/files/:id", FileAuthMiddleware(cfg.FileTokenSecret), func(c *fiber.Ctx) error {
+		return c.SendString(GetCurrentUser(c).ID)
+	})
+	get := func(secret string) int {
+		token := crypto.SignFileToken("file-1", user.ID, models.Now()+60_000, secret)
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/files/file-1?token="+token, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(cfg.FileTokenSecret); code != fiber.StatusOK {
+		t.Errorf("valid token: status = %d, want 200", code)
+	}
+	if cfg.FileTokenSecret == cfg.APIKeyEncryptionSecret {
+		t.Error("file tokens are signed with the API key encryption secret itself")
+	}
+	if code := get(cfg.APIKeyEncryptionSecret); code != fiber.StatusUnauthorized {
+		t.Errorf("token signed with the encryption secret: status = %d, want 401", code)
+	}
+
+	if err := database.UpdateUserDisabled(user.ID, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(cfg.FileTokenSecret); code != fiber.StatusUnauthorized {
+		t.Errorf("disabled user: status = %d, want 401", code)
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"math"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -12,7 +15,9 @@ type User struct {
 	Role         string `json:"role"`
 	PasswordHash string `json:"-"`
 	Disabled     bool   `json:"disabled"`
-	CreatedAt    int64  `json:"createdAt"`
+	// 管理员填写的禁用原因，登录被拒时展示给用户
+	DisabledReason string `json:"disabledReason,omitempty"`
+	CreatedAt      int64  `json:"createdAt"`
 	// 新增字段
 	IsLoggedIn      bool  `json:"isLoggedIn"`      // 是否在线
 	LastHeartbeatAt int64 `json:"lastHeartbeatAt"` // 最后心跳时间
@@ -23,12 +28,35 @@ type Session struct {
 	UserID    string `gorm:"index" json:"userId"`
 	CreatedAt int64  `json:"createdAt"`
 	ExpiresAt int64  `json:"expiresAt"`
+	// ImpersonatedBy is the admin user ID when the session was issued via impersonation
+	ImpersonatedBy string `json:"impersonatedBy,omitempty"`
 }
 
 type UserProvider struct {
 	UserID       string `gorm:"primaryKey" json:"userId"`
 	ProviderHost string `json:"providerHost"`
+	ProviderType string `json:"providerType"` // "" 表示按服务地址自动识别
 	APIKeyEnc    string `json:"-"`
+	Locked       bool   `json:"locked"` // 管理员锁定后普通用户不能修改
+	UpdatedAt    int64  `json:"updatedAt"`
+}
+
+// UserPrefs 用户个人偏好，例如请求未指定模型时使用的默认模型
+type UserPrefs struct {
+	DefaultModel string `json:"defaultModel"`
+	UpdatedAt    int64  `json:"updatedAt"`
+}
+
+// ProviderProfile 用户保存的命名服务商配置，可按次选择或设为默认
+type ProviderProfile struct {
+	ID           string `json:"id"`
+	UserID       string `json:"userId"`
+	Name         string `json:"name"`
+	ProviderHost string `json:"providerHost"`
+	ProviderType string `json:"providerType"`
+	APIKeyEnc    string `json:"-"`
+	IsDefault    bool   `json:"isDefault"`
+	CreatedAt    int64  `json:"createdAt"`
 	UpdatedAt    int64  `json:"updatedAt"`
 }
 
@@ -63,6 +91,14 @@ type Generation struct {
 	AspectRatio       *string              `json:"aspectRatio,omitempty"`
 	Favorite          bool                 `json:"favorite"`
 	OutputFileID      *string              `json:"-"`
+	OutputFileIDs     []string             `gorm:"serializer:json" json:"-"`
+	OutputFormat      *string              `json:"outputFormat,omitempty"`
+	RequestID         *string              `json:"-"`
+	ProviderHost      *string              `json:"-"` // 单次请求指定的服务商，为空时使用用户保存的设置
+	ProviderType      *string              `json:"-"`
+	ProviderKeyEnc    *string              `json:"-"`
+	ProviderProfileID *string              `json:"-"`
+	DedupeKey         *string              `json:"-"`
 	Duration          *int                 `json:"duration,omitempty"`
 	VideoSize         *string              `json:"videoSize,omitempty"`
 	RunID             *string              `gorm:"index" json:"runId,omitempty"`
@@ -77,6 +113,43 @@ type Preset struct {
 	Name      string `json:"name"`
 	Prompt    string `json:"prompt"`
 	CreatedAt int64  `json:"createdAt"`
+	// Variables 为提示词中的 {name} 占位符，按首次出现顺序，不入库
+	Variables []string `gorm:"-" json:"variables"`
+}
+
+// promptVariablePattern matches {name} placeholders; names are letters, digits or underscores
+var promptVariablePattern = regexp.MustCompile(`\{([\p{L}\p{N}_]+)\}`)
+
+// PromptVariables returns the distinct placeholder names in a prompt template, in order of first use
+func PromptVariables(prompt string) []string {
+	vars := []string{}
+	seen := make(map[string]bool)
+	for _, m := range promptVariablePattern.FindAllStringSubmatch(prompt, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			vars = append(vars, m[1])
+		}
+	}
+	return vars
+}
+
+// RenderPrompt substitutes every placeholder with its value from vars.
+// It returns the names of placeholders with no (or a blank) value; the prompt is only valid when none are missing.
+func RenderPrompt(prompt string, vars map[string]string) (string, []string) {
+	missing := []string{}
+	for _, name := range PromptVariables(prompt) {
+		if strings.TrimSpace(vars[name]) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", missing
+	}
+
+	rendered := promptVariablePattern.ReplaceAllStringFunc(prompt, func(m string) string {
+		return strings.TrimSpace(vars[m[1:len(m)-1]])
+	})
+	return rendered, nil
 }
 
 type LibraryItem struct {
@@ -125,7 +198,31 @@ type ModelInfo struct {
 	Type                string   `json:"type"`
 	SupportsImageSize   bool     `json:"supportsImageSize"`
 	SupportsAspectRatio bool     `json:"supportsAspectRatio"`
+	AspectRatios        []string `json:"aspectRatios,omitempty"`
+	Sizes               []string `json:"sizes,omitempty"`
+	MaxBatch            int      `json:"maxBatch"`      // 单次请求最多生成的数量
+	MaxReferences       int      `json:"maxReferences"` // 单次请求最多可带的参考图数量
 	Tags                []string `json:"tags"`
+	Disabled            bool     `json:"disabled"` // 管理员临时停用，停用期间拒绝新的生成请求
+}
+
+// SupportsAspect reports whether the model accepts the given aspect ratio
+func (m *ModelInfo) SupportsAspect(aspectRatio string) bool {
+	return len(m.AspectRatios) == 0 || containsString(m.AspectRatios, aspectRatio)
+}
+
+// SupportsSize reports whether the model accepts the given image size / video size
+func (m *ModelInfo) SupportsSize(size string) bool {
+	return len(m.Sizes) == 0 || containsString(m.Sizes, size)
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 type GenerationResponse struct {
@@ -144,8 +241,11 @@ type GenerationResponse struct {
 	AspectRatio      *string              `json:"aspectRatio"`
 	Duration         *int                 `json:"duration"`
 	VideoSize        *string              `json:"videoSize"`
+	OutputFormat     *string              `json:"outputFormat,omitempty"`
 	ReferenceFileIDs []string             `json:"referenceFileIds"`
 	OutputFile       *StoredFile          `json:"outputFile"`
+	OutputFiles      []*StoredFile        `json:"outputFiles,omitempty"`
+	OutputExpired    bool                 `json:"outputExpired"` // 已成功但结果文件已被过期清理
 	RunID            *string              `json:"runId"`
 	NodePosition     *int                 `json:"nodePosition"`
 	CreatedAt        int64                `json:"createdAt"`
@@ -173,6 +273,8 @@ type ReferenceUploadResponse struct {
 	CreatedAt    int64       `json:"createdAt"`
 	File         *StoredFile `json:"file"`
 	OriginalName string      `json:"originalName,omitempty"`
+	// Error is set instead of ID/File when this file of a batch upload was rejected
+	Error string `json:"error,omitempty"`
 }
 
 type SanitizedUser struct {
@@ -180,6 +282,10 @@ type SanitizedUser struct {
 	Username string `json:"username"`
 	Role     string `json:"role"`
 	Disabled bool   `json:"disabled"`
+	// ImpersonatedBy is set when the current session is an admin impersonating this user
+	ImpersonatedBy string `json:"impersonatedBy,omitempty"`
+	// Prefs is only filled in by GET /api/auth/me
+	Prefs *UserPrefs `json:"prefs,omitempty"`
 }
 
 type Settings struct {
@@ -187,30 +293,65 @@ type Settings struct {
 	ReferenceHistoryLimit int `json:"referenceHistoryLimit"`
 	ImageTimeoutSeconds   int `json:"imageTimeoutSeconds"`
 	VideoTimeoutSeconds   int `json:"videoTimeoutSeconds"`
+	// 临时停用的模型 ID，用于上游单个模型故障时快速下线
+	DisabledModels []string `json:"disabledModels"`
 }
 
 // --- 影视项目审阅系统模型 ---
 
 type ReviewProject struct {
-	ID           string `gorm:"primaryKey" json:"id"`
-	UserID       string `gorm:"index" json:"userId"` // 创建者
-	Name         string `json:"name"`
-	CoverFileID  string `json:"coverFileId"`           // 关联 File 表 ID
-	EpisodeCount int    `gorm:"-" json:"episodeCount"` // 动态计算或缓存
-	CreatedAt    int64  `json:"createdAt"`
-	UpdatedAt    int64  `json:"updatedAt"`
+	ID           string         `gorm:"primaryKey" json:"id"`
+	UserID       string         `gorm:"index" json:"userId"` // 创建者
+	Name         string         `json:"name"`
+	Description  string         `json:"description"`           // 简介/导演备注
+	CoverFileID  string         `json:"coverFileId"`           // 关联 File 表 ID
+	EpisodeCount int            `gorm:"-" json:"episodeCount"` // 动态计算或缓存
+	Progress     ReviewProgress `gorm:"-" json:"progress"`     // 项目下所有分镜的审阅进度
+	CreatedAt    int64          `json:"createdAt"`
+	UpdatedAt    int64          `json:"updatedAt"`
 }
 
 type ReviewEpisode struct {
-	ID              string `gorm:"primaryKey" json:"id"`
-	ProjectID       string `gorm:"index" json:"projectId"`
-	UserID          string `gorm:"index" json:"userId"`
-	Name            string `json:"name"`
-	CoverFileID     string `json:"coverFileId"`
-	StoryboardCount int    `gorm:"-" json:"storyboardCount"`
-	SortOrder       int    `json:"sortOrder"`
-	CreatedAt       int64  `json:"createdAt"`
-	UpdatedAt       int64  `json:"updatedAt"`
+	ID              string         `gorm:"primaryKey" json:"id"`
+	ProjectID       string         `gorm:"index" json:"projectId"`
+	UserID          string         `gorm:"index" json:"userId"`
+	Name            string         `json:"name"`
+	Description     string         `json:"description"`
+	CoverFileID     string         `json:"coverFileId"`
+	StoryboardCount int            `gorm:"-" json:"storyboardCount"`
+	Progress        ReviewProgress `gorm:"-" json:"progress"`
+	SortOrder       int            `json:"sortOrder"`
+	CreatedAt       int64          `json:"createdAt"`
+	UpdatedAt       int64          `json:"updatedAt"`
+}
+
+// ReviewProgress 分镜审阅进度统计 (动态计算)
+type ReviewProgress struct {
+	PendingCount    int     `json:"pendingCount"`
+	ApprovedCount   int     `json:"approvedCount"`
+	RejectedCount   int     `json:"rejectedCount"`
+	ApprovedPercent float64 `json:"approvedPercent"` // 0-100，保留一位小数
+}
+
+// Total 返回统计到的分镜总数
+func (p *ReviewProgress) Total() int {
+	return p.PendingCount + p.ApprovedCount + p.RejectedCount
+}
+
+// AddStatusCount 累加某一状态的分镜数量并重新计算通过率
+func (p *ReviewProgress) AddStatusCount(status string, count int) {
+	switch status {
+	case StoryboardStatusApproved:
+		p.ApprovedCount += count
+	case StoryboardStatusRejected:
+		p.RejectedCount += count
+	default:
+		p.PendingCount += count
+	}
+	total := p.Total()
+	if total > 0 {
+		p.ApprovedPercent = math.Round(float64(p.ApprovedCount)*1000/float64(total)) / 10
+	}
 }
 
 type ReviewStoryboard struct {
@@ -222,16 +363,73 @@ type ReviewStoryboard struct {
 	Status      string `json:"status"`              // pending(未审阅), approved(通过), rejected(未通过)
 	Feedback    string `json:"feedback"`            // 修改建议
 	SortOrder   int    `json:"sortOrder"`           // 用于拖拽排序
+	ReviewedBy  string `json:"reviewedBy"`          // 最近一次审阅人 ID
+	ReviewedAt  *int64 `json:"reviewedAt"`          // 最近一次审阅时间
 	CreatedAt   int64  `json:"createdAt"`
 	UpdatedAt   int64  `json:"updatedAt"`
 }
 
+// 服务商类型 (空字符串表示按服务地址自动识别)
+const (
+	ProviderTypeAuto   = ""
+	ProviderTypeGRSAI  = "grsai"
+	ProviderTypeGemini = "gemini"
+	ProviderTypeOpenAI = "openai"
+)
+
+// IsValidProviderType 判断服务商类型是否为允许的取值
+func IsValidProviderType(providerType string) bool {
+	switch providerType {
+	case ProviderTypeAuto, ProviderTypeGRSAI, ProviderTypeGemini, ProviderTypeOpenAI:
+		return true
+	}
+	return false
+}
+
+// 分镜审阅状态
+const (
+	StoryboardStatusPending  = "pending"
+	StoryboardStatusApproved = "approved"
+	StoryboardStatusRejected = "rejected"
+)
+
+// IsValidStoryboardStatus 判断分镜状态是否为允许的取值
+func IsValidStoryboardStatus(status string) bool {
+	switch status {
+	case StoryboardStatusPending, StoryboardStatusApproved, StoryboardStatusRejected:
+		return true
+	}
+	return false
+}
+
 // 响应结构体 (用于前端展示)
+type ReviewProjectResponse struct {
+	ReviewProject
+	CoverURL string `json:"coverUrl"`
+}
+
+type ReviewEpisodeResponse struct {
+	ReviewEpisode
+	CoverURL string `json:"coverUrl"`
+}
+
 type ReviewStoryboardResponse struct {
 	ReviewStoryboard
 	ImageURL string `json:"imageUrl"`
 }
 
+// ReviewProjectDetailResponse 项目详情，内嵌单集及其分镜
+type ReviewProjectDetailResponse struct {
+	ReviewProjectResponse
+	Episodes []ReviewEpisodeDetailResponse `json:"episodes"`
+}
+
+// ReviewEpisodeDetailResponse 单集及其分镜；分镜数多于返回条数时以 storyboardCount 为准
+type ReviewEpisodeDetailResponse struct {
+	ReviewEpisodeResponse
+	Storyboards []ReviewStoryboardResponse `json:"storyboards"`
+}
+
 // --- 工具函数 ---
 
 func Now() int64 {
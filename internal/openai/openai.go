@@ -0,0 +1,248 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"nano-backend/internal/crypto"
+)
+
+// maxResponseBytes caps the response body; inline b64_json images make it large but never unbounded.
+// A variable so tests can lower it.
+var maxResponseBytes int64 = 64 << 20
+
+// Client talks to an OpenAI-compatible images API (/v1/images/generations and /v1/images/edits)
+type Client struct {
+	Host    string
+	APIKey  crypto.SecretString
+	Timeout time.Duration
+}
+
+// NewClient creates a new OpenAI-compatible images client
+func NewClient(host string, apiKey crypto.SecretString, timeout time.Duration) *Client {
+	return &Client{
+		Host:    strings.TrimRight(host, "/"),
+		APIKey:  apiKey,
+		Timeout: timeout,
+	}
+}
+
+// APIError is returned when the gateway answers with a non-2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// Retryable reports whether the failure is likely transient (rate limiting or a server error)
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ImageRequest is the body for /v1/images/generations
+type ImageRequest struct {
+	Model          string `json:"model,omitempty"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
+
+// ReferenceImage is an input image sent to /v1/images/edits
+type ReferenceImage struct {
+	MimeType string
+	Data     []byte
+}
+
+// ImageResponse is the images API response
+type ImageResponse struct {
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+	Error   *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// ImageData is a single generated image, returned either inline (b64_json) or as a URL
+type ImageData struct {
+	B64JSON       string `json:"b64_json,omitempty"`
+	URL           string `json:"url,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+// SizeForAspect maps an aspect ratio onto the closest size the images API accepts.
+// An empty result means "let the provider decide" and the field is omitted.
+func SizeForAspect(aspectRatio string) string {
+	parts := strings.SplitN(aspectRatio, ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	w, errW := strconv.ParseFloat(parts[0], 64)
+	h, errH := strconv.ParseFloat(parts[1], 64)
+	if errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return ""
+	}
+
+	switch ratio := w / h; {
+	case ratio > 1.1:
+		return "1536x1024"
+	case ratio < 0.9:
+		return "1024x1536"
+	default:
+		return "1024x1024"
+	}
+}
+
+// endpoint accepts hosts configured with or without the /v1 suffix
+func (c *Client) endpoint(path string) string {
+	if strings.HasSuffix(c.Host, "/v1") {
+		return c.Host + path
+	}
+	return c.Host + "/v1" + path
+}
+
+// CreateImage generates images from a prompt, or edits the reference images when any are given
+func (c *Client) CreateImage(ctx context.Context, req ImageRequest, references []ReferenceImage) (*ImageResponse, error) {
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = "b64_json"
+	}
+
+	var body io.Reader
+	var contentType, url string
+	if len(references) == 0 {
+		jsonBody, err := json.Marshal(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(jsonBody)
+		contentType = "application/json"
+		url = c.endpoint("/images/generations")
+	} else {
+		buf, ct, err := buildEditForm(req, references)
+		if err != nil {
+			return nil, err
+		}
+		body = buf
+		contentType = ct
+		url = c.endpoint("/images/edits")
+	}
+
+	log.Printf("[openai] POST %s (model=%s, size=%s, refs=%d)", url, req.Model, req.Size, len(references))
+	startTime := time.Now()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("Authorization", "Bearer "+c.APIKey.Reveal())
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 180 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		log.Printf("[openai] Request failed after %v: %v", time.Since(startTime), err)
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if int64(len(respBody)) > maxResponseBytes {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxResponseBytes)
+	}
+	log.Printf("[openai] Response Status: %d (took %v)", resp.StatusCode, time.Since(startTime))
+
+	var result ImageResponse
+	jsonErr := json.Unmarshal(respBody, &result)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg := strings.TrimSpace(string(respBody))
+		if jsonErr == nil && result.Error != nil && result.Error.Message != "" {
+			msg = result.Error.Message
+		}
+		if len(msg) > 500 {
+			msg = msg[:500]
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: msg}
+	}
+	if jsonErr != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", jsonErr)
+	}
+	if result.Error != nil && result.Error.Message != "" {
+		return nil, fmt.Errorf("%s", result.Error.Message)
+	}
+
+	return &result, nil
+}
+
+// buildEditForm encodes an edits request as multipart/form-data with one image[] part per reference
+func buildEditForm(req ImageRequest, references []ReferenceImage) (*bytes.Buffer, string, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+
+	fields := map[string]string{
+		"model":           req.Model,
+		"prompt":          req.Prompt,
+		"size":            req.Size,
+		"response_format": req.ResponseFormat,
+	}
+	if req.N > 0 {
+		fields["n"] = strconv.Itoa(req.N)
+	}
+	for key, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := w.WriteField(key, value); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for i, ref := range references {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image[]"; filename="reference-%d%s"`, i, extForMime(ref.MimeType)))
+		header.Set("Content-Type", ref.MimeType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(ref.Data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf, w.FormDataContentType(), nil
+}
+
+func extForMime(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".png"
+	}
+}
@@ -0,0 +1,98 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer answers every request with the given status and body and records the request path
+func newTestServer(t *testing.T, status int, body string, gotPath *string) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gotPath != nil {
+			*gotPath = r.URL.Path
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL, "test-key", 5*time.Second)
+}
+
+func TestCreateImageB64(t *testing.T) {
+	var path string
+	client := newTestServer(t, http.StatusOK, `{"created":1,"data":[{"b64_json":"aGVsbG8="}]}`, &path)
+
+	resp, err := client.CreateImage(context.Background(), ImageRequest{Model: "gpt-image-1", Prompt: "cat"}, nil)
+	if err != nil {
+		t.Fatalf("CreateImage: %v", err)
+	}
+	if path != "/v1/images/generations" {
+		t.Errorf("path = %q, want /v1/images/generations", path)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].B64JSON != "aGVsbG8=" {
+		t.Errorf("data = %+v, want one b64 image", resp.Data)
+	}
+}
+
+func TestCreateImageURLWithReferences(t *testing.T) {
+	var path string
+	client := newTestServer(t, http.StatusOK, `{"created":1,"data":[{"url":"https://cdn.example.com/a.png"}]}`, &path)
+
+	refs := []ReferenceImage{{MimeType: "image/png", Data: []byte("png")}}
+	resp, err := client.CreateImage(context.Background(), ImageRequest{Prompt: "cat", ResponseFormat: "url"}, refs)
+	if err != nil {
+		t.Fatalf("CreateImage: %v", err)
+	}
+	if path != "/v1/images/edits" {
+		t.Errorf("path = %q, want /v1/images/edits", path)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].URL != "https://cdn.example.com/a.png" {
+		t.Errorf("data = %+v, want one url image", resp.Data)
+	}
+}
+
+func TestCreateImageAPIError(t *testing.T) {
+	client := newTestServer(t, http.StatusTooManyRequests, `{"error":{"message":"slow down"}}`, nil)
+
+	_, err := client.CreateImage(context.Background(), ImageRequest{Prompt: "cat"}, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *APIError", err)
+	}
+	if apiErr.Message != "slow down" || !apiErr.Retryable() {
+		t.Errorf("apiErr = %+v, want retryable \"slow down\"", apiErr)
+	}
+}
+
+func TestCreateImageRejectsOversizedResponse(t *testing.T) {
+	old := maxResponseBytes
+	maxResponseBytes = 1024
+	t.Cleanup(func() { maxResponseBytes = old })
+
+	body := `{"created":1,"data":[{"b64_json":"` + strings.Repeat("A", 4096) + `"}]}`
+	client := newTestServer(t, http.StatusOK, body, nil)
+
+	_, err := client.CreateImage(context.Background(), ImageRequest{Prompt: "cat"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("err = %v, want size limit error", err)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"nano-backend/internal/config"
+	"nano-backend/internal/crypto"
 	"nano-backend/internal/database"
+	"nano-backend/internal/fileutil"
 	"nano-backend/internal/handlers"
 	"nano-backend/internal/jobs"
 	"nano-backend/internal/middleware"
@@ -16,6 +18,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/joho/godotenv"
 )
 
@@ -27,6 +30,12 @@ func main() {
 
 	// Initialize config
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("[config] Invalid configuration: %v", err)
+	}
+	log.Printf("[config] DATA_DIR = %s, STORAGE_DIR = %s", cfg.DataDir, cfg.StorageDir)
+	fileutil.MaxDecodePixels = int64(cfg.ImageMaxMegapixels) * 1_000_000
+	crypto.PasswordParams = crypto.ScryptParams{N: cfg.PasswordScryptN, R: cfg.PasswordScryptR, P: cfg.PasswordScryptP}
 
 	// Initialize database
 	if err := database.Init(cfg); err != nil {
@@ -41,20 +50,23 @@ func main() {
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
-		BodyLimit: 25 * 1024 * 1024, // 25MB
+		BodyLimit: handlers.MaxUploadBytes,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
 				code = e.Code
 			}
-			log.Printf("[error] %s %s - %v", c.Method(), c.Path(), err)
+			log.Printf("[error] %s %s (req %s) - %v", c.Method(), c.Path(), middleware.GetRequestID(c), err)
 			return c.Status(code).JSON(fiber.Map{"error": err.Error()})
 		},
 	})
 
+	// Request ID: reuse the client's X-Request-ID or generate one, echoed back in the response
+	app.Use(requestid.New())
+
 	// Logger middleware with detailed request logging
 	app.Use(logger.New(logger.Config{
-		Format:     "[${time}] ${status} ${method} ${path} - ${latency} - ${ip} - ${ua}\n",
+		Format:     "[${time}] ${status} ${method} ${path} - ${latency} - ${ip} - ${ua} - req=${locals:requestid}\n",
 		TimeFormat: "2006-01-02 15:04:05",
 		TimeZone:   "Local",
 	}))
@@ -65,33 +77,42 @@ func main() {
 		AllowCredentials: true,
 		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
 		AllowMethods:     "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		ExposeHeaders:    "X-Total-Count, X-Request-ID",
 	}))
 
 	// Setup routes
 	setupRoutes(app, cfg)
 
 	// Start job runner
+	handlers.ActiveJobs = jobs.ActiveGenerationIDs
+	handlers.CancelJob = jobs.CancelGeneration
 	jobs.StartJobRunner(cfg)
 
 	// Start cleanup loops
 	go func() {
-		ticker := time.NewTicker(1 * time.Hour) // 你的原有清理逻辑
+		ticker := time.NewTicker(cfg.CleanupInterval()) // 你的原有清理逻辑
+		sessionTicker := time.NewTicker(cfg.SessionCleanupInterval())
 
 		// 新增：心跳检查 ticker，每分钟检查一次
 		heartbeatTicker := time.NewTicker(1 * time.Minute)
 
 		defer ticker.Stop()
+		defer sessionTicker.Stop()
 		defer heartbeatTicker.Stop()
 
 		// Run immediately
 		database.CleanupExpiredSessions()
 		database.CleanupExpiredFiles(cfg)
+		database.ReconcileUserUsage()
 
 		for {
 			select {
 			case <-ticker.C:
-				database.CleanupExpiredSessions()
 				database.CleanupExpiredFiles(cfg)
+				database.ReconcileUserUsage()
+
+			case <-sessionTicker.C:
+				database.CleanupExpiredSessions()
 
 			case <-heartbeatTicker.C:
 				// === 方案第4点：每分钟检查一次，将超过10分钟没发心跳的用户置为未登录 ===
@@ -112,6 +133,7 @@ func main() {
 	go func() {
 		<-c
 		log.Println("[server] Shutting down...")
+		jobs.StopJobRunner()
 		app.Shutdown()
 	}()
 
@@ -126,6 +148,8 @@ func main() {
 func setupRoutes(app *fiber.App, cfg *config.Config) {
 	// Health check
 	app.Get("/api/health", handlers.HealthCheck)
+	app.Get("/api/version", handlers.GetVersion)
+	app.Get("/api/config", handlers.GetPublicConfig)
 
 	// Auth routes (no auth required)
 	app.Post("/api/auth/login", handlers.Login)
@@ -141,26 +165,47 @@ func setupRoutes(app *fiber.App, cfg *config.Config) {
 	// 前端需定时（如每5分钟）POST 此接口
 	app.Post("/api/auth/heartbeat", authMiddleware, handlers.Heartbeat)
 
+	// Storage usage
+	app.Get("/api/usage", authMiddleware, handlers.GetStorageUsage)
+
 	// Models
 	app.Get("/api/models", authMiddleware, handlers.GetModels)
 
 	// Provider settings
 	app.Get("/api/settings/provider", authMiddleware, handlers.GetProviderSettings)
 	app.Put("/api/settings/provider", authMiddleware, handlers.UpdateProviderSettings)
+	app.Get("/api/settings/prefs", authMiddleware, handlers.GetUserPrefs)
+	app.Put("/api/settings/prefs", authMiddleware, handlers.UpdateUserPrefs)
+	app.Get("/api/settings/providers", authMiddleware, handlers.ListProviderProfiles)
+	app.Post("/api/settings/providers", authMiddleware, handlers.CreateProviderProfile)
+	app.Put("/api/settings/providers/:id", authMiddleware, handlers.UpdateProviderProfile)
+	app.Delete("/api/settings/providers/:id", authMiddleware, handlers.DeleteProviderProfile)
 
 	// Admin routes
 	adminMiddleware := middleware.RequireAdmin
 	app.Get("/api/admin/users", authMiddleware, adminMiddleware, handlers.AdminListUsers)
 	app.Post("/api/admin/users", authMiddleware, adminMiddleware, handlers.AdminCreateUser)
+	app.Post("/api/admin/users/import", authMiddleware, adminMiddleware, handlers.AdminImportUsers)
 	app.Delete("/api/admin/users/:id", authMiddleware, adminMiddleware, handlers.AdminDeleteUser)
 	app.Patch("/api/admin/users/:id/status", authMiddleware, adminMiddleware, handlers.AdminUpdateUserStatus)
+	app.Post("/api/admin/users/:id/impersonate", authMiddleware, adminMiddleware, handlers.AdminImpersonateUser)
+	app.Put("/api/admin/users/:id/provider", authMiddleware, adminMiddleware, handlers.AdminSetUserProvider)
+	app.Get("/api/admin/generation-errors", authMiddleware, adminMiddleware, handlers.AdminGetGenerationErrors)
+	app.Get("/api/admin/generations/:id", authMiddleware, adminMiddleware, handlers.AdminGetGeneration)
+	app.Post("/api/admin/generations/requeue-failed", authMiddleware, adminMiddleware, handlers.AdminRequeueFailedGenerations)
+	app.Get("/api/admin/jobs", authMiddleware, adminMiddleware, handlers.AdminGetJobs)
 	app.Get("/api/admin/settings", authMiddleware, adminMiddleware, handlers.AdminGetSettings)
 	app.Put("/api/admin/settings", authMiddleware, adminMiddleware, handlers.AdminUpdateSettings)
 
 	// Generations
 	app.Get("/api/generations", authMiddleware, handlers.ListGenerations)
+	app.Post("/api/generations/cancel-all", authMiddleware, handlers.CancelAllGenerations)
 	app.Get("/api/generations/:id", authMiddleware, handlers.GetGeneration)
+	app.Get("/api/generations/:id/wait", authMiddleware, handlers.WaitGeneration)
+	app.Get("/api/generations/:id/references", authMiddleware, handlers.ListGenerationReferences)
 	app.Patch("/api/generations/:id/favorite", authMiddleware, handlers.ToggleFavorite)
+	app.Patch("/api/generations/:id", authMiddleware, handlers.EditGeneration)
+	app.Post("/api/generations/:id/submit", authMiddleware, handlers.SubmitGeneration)
 	app.Delete("/api/generations/:id", authMiddleware, handlers.DeleteGeneration)
 
 	// Generate
@@ -170,24 +215,30 @@ func setupRoutes(app *fiber.App, cfg *config.Config) {
 	// Video runs
 	app.Get("/api/video/runs", authMiddleware, handlers.ListVideoRuns)
 	app.Post("/api/video/runs", authMiddleware, handlers.CreateVideoRun)
+	app.Delete("/api/video/runs/:id", authMiddleware, handlers.DeleteVideoRun)
+	app.Get("/api/video/runs/:id/generations", authMiddleware, handlers.ListVideoRunGenerations)
 
 	// Presets
 	app.Get("/api/presets", authMiddleware, handlers.ListPresets)
 	app.Post("/api/presets", authMiddleware, handlers.CreatePreset)
+	app.Post("/api/presets/reorder", authMiddleware, handlers.ReorderPresets)
+	app.Post("/api/presets/:id/render", authMiddleware, handlers.RenderPreset)
 	app.Delete("/api/presets/:id", authMiddleware, handlers.DeletePreset)
 
 	// Library
 	app.Get("/api/library", authMiddleware, handlers.ListLibrary)
 	app.Post("/api/library", authMiddleware, handlers.CreateLibraryItem)
+	app.Post("/api/library/from-reference", authMiddleware, handlers.CreateLibraryItemFromReference)
 	app.Delete("/api/library/:id", authMiddleware, handlers.DeleteLibraryItem)
 
 	// Reference uploads
 	app.Get("/api/reference-uploads", authMiddleware, handlers.ListReferenceUploads)
 	app.Post("/api/reference-uploads", authMiddleware, handlers.CreateReferenceUploads)
+	app.Delete("/api/reference-uploads", authMiddleware, handlers.ClearReferenceUploads)
 	app.Delete("/api/reference-uploads/:id", authMiddleware, handlers.DeleteReferenceUpload)
 
 	// Files (authenticated)
-	app.Get("/api/files/:id", authMiddleware, handlers.GetFile)
+	app.Get("/api/files/:id", middleware.FileAuthMiddleware(cfg.FileTokenSecret), handlers.GetFile)
 
 	// Files (public - for provider to fetch reference images)
 	app.Get("/public/files/:id", handlers.GetPublicFile)
@@ -202,20 +253,24 @@ func setupRoutes(app *fiber.App, cfg *config.Config) {
 	review.Get("/projects", handlers.ListReviewProjects)
 	review.Post("/projects", handlers.CreateReviewProject)
 	review.Get("/projects/:id", handlers.GetReviewProject)
+	review.Get("/projects/:id/full", handlers.GetReviewProjectFull)
 	review.Put("/projects/:id", handlers.UpdateReviewProject)
 	review.Delete("/projects/:id", handlers.DeleteReviewProject)
+	review.Post("/projects/:id/duplicate", handlers.DuplicateReviewProject)
 
 	// 单集
 	review.Get("/projects/:projectId/episodes", handlers.ListReviewEpisodes)
 	review.Post("/projects/:projectId/episodes", handlers.CreateReviewEpisode)
 	review.Put("/episodes/reorder", handlers.ReorderEpisodes)
 	review.Get("/episodes/:id", handlers.GetReviewEpisode)
+	review.Get("/episodes/:id/contact-sheet", handlers.GetReviewEpisodeContactSheet)
 	review.Put("/episodes/:id", handlers.UpdateReviewEpisode)
 	review.Delete("/episodes/:id", handlers.DeleteReviewEpisode)
 
 	// 分镜
 	review.Get("/episodes/:episodeId/storyboards", handlers.ListReviewStoryboards)
 	review.Post("/episodes/:episodeId/storyboards", handlers.CreateReviewStoryboard)
+	review.Post("/episodes/:episodeId/storyboards/batch", handlers.BatchCreateReviewStoryboards)
 	review.Put("/storyboards/reorder", handlers.ReorderStoryboards)
 	review.Patch("/storyboards/:id/status", handlers.ReviewStoryboard)
 	review.Put("/storyboards/:id", handlers.UpdateReviewStoryboard)
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nano-backend/internal/config"
+	"nano-backend/internal/database"
+	"nano-backend/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer wires setupRoutes against a fresh database with the initial admin account
+func newTestServer(t *testing.T) (*fiber.App, *config.Config) {
+	t.Helper()
+	cfg := config.Load()
+	dir := t.TempDir()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.StorageDir = filepath.Join(dir, "storage")
+	if err := database.Init(cfg); err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	t.Cleanup(database.Close)
+	if err := database.EnsureInitialAdmin(cfg); err != nil {
+		t.Fatalf("EnsureInitialAdmin: %v", err)
+	}
+
+	app := fiber.New()
+	setupRoutes(app, cfg)
+	return app, cfg
+}
+
+// call sends body as JSON with the bearer token (when set), decoding the response into out
+func call(t *testing.T, app *fiber.App, token, method, target string, body interface{}, out interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, target, raw, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// login signs in through the real route and returns the session token
+func login(t *testing.T, app *fiber.App, username, password string) string {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if code := call(t, app, "", "POST", "/api/auth/login", fiber.Map{"username": username, "password": password}, &resp); code != 200 || resp.Token == "" {
+		t.Fatalf("login %s: status = %d, token = %q", username, code, resp.Token)
+	}
+	return resp.Token
+}
+
+func TestReviewRoutesSmoke(t *testing.T) {
+	app, cfg := newTestServer(t)
+
+	if code := call(t, app, "", "GET", "/api/review/projects", nil, nil); code != 401 {
+		t.Fatalf("anonymous review request: status = %d, want 401", code)
+	}
+	token := login(t, app, cfg.InitAdminUsername, cfg.InitAdminPassword)
+
+	var project struct {
+		ID string `json:"id"`
+	}
+	if code := call(t, app, token, "POST", "/api/review/projects", fiber.Map{"name": "project"}, &project); code != 200 {
+		t.Fatalf("create project: status = %d", code)
+	}
+
+	var episodeIDs []string
+	for _, name := range []string{"ep1", "ep2"} {
+		var episode struct {
+			ID string `json:"id"`
+		}
+		if code := call(t, app, token, "POST", "/api/review/projects/"+project.ID+"/episodes", fiber.Map{"name": name}, &episode); code != 200 {
+			t.Fatalf("create episode: status = %d", code)
+		}
+		episodeIDs = append(episodeIDs, episode.ID)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		body   interface{}
+		want   int
+		// wantErr pins which handler answered where a static path shadows an :id route
+		wantErr string
+	}{
+		{"GET", "/api/review/projects", nil, 200, ""},
+		{"GET", "/api/review/projects/" + project.ID, nil, 200, ""},
+		{"GET", "/api/review/projects/" + project.ID + "/full", nil, 200, ""},
+		{"GET", "/api/review/projects/" + project.ID + "/episodes", nil, 200, ""},
+		{"GET", "/api/review/episodes/" + episodeIDs[0], nil, 200, ""},
+		{"GET", "/api/review/episodes/" + episodeIDs[0] + "/storyboards", nil, 200, ""},
+		{"PUT", "/api/review/episodes/reorder", fiber.Map{"episodeIds": []string{episodeIDs[1], episodeIDs[0]}}, 200, ""},
+		{"PUT", "/api/review/storyboards/reorder", fiber.Map{"storyboardIds": []string{}}, 400, "分镜ID列表不能为空"},
+		{"PATCH", "/api/review/storyboards/missing/status", fiber.Map{"status": "approved"}, 404, "分镜不存在"},
+		{"PUT", "/api/review/storyboards/missing", fiber.Map{"name": "x"}, 404, "分镜不存在"},
+		{"DELETE", "/api/review/storyboards/missing", nil, 404, ""},
+		{"PUT", "/api/review/episodes/" + episodeIDs[0], fiber.Map{"name": "renamed"}, 200, ""},
+		{"DELETE", "/api/review/episodes/" + episodeIDs[1], nil, 200, ""},
+		{"POST", "/api/review/projects/" + project.ID + "/duplicate", nil, 200, ""},
+		{"DELETE", "/api/review/projects/" + project.ID, nil, 200, ""},
+	}
+	for _, tt := range tests {
+		var raw json.RawMessage
+		code := call(t, app, token, tt.method, tt.target, tt.body, &raw)
+		var resp struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(raw, &resp) // list endpoints answer with an array
+		if code != tt.want {
+			t.Errorf("%s %s: status = %d (%s), want %d", tt.method, tt.target, code, resp.Error, tt.want)
+		}
+		if tt.wantErr != "" && resp.Error != tt.wantErr {
+			t.Errorf("%s %s: error = %q, want %q", tt.method, tt.target, resp.Error, tt.wantErr)
+		}
+	}
+}
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	app, cfg := newTestServer(t)
+	adminToken := login(t, app, cfg.InitAdminUsername, cfg.InitAdminPassword)
+
+	newUser := fiber.Map{"username": "alice", "password": "alice-password", "role": "user"}
+	if code := call(t, app, adminToken, "POST", "/api/admin/users", newUser, nil); code != 200 {
+		t.Fatalf("create user: status = %d", code)
+	}
+	userToken := login(t, app, "alice", "alice-password")
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", 401},
+		{userToken, 403},
+		{adminToken, 200},
+	} {
+		if code := call(t, app, tt.token, "GET", "/api/admin/users", nil, nil); code != tt.want {
+			t.Errorf("GET /api/admin/users: status = %d, want %d", code, tt.want)
+		}
+	}
+}
+
+func TestAdminGenerationFileURLsOpen(t *testing.T) {
+	app, cfg := newTestServer(t)
+	adminToken := login(t, app, cfg.InitAdminUsername, cfg.InitAdminPassword)
+	alice, err := database.CreateUser("alice", "alice-password", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(cfg.StorageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(cfg.StorageDir, "output.png")
+	if err := os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n0000"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := database.CreateFile(alice.ID, "generation-output", "image/png", "", path, 12, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := models.Now()
+	gen := &models.Generation{ID: uuid.New().String(), UserID: alice.ID, Type: "image", Prompt: "a cat", Model: "nano-banana",
+		Status: "succeeded", ReferenceFileIDs: []string{}, OutputFileID: &file.ID, CreatedAt: now, UpdatedAt: now}
+	if err := database.CreateGeneration(gen); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		Generation models.GenerationResponse `json:"generation"`
+	}
+	if code := call(t, app, adminToken, "GET", "/api/admin/generations/"+gen.ID, nil, &resp); code != 200 {
+		t.Fatalf("admin get generation: status = %d", code)
+	}
+	if resp.Generation.OutputFile == nil {
+		t.Fatal("admin view has no output file")
+	}
+
+	// The URL is opened the way a browser would, without the admin's session
+	target := strings.TrimPrefix(resp.Generation.OutputFile.URL, cfg.PublicBaseURL)
+	if code := call(t, app, "", "GET", target, nil, nil); code != 200 {
+		t.Errorf("GET %s: status = %d, want 200", target, code)
+	}
+}